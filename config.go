@@ -5,17 +5,46 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
+
+	"golang.org/x/oauth2"
+
+	"lenslockedbr.com/hash"
+	"lenslockedbr.com/models"
+	"lenslockedbr.com/oidc"
+	"lenslockedbr.com/pwcheck"
 )
 
+// dropboxUserInfoURL is the OpenID Connect userinfo endpoint of
+// Dropbox, which only accepts POST requests.
+const dropboxUserInfoURL = "https://api.dropboxapi.com/2/openid/userinfo"
+
 type Config struct {
 	Port    int    `json:"port"`
 	Env     string `json:"env"`
 	Pepper  string `json:"pepper"`
 	HMACKey string `json:"hmac_key"`
 
+	// Retired peppers and HMAC keys are still accepted for what was
+	// hashed with them, and upgraded to the current ones whenever
+	// possible. Only drop one once nothing depends on it anymore.
+	RetiredPeppers  []string `json:"retired_peppers"`
+	RetiredHMACKeys []string `json:"retired_hmac_keys"`
+
+	Password PasswordConfig `json:"password"`
+
+	// StorageQuota is the number of bytes of images each user can
+	// store, unless an admin gave them another quota. It defaults to
+	// models.DefaultStorageQuota.
+	StorageQuota int64 `json:"storage_quota"`
+
 	Database PostgresConfig `json:"database"`
 	Mailgun  MailgunConfig  `json:"mailgun"`
 	Dropbox OAuthConfig `json:"dropbox"`
+
+	// OIDC lists the other OpenID Connect providers users can sign
+	// in with, by the name used in their URLs.
+	OIDC map[string]OAuthConfig `json:"oidc"`
 }
 
 func DefaultConfig() Config {
@@ -32,6 +61,41 @@ func (c Config) IsProd() bool {
 	return c.Env == "prod"
 }
 
+// Providers returns the OAuth providers, Dropbox first and then the
+// OpenID Connect ones by name. Providers without a client ID and
+// secret are left out, so nobody is offered a login that can't work.
+func (c Config) Providers() []*oidc.Provider {
+
+	var providers []*oidc.Provider
+
+	dropbox := c.Dropbox
+	if dropbox.Configured() {
+		if dropbox.Label == "" {
+			dropbox.Label = "Dropbox"
+		}
+		if dropbox.UserInfoURL == "" {
+			dropbox.UserInfoURL = dropboxUserInfoURL
+			dropbox.UserInfoMethod = "POST"
+		}
+		providers = append(providers,
+			dropbox.Provider(models.OAuthDropbox))
+	}
+
+	var names []string
+	for name, provider := range c.OIDC {
+		if provider.Configured() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		providers = append(providers, c.OIDC[name].Provider(name))
+	}
+
+	return providers
+}
+
 func LoadConfig(configReq bool) Config {
 	// Open the config file
 	f, err := os.Open(".config")
@@ -91,18 +155,99 @@ func (c PostgresConfig) ConnectionInfo() string {
 		c.User, c.Password, c.Name)
 }
 
+// PasswordConfig picks how new passwords are hashed. Existing hashes
+// are upgraded the next time their owner logs in. Empty fields fall
+// back to the defaults of the hash and pwcheck packages.
+//
+// BreachedPasswords is the directory of a downloaded copy of the
+// Have I Been Pwned hashes, see pwcheck.Dataset. Leave it empty to
+// skip the check.
+type PasswordConfig struct {
+	Algorithm     string `json:"algorithm"`
+	BcryptCost    int    `json:"bcrypt_cost"`
+	Argon2Memory  uint32 `json:"argon2_memory"`
+	Argon2Time    uint32 `json:"argon2_time"`
+	Argon2Threads uint8  `json:"argon2_threads"`
+
+	BreachedPasswords string `json:"breached_passwords"`
+	MinStrength       int    `json:"min_strength"`
+}
+
+func (c PasswordConfig) Hasher(pepper string, retired ...string) hash.Password {
+	return hash.NewPassword(hash.PasswordConfig{
+		Algorithm:     c.Algorithm,
+		BcryptCost:    c.BcryptCost,
+		Argon2Memory:  c.Argon2Memory,
+		Argon2Time:    c.Argon2Time,
+		Argon2Threads: c.Argon2Threads,
+	}, pepper, retired...)
+}
+
+func (c PasswordConfig) Policy() pwcheck.Policy {
+
+	policy := pwcheck.Policy{
+		MinStrength: c.MinStrength,
+	}
+	if policy.MinStrength == 0 {
+		policy.MinStrength = pwcheck.DefaultMinStrength
+	}
+	if c.BreachedPasswords != "" {
+		policy.Breached = pwcheck.NewDataset(c.BreachedPasswords)
+	}
+
+	return policy
+}
+
 type MailgunConfig struct {
 	APIKey       string `json:"api_key"`
 	PublicAPIKey string `json:"public_api_key"`
 	Domain       string `json:"domain"`
 }
 
+// OAuthConfig describes an OAuth provider. Users can only sign in
+// with it if it has a userinfo URL, and the scopes requested must
+// include openid and email for it to tell us who they are.
 type OAuthConfig struct {
 	ID string `json:"id"`
 	Secret string `json:"secret"`
 	AuthURL string `json:"auth_url"`
 	TokenURL string `json:"token_url"`
 	RedirectURL string `json:"redirect_url"`
+
+	Label          string   `json:"label"`
+	Scopes         []string `json:"scopes"`
+	UserInfoURL    string   `json:"userinfo_url"`
+	UserInfoMethod string   `json:"userinfo_method"`
+}
+
+// Configured reports whether the client ID and secret are set.
+func (c OAuthConfig) Configured() bool {
+	return c.ID != "" && c.Secret != ""
+}
+
+func (c OAuthConfig) Provider(name string) *oidc.Provider {
+
+	label := c.Label
+	if label == "" {
+		label = name
+	}
+
+	return &oidc.Provider{
+		Name:  name,
+		Label: label,
+		Config: &oauth2.Config{
+			ClientID:     c.ID,
+			ClientSecret: c.Secret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  c.AuthURL,
+				TokenURL: c.TokenURL,
+			},
+			RedirectURL: c.RedirectURL,
+			Scopes:      c.Scopes,
+		},
+		UserInfoURL:    c.UserInfoURL,
+		UserInfoMethod: c.UserInfoMethod,
+	}
 }
 
 
@@ -8,7 +8,10 @@ import (
 type privateKey string
 
 const (
-	userKey privateKey = "user"
+	userKey         privateKey = "user"
+	sessionKey      privateKey = "session"
+	impersonatorKey privateKey = "impersonator"
+	apiTokenKey     privateKey = "api_token"
 )
 
 func WithUser(ctx context.Context, user *models.User) context.Context {
@@ -24,3 +27,49 @@ func User(ctx context.Context) *models.User {
 
 	return nil
 }
+
+func WithSession(ctx context.Context, session *models.Session) context.Context {
+	return context.WithValue(ctx, sessionKey, session)
+}
+
+func Session(ctx context.Context) *models.Session {
+	if temp := ctx.Value(sessionKey); temp != nil {
+		if session, ok := temp.(*models.Session); ok {
+			return session
+		}
+	}
+
+	return nil
+}
+
+// WithImpersonator stores the admin acting as the user of the
+// request, if any.
+func WithImpersonator(ctx context.Context, admin *models.User) context.Context {
+	return context.WithValue(ctx, impersonatorKey, admin)
+}
+
+func Impersonator(ctx context.Context) *models.User {
+	if temp := ctx.Value(impersonatorKey); temp != nil {
+		if admin, ok := temp.(*models.User); ok {
+			return admin
+		}
+	}
+
+	return nil
+}
+
+// WithAPIToken stores the API token the request was authenticated
+// with, if any.
+func WithAPIToken(ctx context.Context, token *models.APIToken) context.Context {
+	return context.WithValue(ctx, apiTokenKey, token)
+}
+
+func APIToken(ctx context.Context) *models.APIToken {
+	if temp := ctx.Value(apiTokenKey); temp != nil {
+		if token, ok := temp.(*models.APIToken); ok {
+			return token
+		}
+	}
+
+	return nil
+}
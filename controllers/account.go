@@ -0,0 +1,786 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	qrcode "github.com/skip2/go-qrcode"
+
+	"lenslockedbr.com/context"
+	"lenslockedbr.com/email"
+	"lenslockedbr.com/models"
+	"lenslockedbr.com/views"
+)
+
+type ChangePasswordForm struct {
+	CurrentPassword string `schema:"current_password"`
+	NewPassword     string `schema:"new_password"`
+}
+
+type ChangeEmailForm struct {
+	NewEmail string `schema:"new_email"`
+	Password string `schema:"password"`
+}
+
+type DeleteAccountForm struct {
+	Password string `schema:"password"`
+}
+
+type APITokenForm struct {
+	Name   string   `schema:"name"`
+	Scopes []string `schema:"scopes"`
+}
+
+// HasScope reports whether the scope was ticked, to keep the form
+// filled in when it is displayed again.
+func (f APITokenForm) HasScope(scope string) bool {
+
+	for _, s := range f.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+type ExportDownloadForm struct {
+	Token string `schema:"token"`
+}
+
+type TwoFactorForm struct {
+	Code string `schema:"code"`
+}
+
+// TwoFactorData is what the two-factor settings page expects as its
+// Yield. Only the fields relevant to the current step are set.
+type TwoFactorData struct {
+	User          *models.User
+	Secret        string
+	QRCode        template.URL
+	RecoveryCodes []string
+}
+
+// SessionsData is what the sessions page expects as its Yield.
+type SessionsData struct {
+	Sessions  []models.Session
+	CurrentID uint
+}
+
+// APITokensData is what the API tokens page expects as its Yield.
+// NewToken is only set right after a token is created, as it can't
+// be displayed again.
+type APITokensData struct {
+	Tokens   []models.APIToken
+	Scopes   []models.APIScope
+	NewToken *models.APIToken
+	Form     APITokenForm
+}
+
+const (
+	// activityLimit is the number of audit events on the activity
+	// page.
+	activityLimit = 50
+
+	// maxImportSize caps the size of uploaded archives. The storage
+	// quota of the user is enforced by the import itself.
+	maxImportSize = 4 << 30 // 4 gigabytes
+)
+
+type Account struct {
+	IndexView     *views.View
+	TwoFactorView *views.View
+	SessionsView  *views.View
+	APITokensView *views.View
+	ActivityView  *views.View
+	ExportView    *views.View
+	PasswordView  *views.View
+	EmailView     *views.View
+	DeleteView    *views.View
+	us            models.UserService
+	as            models.AuditService
+	es            models.ExportService
+	importer      models.ImportService
+	emailer       *email.Client
+}
+
+func NewAccount(us models.UserService, as models.AuditService,
+	es models.ExportService, importer models.ImportService,
+	emailer *email.Client) *Account {
+	return &Account{
+		IndexView: views.NewView("bootstrap", false,
+			"account/index"),
+		TwoFactorView: views.NewView("bootstrap", false,
+			"account/two_factor"),
+		SessionsView: views.NewView("bootstrap", false,
+			"account/sessions"),
+		APITokensView: views.NewView("bootstrap", false,
+			"account/tokens"),
+		ActivityView: views.NewView("bootstrap", false,
+			"account/activity"),
+		ExportView: views.NewView("bootstrap", false,
+			"account/export"),
+		PasswordView: views.NewView("bootstrap", false,
+			"account/password"),
+		EmailView: views.NewView("bootstrap", false,
+			"account/email"),
+		DeleteView: views.NewView("bootstrap", false,
+			"account/delete"),
+		us:       us,
+		as:       as,
+		es:       es,
+		importer: importer,
+		emailer:  emailer,
+	}
+}
+
+// Index displays the account settings of the current user.
+//
+// GET /account
+func (a *Account) Index(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	vd.Yield = context.User(r.Context())
+	a.IndexView.Render(w, r, vd)
+}
+
+// TwoFactor displays the current two-factor authentication status
+// along with the forms to enable or disable it.
+//
+// GET /account/2fa
+func (a *Account) TwoFactor(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	vd.Yield = TwoFactorData{
+		User: context.User(r.Context()),
+	}
+	a.TwoFactorView.Render(w, r, vd)
+}
+
+// EnrollTwoFactor generates a new TOTP secret and displays it, both
+// as a QR code and in plain text, so it can be added to an
+// authenticator app.
+//
+// POST /account/2fa/enroll
+func (a *Account) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+
+	user := context.User(r.Context())
+	data := TwoFactorData{
+		User: user,
+	}
+	vd.Yield = &data
+
+	url, err := a.us.EnrollTOTP(user)
+	if err != nil {
+		vd.SetAlert(err)
+		a.TwoFactorView.Render(w, r, vd)
+		return
+	}
+
+	png, err := qrcode.Encode(url, qrcode.Medium, 256)
+	if err != nil {
+		vd.SetAlert(err)
+		a.TwoFactorView.Render(w, r, vd)
+		return
+	}
+
+	data.Secret = user.TOTPSecret
+	data.QRCode = template.URL("data:image/png;base64," +
+		base64.StdEncoding.EncodeToString(png))
+
+	a.TwoFactorView.Render(w, r, vd)
+}
+
+// ConfirmTwoFactor enables two-factor authentication once the first
+// code from the authenticator app is verified, and displays the
+// recovery codes.
+//
+// POST /account/2fa/confirm
+func (a *Account) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form TwoFactorForm
+
+	user := context.User(r.Context())
+	data := TwoFactorData{
+		User: user,
+	}
+	vd.Yield = &data
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.TwoFactorView.Render(w, r, vd)
+		return
+	}
+
+	codes, err := a.us.ConfirmTOTP(user, form.Code)
+	if err != nil {
+		vd.SetAlert(err)
+		a.TwoFactorView.Render(w, r, vd)
+		return
+	}
+
+	data.RecoveryCodes = codes
+	vd.Alert = &views.Alert{
+		Level: views.AlertLvlSuccess,
+		Message: "Two-factor authentication is now enabled. " +
+			"Please store your recovery codes somewhere safe.",
+	}
+
+	a.TwoFactorView.Render(w, r, vd)
+}
+
+// DisableTwoFactor turns two-factor authentication off.
+//
+// POST /account/2fa/disable
+func (a *Account) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form TwoFactorForm
+
+	user := context.User(r.Context())
+	vd.Yield = TwoFactorData{
+		User: user,
+	}
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.TwoFactorView.Render(w, r, vd)
+		return
+	}
+
+	if err := a.us.DisableTOTP(user, form.Code); err != nil {
+		vd.SetAlert(err)
+		a.TwoFactorView.Render(w, r, vd)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Two-factor authentication has been disabled.",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// Sessions lists every device the current user is signed in on.
+//
+// GET /account/sessions
+func (a *Account) Sessions(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+
+	user := context.User(r.Context())
+	sessions, err := a.us.Sessions(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		a.SessionsView.Render(w, r, vd)
+		return
+	}
+
+	data := SessionsData{
+		Sessions: sessions,
+	}
+	if current := context.Session(r.Context()); current != nil {
+		data.CurrentID = current.ID
+	}
+	vd.Yield = data
+
+	a.SessionsView.Render(w, r, vd)
+}
+
+// RevokeSession signs the current user out of a single session.
+//
+// POST /account/sessions/:id/revoke
+func (a *Account) RevokeSession(w http.ResponseWriter, r *http.Request) {
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusNotFound)
+		return
+	}
+
+	user := context.User(r.Context())
+	err = a.us.RevokeSession(user.ID, uint(id))
+	switch err {
+	case nil:
+	case models.ErrNotFound:
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	default:
+		http.Error(w, "Whoops! Something went wrong.",
+			http.StatusInternalServerError)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "The session has been signed out.",
+	}
+	views.RedirectAlert(w, r, "/account/sessions", http.StatusFound,
+		alert)
+}
+
+// RevokeOtherSessions signs the current user out everywhere except
+// on the device making the request.
+//
+// POST /account/sessions/revoke
+func (a *Account) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+
+	var currentID uint
+	if current := context.Session(r.Context()); current != nil {
+		currentID = current.ID
+	}
+
+	user := context.User(r.Context())
+	err := a.us.RevokeOtherSessions(user.ID, currentID)
+	if err != nil {
+		http.Error(w, "Whoops! Something went wrong.",
+			http.StatusInternalServerError)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "All other sessions have been signed out.",
+	}
+	views.RedirectAlert(w, r, "/account/sessions", http.StatusFound,
+		alert)
+}
+
+// Activity lists the recent security related events of the current
+// user's account, like logins and password changes.
+//
+// GET /account/activity
+func (a *Account) Activity(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+
+	user := context.User(r.Context())
+	events, err := a.as.ByUserID(user.ID, activityLimit)
+	if err != nil {
+		vd.SetAlert(err)
+		a.ActivityView.Render(w, r, vd)
+		return
+	}
+	vd.Yield = events
+
+	a.ActivityView.Render(w, r, vd)
+}
+
+// Export displays the latest export of the current user's data along
+// with the form to request a new one. Yield is nil when they never
+// asked for one.
+//
+// GET /account/export
+func (a *Account) Export(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+
+	user := context.User(r.Context())
+	export, err := a.es.Latest(user)
+	switch err {
+	case nil:
+		vd.Yield = export
+	case models.ErrNotFound:
+	default:
+		vd.SetAlert(err)
+	}
+
+	a.ExportView.Render(w, r, vd)
+}
+
+// RequestExport starts building an archive of the current user's
+// data in the background. They are emailed a link to download it
+// once it is ready.
+//
+// POST /account/export
+func (a *Account) RequestExport(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+
+	user := context.User(r.Context())
+	export, err := a.es.Request(user)
+	if err != nil {
+		vd.SetAlert(err)
+		a.ExportView.Render(w, r, vd)
+		return
+	}
+
+	a.as.Log(user, actor(r), models.AuditExportRequested, "",
+		clientInfo(r))
+
+	go a.buildExport(user, export)
+
+	alert := views.Alert{
+		Level: views.AlertLvlInfo,
+		Message: "We are preparing your export. You will get an " +
+			"email with a link to download it as soon as it is " +
+			"ready.",
+	}
+	views.RedirectAlert(w, r, "/account/export", http.StatusFound, alert)
+}
+
+// DownloadExport sends the archive of an export of the current user,
+// found by the token of the link emailed to them.
+//
+// GET /account/export/download
+func (a *Account) DownloadExport(w http.ResponseWriter, r *http.Request) {
+
+	var form ExportDownloadForm
+	if err := parseURLParams(r, &form); err != nil {
+		redirectError(w, r, "/account/export", err)
+		return
+	}
+
+	user := context.User(r.Context())
+	export, err := a.es.Download(user, form.Token)
+	switch err {
+	case nil:
+	case models.ErrNotFound:
+		redirectError(w, r, "/account/export", models.ErrExportExpired)
+		return
+	default:
+		redirectError(w, r, "/account/export", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="`+export.Filename()+`"`)
+	http.ServeFile(w, r, export.Path())
+}
+
+// ImportArchive recreates the galleries of an archive exported from
+// this or another instance for the current user.
+//
+// POST /account/import
+func (a *Account) ImportArchive(w http.ResponseWriter, r *http.Request) {
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	if err := r.ParseMultipartForm(maxMultipartMem); err != nil {
+		redirectError(w, r, "/account/export", err)
+		return
+	}
+
+	file, header, err := r.FormFile("archive")
+	if err != nil {
+		redirectError(w, r, "/account/export", models.ErrImportInvalid)
+		return
+	}
+	defer file.Close()
+
+	user := context.User(r.Context())
+	result, err := a.importer.Import(user, file, header.Size)
+	if err != nil {
+		redirectError(w, r, "/account/export", err)
+		return
+	}
+
+	a.as.Log(user, actor(r), models.AuditArchiveImported,
+		result.Summary(), clientInfo(r))
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Imported " + result.Summary() + ".",
+	}
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
+}
+
+// APITokens lists the API tokens of the current user along with the
+// form to create a new one.
+//
+// GET /account/tokens
+func (a *Account) APITokens(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+
+	user := context.User(r.Context())
+	data, err := a.apiTokensData(user)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = data
+
+	a.APITokensView.Render(w, r, vd)
+}
+
+// CreateAPIToken creates a new API token for the current user and
+// displays it, this being the only time it can be seen.
+//
+// POST /account/tokens
+func (a *Account) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form APITokenForm
+
+	user := context.User(r.Context())
+	data, err := a.apiTokensData(user)
+	vd.Yield = data
+	if err != nil {
+		vd.SetAlert(err)
+		a.APITokensView.Render(w, r, vd)
+		return
+	}
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.APITokensView.Render(w, r, vd)
+		return
+	}
+	data.Form = form
+
+	token, err := a.us.CreateAPIToken(user, form.Name, form.Scopes)
+	if err != nil {
+		vd.SetAlert(err)
+		a.APITokensView.Render(w, r, vd)
+		return
+	}
+
+	data.NewToken = token
+	data.Form = APITokenForm{}
+	data.Tokens = append([]models.APIToken{*token}, data.Tokens...)
+
+	vd.Alert = &views.Alert{
+		Level: views.AlertLvlSuccess,
+		Message: "Your token has been created. Copy it now, " +
+			"you won't be able to see it again!",
+	}
+	a.APITokensView.Render(w, r, vd)
+}
+
+// RevokeAPIToken deletes an API token of the current user. Scripts
+// using it can't authenticate anymore.
+//
+// POST /account/tokens/:id/revoke
+func (a *Account) RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusNotFound)
+		return
+	}
+
+	user := context.User(r.Context())
+	err = a.us.RevokeAPIToken(user.ID, uint(id))
+	switch err {
+	case nil:
+	case models.ErrNotFound:
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	default:
+		http.Error(w, "Whoops! Something went wrong.",
+			http.StatusInternalServerError)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "The token has been revoked.",
+	}
+	views.RedirectAlert(w, r, "/account/tokens", http.StatusFound,
+		alert)
+}
+
+// ChangePassword updates the password of the current user. Changing
+// it signs the user out everywhere, so a new session is started for
+// the device making the request.
+//
+// POST /account/password
+func (a *Account) ChangePassword(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form ChangePasswordForm
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.PasswordView.Render(w, r, vd)
+		return
+	}
+
+	user := context.User(r.Context())
+	err := a.us.ChangePassword(user, context.Session(r.Context()),
+		form.CurrentPassword, form.NewPassword, clientInfo(r))
+	if err != nil {
+		vd.SetAlert(err)
+		a.PasswordView.Render(w, r, vd)
+		return
+	}
+
+	if err := a.emailer.PasswordChanged(user.Name, user.Email); err != nil {
+		log.Println(err)
+	}
+
+	if err := signIn(w, r, a.us, user); err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	alert := views.Alert{
+		Level: views.AlertLvlSuccess,
+		Message: "Your password has been changed and every other " +
+			"device has been signed out.",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// ChangeEmail sends a confirmation link to the new email address,
+// and a notice to the current one. The address is only changed once
+// the link is followed.
+//
+// POST /account/email
+func (a *Account) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form ChangeEmailForm
+
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.EmailView.Render(w, r, vd)
+		return
+	}
+
+	user := context.User(r.Context())
+	token, err := a.us.InitiateEmailChange(user,
+		context.Session(r.Context()), form.Password, form.NewEmail)
+	if err != nil {
+		vd.SetAlert(err)
+		a.EmailView.Render(w, r, vd)
+		return
+	}
+
+	if err := a.emailer.ConfirmEmailChange(form.NewEmail, token); err != nil {
+		vd.SetAlert(err)
+		a.EmailView.Render(w, r, vd)
+		return
+	}
+
+	err = a.emailer.EmailChangeRequested(user.Name, user.Email,
+		form.NewEmail)
+	if err != nil {
+		log.Println(err)
+	}
+
+	alert := views.Alert{
+		Level: views.AlertLvlSuccess,
+		Message: "Almost done! Please follow the link we sent to " +
+			"your new email address to confirm the change.",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// ConfirmEmail completes an email change with the token sent to the
+// new address. It doesn't require the user to be logged in, since
+// the link may well be opened on another device.
+//
+// GET /account/email/confirm
+func (a *Account) ConfirmEmail(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form VerifyForm
+
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.EmailView.Render(w, r, vd)
+		return
+	}
+
+	if _, err := a.us.CompleteEmailChange(form.Token); err != nil {
+		vd.SetAlert(err)
+		a.EmailView.Render(w, r, vd)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your email address has been changed!",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// Delete schedules the current user's account for deletion once they
+// confirm their password, and signs them out. Everything they own is
+// only purged after models.DeletionGracePeriod, so logging back in
+// before that restores the account.
+//
+// POST /account/delete
+func (a *Account) Delete(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form DeleteAccountForm
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.DeleteView.Render(w, r, vd)
+		return
+	}
+
+	user := context.User(r.Context())
+	session := context.Session(r.Context())
+	if err := a.us.ScheduleDeletion(user, session, form.Password); err != nil {
+		vd.SetAlert(err)
+		a.DeleteView.Render(w, r, vd)
+		return
+	}
+
+	err := a.emailer.DeletionScheduled(user.Name, user.Email,
+		user.DeletionDate())
+	if err != nil {
+		log.Println(err)
+	}
+
+	cookie := http.Cookie{
+		Name:     "remember_cookie",
+		Value:    "",
+		Expires:  time.Now(),
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+
+	alert := views.Alert{
+		Level: views.AlertLvlInfo,
+		Message: "Your account will be deleted on " +
+			user.DeletionDate().Format("January 2, 2006") +
+			". Log in before then if you change your mind.",
+	}
+	views.RedirectAlert(w, r, "/", http.StatusFound, alert)
+}
+
+// buildExport builds the archive of the export and emails the user
+// the link to download it. It runs once the request that asked for
+// it is over, so failures can only be logged.
+func (a *Account) buildExport(user *models.User, export *models.Export) {
+
+	if err := a.es.Build(user, export); err != nil {
+		log.Println("controllers: building export:", err)
+		return
+	}
+
+	err := a.emailer.ExportReady(user.Name, user.Email, export.Token,
+		*export.ExpiresAt)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Account) apiTokensData(user *models.User) (*APITokensData, error) {
+
+	data := APITokensData{
+		Scopes: models.APIScopes,
+	}
+
+	tokens, err := a.us.APITokens(user.ID)
+	if err != nil {
+		return &data, err
+	}
+	data.Tokens = tokens
+
+	return &data, nil
+}
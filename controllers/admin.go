@@ -0,0 +1,494 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"lenslockedbr.com/context"
+	"lenslockedbr.com/models"
+	"lenslockedbr.com/views"
+)
+
+const (
+	adminPerPage = 25
+
+	megabyte = 1 << 20
+)
+
+type AdminSearchForm struct {
+	Query string `schema:"q"`
+	Page  int    `schema:"page"`
+}
+
+// AdminQuotaForm overrides the storage quota of a user, in megabytes.
+// An empty quota brings them back to the default one.
+type AdminQuotaForm struct {
+	Quota string `schema:"quota"`
+}
+
+// Pagination is used by the admin pages listing many records.
+type Pagination struct {
+	Page  int
+	Pages int
+	Total int
+}
+
+func (p Pagination) HasPrev() bool {
+	return p.Page > 1
+}
+
+func (p Pagination) HasNext() bool {
+	return p.Page < p.Pages
+}
+
+func (p Pagination) Prev() int {
+	return p.Page - 1
+}
+
+func (p Pagination) Next() int {
+	return p.Page + 1
+}
+
+// AdminUsersData is what the user search page expects as its Yield.
+type AdminUsersData struct {
+	Query string
+	Users []models.User
+	Pagination
+}
+
+// AdminGallery describes a gallery of the user looked at by an admin.
+type AdminGallery struct {
+	models.Gallery
+	ImageCount int
+	Size       string
+}
+
+// AdminUserData is what the user details page expects as its Yield.
+// QuotaMB is the quota picked for the user, zero for the default one.
+type AdminUserData struct {
+	User      *models.User
+	Galleries []AdminGallery
+	Storage   *StorageMeter
+	QuotaMB   int64
+	Actions   []models.AdminAction
+}
+
+// AdminLogData is what the admin log page expects as its Yield.
+type AdminLogData struct {
+	Actions []models.AdminAction
+	Pagination
+}
+
+type Admin struct {
+	UsersView *views.View
+	UserView  *views.View
+	LogView   *views.View
+	us        models.UserService
+	gs        models.GalleryService
+	is        models.ImageService
+	as        models.AdminService
+}
+
+func NewAdmin(us models.UserService, gs models.GalleryService,
+	is models.ImageService, as models.AdminService) *Admin {
+	return &Admin{
+		UsersView: views.NewView("bootstrap", false,
+			"admin/users", "admin/partials"),
+		UserView: views.NewView("bootstrap", false,
+			"admin/user", "admin/partials"),
+		LogView: views.NewView("bootstrap", false,
+			"admin/log", "admin/partials"),
+		us: us,
+		gs: gs,
+		is: is,
+		as: as,
+	}
+}
+
+// Users searches users by email, name or handle.
+//
+// GET /admin/users
+func (a *Admin) Users(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form AdminSearchForm
+
+	data := AdminUsersData{}
+	vd.Yield = &data
+
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.UsersView.Render(w, r, vd)
+		return
+	}
+	data.Query = form.Query
+
+	page := pageNumber(form.Page)
+	users, total, err := a.us.Search(form.Query,
+		(page-1)*adminPerPage, adminPerPage)
+	if err != nil {
+		vd.SetAlert(err)
+		a.UsersView.Render(w, r, vd)
+		return
+	}
+
+	data.Users = users
+	data.Pagination = paginate(page, total)
+
+	a.UsersView.Render(w, r, vd)
+}
+
+// User displays a user along with their galleries, storage use and
+// the admin actions taken on their account.
+//
+// GET /admin/users/:id
+func (a *Admin) User(w http.ResponseWriter, r *http.Request) {
+
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+
+	var vd views.Data
+	data := AdminUserData{
+		User:    user,
+		QuotaMB: user.StorageQuota / megabyte,
+	}
+	vd.Yield = &data
+
+	galleries, err := a.gs.ByUserID(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		a.UserView.Render(w, r, vd)
+		return
+	}
+
+	for _, gallery := range galleries {
+		images, _ := a.is.ByGalleryID(gallery.ID)
+		size, err := a.is.DiskUsage(gallery.ID)
+		if err != nil {
+			log.Println(err)
+		}
+		data.Galleries = append(data.Galleries, AdminGallery{
+			Gallery:    gallery,
+			ImageCount: len(images),
+			Size:       formatBytes(size),
+		})
+	}
+
+	storage, err := a.is.Storage(user)
+	if err != nil {
+		vd.SetAlert(err)
+		a.UserView.Render(w, r, vd)
+		return
+	}
+	data.Storage = newStorageMeter(storage)
+
+	data.Actions, err = a.as.ByTargetUserID(user.ID, adminPerPage)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+
+	a.UserView.Render(w, r, vd)
+}
+
+// Disable prevents a user from logging in and signs them out. Admins,
+// the current one included, can't be disabled: a stolen admin session
+// could otherwise lock every other admin out, leaving nobody to enable
+// the accounts again.
+//
+// POST /admin/users/:id/disable
+func (a *Admin) Disable(w http.ResponseWriter, r *http.Request) {
+
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if user.IsAdmin {
+		http.Error(w, "Admins can't be disabled.",
+			http.StatusForbidden)
+		return
+	}
+
+	if err := a.us.Disable(user); err != nil {
+		http.Error(w, "Whoops! Something went wrong.",
+			http.StatusInternalServerError)
+		return
+	}
+
+	admin := context.User(r.Context())
+	a.log(admin, user, models.AdminActionDisable, "", r)
+	a.redirectToUser(w, r, user, "The account has been disabled.")
+}
+
+// Enable lets a disabled user log in again.
+//
+// POST /admin/users/:id/enable
+func (a *Admin) Enable(w http.ResponseWriter, r *http.Request) {
+
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if err := a.us.Enable(user); err != nil {
+		http.Error(w, "Whoops! Something went wrong.",
+			http.StatusInternalServerError)
+		return
+	}
+
+	admin := context.User(r.Context())
+	a.log(admin, user, models.AdminActionEnable, "", r)
+	a.redirectToUser(w, r, user, "The account has been enabled.")
+}
+
+// SetQuota overrides the storage quota of a user.
+//
+// POST /admin/users/:id/quota
+func (a *Admin) SetQuota(w http.ResponseWriter, r *http.Request) {
+
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+
+	var form AdminQuotaForm
+	if err := parseForm(r, &form); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	var quota int64
+	if q := strings.TrimSpace(form.Quota); q != "" {
+		mb, err := strconv.ParseInt(q, 10, 64)
+		if err != nil || mb <= 0 || mb > math.MaxInt64/megabyte {
+			alert := views.Alert{
+				Level:   views.AlertLvlError,
+				Message: "The quota must be a positive number.",
+			}
+			views.RedirectAlert(w, r,
+				fmt.Sprintf("/admin/users/%d", user.ID),
+				http.StatusFound, alert)
+			return
+		}
+		quota = mb * megabyte
+	}
+
+	user.StorageQuota = quota
+	if err := a.us.Update(user); err != nil {
+		http.Error(w, "Whoops! Something went wrong.",
+			http.StatusInternalServerError)
+		return
+	}
+
+	details := "default"
+	if quota != 0 {
+		details = formatBytes(quota)
+	}
+
+	admin := context.User(r.Context())
+	a.log(admin, user, models.AdminActionSetQuota, details, r)
+
+	a.redirectToUser(w, r, user, "The storage quota has been updated.")
+}
+
+// Impersonate lets the current admin browse the app as the user, to
+// help them with support requests.
+//
+// POST /admin/users/:id/impersonate
+func (a *Admin) Impersonate(w http.ResponseWriter, r *http.Request) {
+
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+
+	admin := context.User(r.Context())
+	session := context.Session(r.Context())
+	if session == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	err = a.us.Impersonate(admin, session, user)
+	switch err {
+	case nil:
+	case models.ErrCannotImpersonate:
+		http.Error(w, "This user cannot be impersonated.",
+			http.StatusForbidden)
+		return
+	default:
+		http.Error(w, "Whoops! Something went wrong.",
+			http.StatusInternalServerError)
+		return
+	}
+
+	a.log(admin, user, models.AdminActionImpersonate, "", r)
+
+	alert := views.Alert{
+		Level:   views.AlertLvlWarning,
+		Message: "You are now acting as " + user.Email + ".",
+	}
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
+}
+
+// StopImpersonating brings the admin back to their own account. It
+// is reached while the current user is the impersonated one, so it
+// can't be behind the RequireAdmin middleware.
+//
+// POST /admin/impersonate/stop
+func (a *Admin) StopImpersonating(w http.ResponseWriter, r *http.Request) {
+
+	admin := context.Impersonator(r.Context())
+	session := context.Session(r.Context())
+	if admin == nil || session == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if err := a.us.StopImpersonating(session); err != nil {
+		http.Error(w, "Whoops! Something went wrong.",
+			http.StatusInternalServerError)
+		return
+	}
+
+	user := context.User(r.Context())
+	a.log(admin, user, models.AdminActionStopImpersonating, "", r)
+	a.redirectToUser(w, r, user, "You are back to your own account.")
+}
+
+// Log lists every action taken by admins, most recent first.
+//
+// GET /admin/log
+func (a *Admin) Log(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form AdminSearchForm
+
+	data := AdminLogData{}
+	vd.Yield = &data
+
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.LogView.Render(w, r, vd)
+		return
+	}
+
+	page := pageNumber(form.Page)
+
+	// Fetch one extra action to know whether there is a next page
+	// without counting the whole log.
+	actions, err := a.as.Recent((page-1)*adminPerPage, adminPerPage+1)
+	if err != nil {
+		vd.SetAlert(err)
+		a.LogView.Render(w, r, vd)
+		return
+	}
+
+	data.Page = page
+	data.Pages = page
+	if len(actions) > adminPerPage {
+		actions = actions[:adminPerPage]
+		data.Pages = page + 1
+	}
+	data.Actions = actions
+
+	a.LogView.Render(w, r, vd)
+}
+
+/////////////////////////////////////////////////////////////////////
+//
+// Helper methods
+//
+/////////////////////////////////////////////////////////////////////
+
+func (a *Admin) userByID(w http.ResponseWriter, r *http.Request) (*models.User, error) {
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusNotFound)
+		return nil, err
+	}
+
+	user, err := a.us.ByID(uint(id))
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "User not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong.",
+				http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// log records an admin action. The action already happened, so a
+// failure is logged rather than shown to the admin.
+func (a *Admin) log(admin, user *models.User, action, details string,
+	r *http.Request) {
+
+	err := a.as.Log(admin, user, action, details, clientInfo(r))
+	if err != nil {
+		log.Println("controllers: recording admin action:", err)
+	}
+}
+
+func (a *Admin) redirectToUser(w http.ResponseWriter, r *http.Request,
+	user *models.User, msg string) {
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: msg,
+	}
+	views.RedirectAlert(w, r, fmt.Sprintf("/admin/users/%d", user.ID),
+		http.StatusFound, alert)
+}
+
+func pageNumber(page int) int {
+	if page < 1 {
+		return 1
+	}
+
+	return page
+}
+
+func paginate(page, total int) Pagination {
+	pages := (total + adminPerPage - 1) / adminPerPage
+	if pages < 1 {
+		pages = 1
+	}
+
+	return Pagination{
+		Page:  page,
+		Pages: pages,
+		Total: total,
+	}
+}
+
+// formatBytes formats a size in bytes for humans, like 1.5 MB.
+func formatBytes(n int64) string {
+
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div),
+		"KMGTPE"[exp])
+}
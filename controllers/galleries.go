@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 
@@ -23,22 +24,113 @@ const (
 	maxMultipartMem = 1 << 20 // 1 megabyte
 )
 
+// GalleryForm is used to create and update galleries. An empty
+// Visibility leaves it unchanged, or private for new galleries, and
+// an empty Password leaves the current one in place. EventDate is in
+// the YYYY-MM-DD format of date inputs, and CoverImage the filename
+// of one of the images of the gallery.
 type GalleryForm struct {
-	Title string `schema:"title"`
+	Title          string `schema:"title"`
+	Description    string `schema:"description"`
+	EventDate      string `schema:"event_date"`
+	CoverImage     string `schema:"cover_image"`
+	Visibility     string `schema:"visibility"`
+	Password       string `schema:"password"`
+	RemovePassword bool   `schema:"remove_password"`
+}
+
+// eventDate returns the event date of the form, or nil when it was
+// left empty.
+func (f *GalleryForm) eventDate() (*time.Time, error) {
+
+	if f.EventDate == "" {
+		return nil, nil
+	}
+
+	date, err := time.Parse("2006-01-02", f.EventDate)
+	if err != nil {
+		return nil, models.ErrEventDateInvalid
+	}
+
+	return &date, nil
+}
+
+// GalleryUnlockForm is filled in by visitors of a protected gallery.
+type GalleryUnlockForm struct {
+	Password string `schema:"password"`
+}
+
+// ImageOrderForm lists the filenames of the images of a gallery in
+// the order they should be shown.
+type ImageOrderForm struct {
+	Filenames []string `schema:"filenames"`
+}
+
+// ImageSortForm sorts the images of a gallery with one of the
+// models.ImageSort presets.
+type ImageSortForm struct {
+	By string `schema:"by"`
+}
+
+// ShareLinkForm creates a share link working for Days days.
+type ShareLinkForm struct {
+	Label         string `schema:"label"`
+	Days          int    `schema:"days"`
+	AllowDownload bool   `schema:"allow_download"`
+}
+
+// GalleriesData is what the galleries index expects as its Yield.
+// Storage is nil when it couldn't be looked up.
+type GalleriesData struct {
+	Galleries []models.Gallery
+	Storage   *StorageMeter
+}
+
+// StorageMeter describes the storage used by a user, for humans.
+type StorageMeter struct {
+	Used    string
+	Quota   string
+	Percent int
+}
+
+// Level is the Bootstrap contextual class matching how full the
+// storage is.
+func (m *StorageMeter) Level() string {
+	switch {
+	case m.Percent >= 100:
+		return "danger"
+	case m.Percent >= 80:
+		return "warning"
+	default:
+		return "success"
+	}
+}
+
+func newStorageMeter(s *models.Storage) *StorageMeter {
+	return &StorageMeter{
+		Used:    formatBytes(s.Used),
+		Quota:   formatBytes(s.Quota),
+		Percent: s.Percent(),
+	}
 }
 
 type Galleries struct {
-	NewView   *views.View
-	ShowView  *views.View
-	EditView  *views.View
-	IndexView *views.View
-	gs        models.GalleryService
-	is        models.ImageService
-	r         *mux.Router
+	NewView    *views.View
+	ShowView   *views.View
+	EditView   *views.View
+	IndexView  *views.View
+	UnlockView *views.View
+	gs         models.GalleryService
+	is         models.ImageService
+	sls        models.ShareLinkService
+	us         models.UserService
+	as         models.AuditService
+	r          *mux.Router
 }
 
 func NewGalleries(gs models.GalleryService, is models.ImageService,
-	r *mux.Router) *Galleries {
+	sls models.ShareLinkService, us models.UserService,
+	as models.AuditService, r *mux.Router) *Galleries {
 	return &Galleries{
 		NewView: views.NewView("bootstrap", false,
 			"galleries/new"),
@@ -48,9 +140,14 @@ func NewGalleries(gs models.GalleryService, is models.ImageService,
 			"galleries/edit"),
 		IndexView: views.NewView("bootstrap", false,
 			"galleries/index"),
-		gs: gs,
-		is: is,
-		r:  r,
+		UnlockView: views.NewView("bootstrap", false,
+			"galleries/unlock"),
+		gs:  gs,
+		is:  is,
+		sls: sls,
+		us:  us,
+		as:  as,
+		r:   r,
 	}
 }
 
@@ -68,11 +165,27 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	eventDate, err := form.eventDate()
+	if err != nil {
+		vd.SetAlert(err)
+		g.NewView.Render(w, r, vd)
+		return
+	}
+
 	user := context.User(r.Context())
 
 	gallery := models.Gallery{
-		Title:  form.Title,
-		UserID: user.ID,
+		Title:       form.Title,
+		Description: form.Description,
+		EventDate:   eventDate,
+		UserID:      user.ID,
+		Visibility:  form.Visibility,
+	}
+
+	if err := g.requireVerified(user, gallery.Visibility); err != nil {
+		vd.SetAlert(err)
+		g.NewView.Render(w, r, vd)
+		return
 	}
 
 	if err := g.gs.Create(&gallery); err != nil {
@@ -91,15 +204,81 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url.Path, http.StatusFound)
 }
 
+// Show displays a gallery to its owner, or to anyone if it's public.
+// Unlisted galleries are shown to others by ShowBySlug.
+//
+// GET /galleries/:id
 func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
 	if err != nil {
 		return
 	}
 
-	var vd views.Data
-	vd.Yield = gallery
-	g.ShowView.Render(w, r, vd)
+	if !gallery.VisibleTo(viewer(r)) {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+
+	g.show(w, r, gallery)
+}
+
+// ShowBySlug displays an unlisted gallery to anyone with its link.
+//
+// GET /g/:slug
+func (g *Galleries) ShowBySlug(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r)
+	if err != nil {
+		return
+	}
+
+	g.show(w, r, gallery)
+}
+
+// Unlock lets a visitor see a protected gallery once they enter its
+// password.
+//
+// POST /galleries/:id/unlock
+func (g *Galleries) Unlock(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if !gallery.VisibleTo(viewer(r)) {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+
+	g.unlock(w, r, gallery, fmt.Sprintf("/galleries/%d", gallery.ID))
+}
+
+// UnlockBySlug is Unlock for unlisted galleries.
+//
+// POST /g/:slug/unlock
+func (g *Galleries) UnlockBySlug(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r)
+	if err != nil {
+		return
+	}
+
+	g.unlock(w, r, gallery, gallery.SharePath())
+}
+
+// ShowByLink displays a gallery to anyone with one of its share
+// links, whatever its visibility and password.
+//
+// GET /s/:token
+func (g *Galleries) ShowByLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByLink(w, r)
+	if err != nil {
+		return
+	}
+
+	if err := g.sls.Viewed(gallery.SharedVia); err != nil {
+		log.Println(err)
+	}
+
+	g.show(w, r, gallery)
 }
 
 func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
@@ -118,7 +297,7 @@ func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 
 	var vd views.Data
 	vd.Yield = gallery
-	g.EditView.Render(w, r, vd)
+	g.renderEdit(w, r, vd, gallery)
 }
 
 func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
@@ -141,11 +320,51 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 
 	if err := parseForm(r, &form); err != nil {
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd, gallery)
 		return
 	}
 
+	eventDate, err := form.eventDate()
+	if err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+
+	if form.CoverImage != "" {
+		images, err := g.is.ByGalleryID(gallery.ID)
+		if err == nil && !containsImage(images, form.CoverImage) {
+			err = models.ErrCoverImageInvalid
+		}
+		if err != nil {
+			vd.SetAlert(err)
+			g.renderEdit(w, r, vd, gallery)
+			return
+		}
+	}
+
+	// Galleries shared before verification was required can still
+	// be edited, only changing who can see them is checked.
+	if form.Visibility != "" && form.Visibility != gallery.Visibility {
+		if err := g.requireVerified(user, form.Visibility); err != nil {
+			vd.SetAlert(err)
+			g.renderEdit(w, r, vd, gallery)
+			return
+		}
+	}
+
 	gallery.Title = form.Title
+	gallery.Description = form.Description
+	gallery.EventDate = eventDate
+	gallery.CoverImage = form.CoverImage
+	if form.Visibility != "" {
+		gallery.Visibility = form.Visibility
+	}
+	if form.RemovePassword {
+		gallery.PasswordHash = ""
+	} else {
+		gallery.Password = form.Password
+	}
 
 	err = g.gs.Update(gallery)
 	if err != nil {
@@ -157,7 +376,7 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	g.EditView.Render(w, r, vd)
+	g.renderEdit(w, r, vd, gallery)
 }
 
 func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
@@ -181,9 +400,22 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		vd.SetAlert(err)
 		vd.Yield = gallery
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+
+	// Nothing can bring a deleted gallery back, so its images
+	// and share links shouldn't be left behind.
+	if err := g.is.DeleteAll(gallery); err != nil {
+		log.Println(err)
+	}
+	if err := g.sls.DeleteByGalleryID(gallery.ID); err != nil {
+		log.Println(err)
 	}
 
+	g.as.Log(user, actor(r), models.AuditGalleryDeleted, gallery.Title,
+		clientInfo(r))
+
 	url, err := g.r.Get(IndexGallery).URL()
 	if err != nil {
 		http.Redirect(w, r, "/", http.StatusFound)
@@ -193,6 +425,98 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url.Path, http.StatusFound)
 }
 
+// CreateShareLink creates a link to send to someone who should see
+// the gallery for a while.
+//
+// POST /galleries/:id/links
+func (g *Galleries) CreateShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "Gallery not found.",
+			http.StatusForbidden)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+
+	var form ShareLinkForm
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+
+	if err := g.us.RequireVerified(user); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+
+	link := models.ShareLink{
+		GalleryID:     gallery.ID,
+		Label:         form.Label,
+		Days:          form.Days,
+		AllowDownload: form.AllowDownload,
+	}
+
+	if err := g.sls.Create(&link); err != nil {
+		vd.SetAlert(err)
+	} else {
+		vd.Alert = &views.Alert{
+			Level: views.AlertLvlSuccess,
+			Message: "Share link created! Send it to whoever " +
+				"should see the gallery.",
+		}
+	}
+
+	g.renderEdit(w, r, vd, gallery)
+}
+
+// RevokeShareLink makes a share link of the gallery stop working.
+//
+// POST /galleries/:id/links/:link_id/revoke
+func (g *Galleries) RevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "Gallery not found.",
+			http.StatusForbidden)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+
+	linkID, err := strconv.Atoi(mux.Vars(r)["link_id"])
+	if err != nil {
+		http.Error(w, "Link not found", http.StatusNotFound)
+		return
+	}
+
+	err = g.sls.Revoke(gallery.ID, uint(linkID))
+	if err != nil {
+		vd.SetAlert(err)
+	} else {
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: "Share link revoked.",
+		}
+	}
+
+	g.renderEdit(w, r, vd, gallery)
+}
+
 func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
 
 	user := context.User(r.Context())
@@ -204,8 +528,25 @@ func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Images are only needed for the covers.
+	for i := range galleries {
+		images, _ := g.is.ByGalleryID(galleries[i].ID)
+		galleries[i].SetImages(images)
+	}
+
+	data := GalleriesData{
+		Galleries: galleries,
+	}
+
+	storage, err := g.is.Storage(user)
+	if err != nil {
+		log.Println(err)
+	} else {
+		data.Storage = newStorageMeter(storage)
+	}
+
 	var vd views.Data
-	vd.Yield = galleries
+	vd.Yield = data
 	g.IndexView.Render(w, r, vd)
 }
 
@@ -229,7 +570,7 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 	err = r.ParseMultipartForm(maxMultipartMem)
 	if err != nil {
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd, gallery)
 		return
 	}
 
@@ -240,16 +581,19 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 		file, err := f.Open()
 		if err != nil {
 			vd.SetAlert(err)
-			g.EditView.Render(w, r, vd)
+			g.renderEdit(w, r, vd, gallery)
 			return
 		}
 		defer file.Close()
 
 		// Create image
-		err = g.is.Create(gallery.ID, file, f.Filename)
+		err = g.is.Create(gallery, file, f.Filename)
 		if err != nil {
+			// Show the images uploaded before this one.
+			images, _ := g.is.ByGalleryID(gallery.ID)
+			gallery.SetImages(images)
 			vd.SetAlert(err)
-			g.EditView.Render(w, r, vd)
+			g.renderEdit(w, r, vd, gallery)
 			return
 		}
 	}
@@ -264,6 +608,150 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url.Path, http.StatusFound)
 }
 
+// Image serves an image of a gallery to whoever can see the gallery
+// at its /galleries/:id address.
+//
+// GET /images/galleries/:id/:filename
+func (g *Galleries) Image(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if !gallery.VisibleTo(viewer(r)) {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	g.serveImage(w, r, gallery)
+}
+
+// ImageBySlug serves an image of an unlisted gallery to anyone with
+// the link of the gallery.
+//
+// GET /g/:slug/images/:filename
+func (g *Galleries) ImageBySlug(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r)
+	if err != nil {
+		return
+	}
+
+	g.serveImage(w, r, gallery)
+}
+
+// ImageOrder saves the order the images were dragged into on the
+// edit page.
+//
+// POST /galleries/:id/images/order
+func (g *Galleries) ImageOrder(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "Gallery not found.",
+			http.StatusForbidden)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+
+	var form ImageOrderForm
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+
+	if err := g.is.Reorder(gallery, form.Filenames); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+
+	g.redirectToEdit(w, r, gallery, "Image order saved!")
+}
+
+// ImageSort orders the images of the gallery with a preset.
+//
+// POST /galleries/:id/images/sort
+func (g *Galleries) ImageSort(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "Gallery not found.",
+			http.StatusForbidden)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+
+	var form ImageSortForm
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+
+	if err := g.is.Sort(gallery, form.By); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+
+	g.redirectToEdit(w, r, gallery, "Images sorted!")
+}
+
+// ImageByLink serves the images of galleries seen through a share
+// link.
+//
+// GET /s/:token/images/:filename
+func (g *Galleries) ImageByLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByLink(w, r)
+	if err != nil {
+		return
+	}
+
+	g.serveImage(w, r, gallery)
+}
+
+// DownloadByLink sends every image of the gallery as a ZIP archive,
+// when the share link allows it.
+//
+// GET /s/:token/download
+func (g *Galleries) DownloadByLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByLink(w, r)
+	if err != nil {
+		return
+	}
+
+	if !gallery.SharedVia.AllowDownload {
+		http.Error(w, "This link doesn't allow downloads.",
+			http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="gallery-%d.zip"`, gallery.ID))
+	w.Header().Set("Cache-Control", "private")
+
+	// Headers are gone by now, so errors can only be logged.
+	if err := models.ZipImages(w, gallery.Images); err != nil {
+		log.Println(err)
+	}
+}
+
 func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 
 	gallery, err := g.galleryByID(w, r)
@@ -280,23 +768,27 @@ func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 
 	// Get the filname from the path
 	filename := mux.Vars(r)["filename"]
-	// Build the Image model
-	i := models.Image{
-		GalleryID: gallery.ID,
-		Filename:  filename,
-	}
 
 	// Try to delete the image
-	err = g.is.Delete(&i)
+	err = g.is.Delete(gallery, filename)
 	if err != nil {
 		// Render the edit page with any error
 		var vd views.Data
 		vd.Yield = gallery
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd, gallery)
 		return
 	}
 
+	// Don't let an image uploaded later with the same name become
+	// the cover.
+	if gallery.CoverImage == filename {
+		gallery.CoverImage = ""
+		if err := g.gs.Update(gallery); err != nil {
+			log.Println(err)
+		}
+	}
+
 	// If all goes well, redirect to the edit gallery page
 	url, err := g.r.Get(EditGallery).
 		URL("id", fmt.Sprintf("%v", gallery.ID))
@@ -326,7 +818,7 @@ func (g *Galleries) ImageViaLink(w http.ResponseWriter, r *http.Request) {
 	err = r.ParseForm()
 	if err != nil {
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd, gallery)
 		return
 	}
 
@@ -335,6 +827,11 @@ func (g *Galleries) ImageViaLink(w http.ResponseWriter, r *http.Request) {
 	var wg sync.WaitGroup
 	wg.Add(len(files))
 
+	// Downloads past the storage quota are reported, other failures
+	// are only logged.
+	var mu sync.Mutex
+	var quotaExceeded bool
+
 	for _, fileURL := range files {
 
 		go func(url string) {
@@ -349,8 +846,12 @@ func (g *Galleries) ImageViaLink(w http.ResponseWriter, r *http.Request) {
 
 			pieces := strings.Split(url, "/")
 			filename := pieces[len(pieces)-1]
-			err = g.is.Create(gallery.ID, resp.Body, filename)
-			if err != nil {
+			err = g.is.Create(gallery, resp.Body, filename)
+			if err == models.ErrStorageQuotaExceeded {
+				mu.Lock()
+				quotaExceeded = true
+				mu.Unlock()
+			} else if err != nil {
 				log.Println("Failed to create the image from:", url)
 			}
 		} (fileURL)
@@ -365,6 +866,15 @@ func (g *Galleries) ImageViaLink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if quotaExceeded {
+		alert := views.Alert{
+			Level:   views.AlertLvlError,
+			Message: models.ErrStorageQuotaExceeded.Public(),
+		}
+		views.RedirectAlert(w, r, url.Path, http.StatusFound, alert)
+		return
+	}
+
 	http.Redirect(w, r, url.Path, http.StatusFound)
 }
 
@@ -374,6 +884,31 @@ func (g *Galleries) ImageViaLink(w http.ResponseWriter, r *http.Request) {
 //
 /////////////////////////////////////////////////////////////////////
 
+// containsImage reports whether one of the images has the filename.
+func containsImage(images []models.Image, filename string) bool {
+
+	for _, image := range images {
+		if image.Filename == filename {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requireVerified returns models.ErrEmailNotVerified if the gallery
+// would be shared with the visibility while its owner hasn't verified
+// their email address yet.
+func (g *Galleries) requireVerified(user *models.User, visibility string) error {
+
+	switch visibility {
+	case models.VisibilityUnlisted, models.VisibilityPublic:
+		return g.us.RequireVerified(user)
+	}
+
+	return nil
+}
+
 func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
 
 	vars := mux.Vars(r)
@@ -399,7 +934,212 @@ func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models
 	}
 
 	images, _ := g.is.ByGalleryID(gallery.ID)
-	gallery.Images = images
+	gallery.SetImages(images)
+
+	return gallery, nil
+}
+
+func (g *Galleries) galleryBySlug(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+
+	gallery, err := g.gs.BySlug(mux.Vars(r)["slug"])
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Gallery not found",
+				http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong.",
+				http.StatusInternalServerError)
+		}
+
+		return nil, err
+	}
+
+	images, _ := g.is.ByGalleryID(gallery.ID)
+	gallery.SetImages(images)
 
 	return gallery, nil
 }
+
+// galleryByLink returns the gallery of the share link in the URL,
+// with its images served through the link.
+func (g *Galleries) galleryByLink(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+
+	link, err := g.sls.ByToken(mux.Vars(r)["token"])
+	if err == nil {
+		var gallery *models.Gallery
+		gallery, err = g.gs.ByID(link.GalleryID)
+		if err == nil {
+			images, _ := g.is.ByGalleryID(gallery.ID)
+			gallery.SetImagesBase(link.Path(), images)
+			gallery.SharedVia = link
+			return gallery, nil
+		}
+	}
+
+	switch err {
+	case models.ErrNotFound:
+		http.Error(w, "Link not found", http.StatusNotFound)
+	case models.ErrShareLinkExpired:
+		http.Error(w, "This link has expired, ask for a new one.",
+			http.StatusGone)
+	default:
+		http.Error(w, "Whoops! Something went wrong.",
+			http.StatusInternalServerError)
+	}
+
+	return nil, err
+}
+
+func (g *Galleries) show(w http.ResponseWriter, r *http.Request,
+	gallery *models.Gallery) {
+
+	var vd views.Data
+
+	if !g.unlocked(r, gallery) {
+		gallery.Images = nil
+		vd.Yield = gallery
+		g.UnlockView.Render(w, r, vd)
+		return
+	}
+
+	// The owner is only used to link to their profile, the gallery
+	// is still worth showing without it.
+	owner, err := g.us.ByID(gallery.UserID)
+	if err == nil && !owner.DeletionScheduled() {
+		gallery.Owner = owner
+	}
+
+	vd.Yield = gallery
+	g.ShowView.Render(w, r, vd)
+}
+
+// unlock checks the password entered for the gallery, then sends the
+// visitor back to path with a cookie remembering they are allowed in.
+func (g *Galleries) unlock(w http.ResponseWriter, r *http.Request,
+	gallery *models.Gallery, path string) {
+
+	if !gallery.Protected() {
+		http.Redirect(w, r, path, http.StatusFound)
+		return
+	}
+
+	var vd views.Data
+	var form GalleryUnlockForm
+
+	gallery.Images = nil
+	vd.Yield = gallery
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.UnlockView.Render(w, r, vd)
+		return
+	}
+
+	token, err := g.gs.Unlock(gallery, form.Password, clientInfo(r))
+	if err != nil {
+		vd.SetAlert(err)
+		g.UnlockView.Render(w, r, vd)
+		return
+	}
+
+	cookie := http.Cookie{
+		Name:     unlockCookieName(gallery),
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(models.UnlockTTL),
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+
+	http.Redirect(w, r, path, http.StatusFound)
+}
+
+// unlocked reports whether the current visitor can see the images of
+// the gallery: it isn't protected, they came through a share link,
+// they own it, or they entered its password. Image requests go
+// through the User middleware too, so owners are recognized there as
+// well as on the gallery page, as long as they don't use an API token
+// without ScopeReadGalleries.
+func (g *Galleries) unlocked(r *http.Request, gallery *models.Gallery) bool {
+
+	if !gallery.Protected() || gallery.SharedVia != nil {
+		return true
+	}
+
+	user := viewer(r)
+	if user != nil && user.ID == gallery.UserID {
+		return true
+	}
+
+	cookie, err := r.Cookie(unlockCookieName(gallery))
+	if err != nil {
+		return false
+	}
+
+	return g.gs.Unlocked(gallery, cookie.Value)
+}
+
+// redirectToEdit sends the owner back to the edit page of the
+// gallery with a success message.
+func (g *Galleries) redirectToEdit(w http.ResponseWriter, r *http.Request,
+	gallery *models.Gallery, msg string) {
+
+	url, err := g.r.Get(EditGallery).
+		URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: msg,
+	}
+	views.RedirectAlert(w, r, url.Path, http.StatusFound, alert)
+}
+
+// renderEdit renders the edit page of the gallery, which lists its
+// share links.
+func (g *Galleries) renderEdit(w http.ResponseWriter, r *http.Request,
+	vd views.Data, gallery *models.Gallery) {
+
+	links, err := g.sls.ByGalleryID(gallery.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	gallery.ShareLinks = links
+
+	g.EditView.Render(w, r, vd)
+}
+
+func unlockCookieName(gallery *models.Gallery) string {
+	return fmt.Sprintf("gallery_%d", gallery.ID)
+}
+
+// serveImage serves the image of the gallery named in the URL.
+func (g *Galleries) serveImage(w http.ResponseWriter, r *http.Request,
+	gallery *models.Gallery) {
+
+	if !g.unlocked(r, gallery) {
+		http.Error(w, "This gallery is password protected.",
+			http.StatusForbidden)
+		return
+	}
+
+	filename := mux.Vars(r)["filename"]
+	for _, image := range gallery.Images {
+		if image.Filename != filename {
+			continue
+		}
+
+		// Shared caches shouldn't keep images others can't see.
+		if gallery.Visibility != models.VisibilityPublic {
+			w.Header().Set("Cache-Control", "private")
+		}
+		http.ServeFile(w, r, image.RelativePath())
+		return
+	}
+
+	http.Error(w, "Image not found", http.StatusNotFound)
+}
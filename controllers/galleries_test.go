@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"lenslockedbr.com/context"
+	"lenslockedbr.com/models"
+)
+
+type testGalleryService struct {
+	models.GalleryService
+	gallery *models.Gallery
+}
+
+func (gs *testGalleryService) ByID(id uint) (*models.Gallery, error) {
+	if id != gs.gallery.ID {
+		return nil, models.ErrNotFound
+	}
+
+	gallery := *gs.gallery
+	return &gallery, nil
+}
+
+type testImageService struct {
+	models.ImageService
+}
+
+func (is *testImageService) ByGalleryID(galleryID uint) ([]models.Image, error) {
+	return nil, nil
+}
+
+// An API token authenticates as its owner on every route, but the
+// routes anyone can use must not show it private galleries unless it
+// was granted ScopeReadGalleries.
+func TestPrivateGalleryWithoutReadScope(t *testing.T) {
+
+	owner := &models.User{}
+	owner.ID = 1
+
+	gallery := &models.Gallery{
+		UserID:     owner.ID,
+		Visibility: models.VisibilityPrivate,
+	}
+	gallery.ID = 2
+
+	g := &Galleries{
+		gs: &testGalleryService{gallery: gallery},
+		is: &testImageService{},
+	}
+
+	token := &models.APIToken{
+		UserID: owner.ID,
+		Scopes: models.ScopeWriteImages,
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		vars    map[string]string
+		handler http.HandlerFunc
+	}{
+		{"gallery", "/galleries/2",
+			map[string]string{"id": "2"}, g.Show},
+		{"image", "/images/galleries/2/a.jpg",
+			map[string]string{"id": "2", "filename": "a.jpg"}, g.Image},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.path, nil)
+		ctx := context.WithUser(r.Context(), owner)
+		ctx = context.WithAPIToken(ctx, token)
+		r = mux.SetURLVars(r.WithContext(ctx), test.vars)
+
+		w := httptest.NewRecorder()
+		test.handler(w, r)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want %d", test.name,
+				w.Code, http.StatusNotFound)
+		}
+	}
+}
@@ -1,10 +1,16 @@
 package controllers
 
 import (
+	"net"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/gorilla/schema"
+
+	"lenslockedbr.com/context"
+	"lenslockedbr.com/models"
+	"lenslockedbr.com/views"
 )
 
 func parseForm(r *http.Request, dst interface{}) error {
@@ -34,3 +40,128 @@ func parseURLParams(r *http.Request, dst interface{}) error {
 
 	return parseValues(r.Form, dst)
 }
+
+// clientInfo describes where the request came from. In production
+// Caddy proxies every request to us from the same machine, so the
+// address it saw is only trusted when we are talking to localhost.
+func clientInfo(r *http.Request) models.ClientInfo {
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		if parsed := net.ParseIP(ip); parsed != nil && parsed.IsLoopback() {
+			ip = realIP
+		}
+	}
+
+	return models.ClientInfo{
+		IP:        ip,
+		UserAgent: r.UserAgent(),
+	}
+}
+
+// redirectError redirects to urlStr, where the error is displayed the
+// same way views.Data.SetAlert would.
+func redirectError(w http.ResponseWriter, r *http.Request, urlStr string,
+	err error) {
+
+	var vd views.Data
+	vd.SetAlert(err)
+	views.RedirectAlert(w, r, urlStr, http.StatusFound, *vd.Alert)
+}
+
+// actor returns who is really making the request: the admin
+// impersonating the current user if any, otherwise the current user.
+func actor(r *http.Request) *models.User {
+
+	if admin := context.Impersonator(r.Context()); admin != nil {
+		return admin
+	}
+
+	return context.User(r.Context())
+}
+
+// viewer returns the current user on the routes anyone can use,
+// which RequireUser doesn't guard. Requests made with an API token
+// that wasn't granted ScopeReadGalleries are anonymous there, the
+// token must not be enough to see private galleries.
+func viewer(r *http.Request) *models.User {
+
+	token := context.APIToken(r.Context())
+	if token != nil && !token.HasScope(models.ScopeReadGalleries) {
+		return nil
+	}
+
+	return context.User(r.Context())
+}
+
+// signIn is used to sign the given user in via cookies. Every sign in
+// starts a new session, so logging in on another device doesn't
+// affect the existing ones. Accounts scheduled for deletion are
+// restored.
+func signIn(w http.ResponseWriter, r *http.Request,
+	us models.UserService, user *models.User) error {
+
+	// Logging in during the grace period is how a user restores
+	// an account they asked us to delete.
+	if user.DeletionScheduled() {
+		if err := us.CancelDeletion(user); err != nil {
+			return err
+		}
+	}
+
+	session, err := us.CreateSession(user, clientInfo(r))
+	if err != nil {
+		return err
+	}
+
+	// Set a cookie with the remember token of the new session
+	cookie := http.Cookie{
+		Name:     "remember_cookie",
+		Value:    session.Token,
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+
+	return nil
+}
+
+// completeLogin signs in a user whose identity was just proven, or
+// sends them on to the second step when two-factor authentication is
+// enabled.
+func completeLogin(w http.ResponseWriter, r *http.Request,
+	us models.UserService, user *models.User) error {
+
+	if user.TwoFactorEnabled() {
+		// Don't sign the user in yet. The pending login is
+		// remembered in a short lived cookie until the TOTP code
+		// is verified by CompleteTwoFactor.
+		token, err := us.InitiateTwoFactor(user)
+		if err != nil {
+			return err
+		}
+
+		cookie := http.Cookie{
+			Name:     "twofactor_token",
+			Value:    token,
+			Expires:  time.Now().Add(5 * time.Minute),
+			HttpOnly: true,
+		}
+		http.SetCookie(w, &cookie)
+
+		http.Redirect(w, r, "/login/2fa", http.StatusFound)
+		return nil
+	}
+
+	alert := welcomeBack(user)
+	if err := signIn(w, r, us, user); err != nil {
+		return err
+	}
+
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
+	return nil
+}
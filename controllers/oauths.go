@@ -1,39 +1,53 @@
 package controllers
 
 import (
-	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"time"
 
-	"golang.org/x/oauth2"
-
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
 
 	"lenslockedbr.com/dbx"
 	llctx "lenslockedbr.com/context"
 	"lenslockedbr.com/models"
+	"lenslockedbr.com/oidc"
+	"lenslockedbr.com/views"
 )
 
 type OAuths struct {
 	os models.OAuthService
-	configs map[string]*oauth2.Config
+	us models.UserService
+	providers map[string]*oidc.Provider
 }
 
-func NewOAuths(os models.OAuthService, configs map[string]*oauth2.Config) *OAuths {
+func NewOAuths(os models.OAuthService, us models.UserService,
+	providers []*oidc.Provider) *OAuths {
+
+	byName := make(map[string]*oidc.Provider)
+	for _, p := range providers {
+		byName[p.Name] = p
+	}
+
 	return &OAuths {
 		os: os,
-		configs: configs, 
+		us: us,
+		providers: byName,
 	}
 }
 
+// Connect sends the user to the provider to authorize us. It's used
+// both to connect a provider to the current user's account and to
+// sign in with it, Callback tells them apart.
+//
+// GET /oauth/:service/connect
+// GET /oauth/:service/login
 func(o *OAuths) Connect(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
 	service := vars["service"]
-	oauthCfg, ok := o.configs[service]
+	provider, ok := o.providers[service]
 	if !ok {
 		http.Error(w, "Invalid OAuth2 Service", 
                            http.StatusBadRequest)
@@ -48,16 +62,20 @@ func(o *OAuths) Connect(w http.ResponseWriter, r *http.Request) {
 	}
 
 	http.SetCookie(w, &cookie)
-	url := oauthCfg.AuthCodeURL(state)
-	log.Println(state)
+	url := provider.Config.AuthCodeURL(state)
 	http.Redirect(w, r, url, http.StatusFound)
 }
 
+// Callback is where the provider sends the user back to. A signed in
+// user gets the provider connected to their account, anyone else is
+// signed in, or up, with it.
+//
+// GET /oauth/:service/callback
 func (o *OAuths) Callback(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
 	service := vars["service"]
-	oauthCfg, ok := o.configs[service]
+	provider, ok := o.providers[service]
 	if !ok {
 		http.Error(w, "Invalid OAuth2 Service", 
                            http.StatusBadRequest)
@@ -66,9 +84,6 @@ func (o *OAuths) Callback(w http.ResponseWriter, r *http.Request) {
 
 	r.ParseForm()
 
-	fmt.Fprintln(w, "code: ", r.FormValue("code"),
-                     " state: ", r.FormValue("state"))
-
 	state := r.FormValue("state")
 	cookie, err := r.Cookie("oauth_state")
 	if err != nil {
@@ -85,39 +100,74 @@ func (o *OAuths) Callback(w http.ResponseWriter, r *http.Request) {
 	http.SetCookie(w, cookie)
 
 	code := r.FormValue("code")
-	token, err := oauthCfg.Exchange(context.TODO(), code)
+	token, err := provider.Config.Exchange(r.Context(), code)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	identity := models.Identity{
+		Service: service,
+		Token:   *token,
+	}
+
 	user := llctx.User(r.Context())
-	existing, err := o.os.Find(user.ID, service)
-	if err == models.ErrNotFound {
-		// noop
-	} else if err != nil {
-		http.Error(w, err.Error(), 
-                           http.StatusInternalServerError)
+
+	if provider.CanSignIn() {
+		info, err := provider.UserInfo(r.Context(), token)
+		switch {
+		case err == nil:
+			identity.Subject = info.Subject
+			identity.Email = info.Email
+			identity.EmailVerified = info.EmailVerified
+			identity.Name = info.Name
+		case user != nil:
+			// Connecting only needs the token, the provider
+			// just can't be used to sign in later on.
+			log.Println(err)
+		default:
+			redirectError(w, r, "/login", err)
+			return
+		}
+	}
+
+	if user != nil {
+		o.connect(w, r, provider, user, identity)
 		return
-	} else {
-		o.os.Delete(existing.ID)
 	}
 
-	userOAuth := models.OAuth {
-		UserID: user.ID,
-		Token: *token,
-		Service: service,
-	}	
-	err = o.os.Create(&userOAuth)
+	if !provider.CanSignIn() {
+		http.Error(w, "You can't sign in with " + provider.Label,
+			http.StatusBadRequest)
+		return
+	}
+
+	user, err = o.us.SignInWithOAuth(identity, clientInfo(r))
 	if err != nil {
-		http.Error(w, err.Error(), 
-                           http.StatusInternalServerError)
+		redirectError(w, r, "/login", err)
 		return
 	}
 
-	fmt.Fprintf(w, "%+v", token)
+	if err := completeLogin(w, r, o.us, user); err != nil {
+		redirectError(w, r, "/login", err)
+	}
 }
 
+func (o *OAuths) connect(w http.ResponseWriter, r *http.Request,
+	provider *oidc.Provider, user *models.User, identity models.Identity) {
+
+	err := o.os.Connect(user, identity.OAuth(), clientInfo(r))
+	if err != nil {
+		redirectError(w, r, "/account", err)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your " + provider.Label + " account is now connected.",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
 
 func (o *OAuths) DropboxTest(w http.ResponseWriter, r *http.Request) {
 
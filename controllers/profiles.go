@@ -0,0 +1,260 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"lenslockedbr.com/context"
+	"lenslockedbr.com/models"
+	"lenslockedbr.com/views"
+)
+
+type ProfileForm struct {
+	Handle      string `schema:"handle"`
+	DisplayName string `schema:"display_name"`
+	Bio         string `schema:"bio"`
+	Website     string `schema:"website"`
+
+	// Avatar is the gallery ID and filename of the image, separated
+	// by a slash, or empty for no avatar.
+	Avatar string `schema:"avatar"`
+}
+
+// ProfileData is what the profile pages expect as their Yield. Images
+// is only set when editing, to pick the avatar from.
+type ProfileData struct {
+	User      *models.User
+	Galleries []models.Gallery
+	Images    []models.Image
+}
+
+type Profiles struct {
+	ShowView *views.View
+	EditView *views.View
+	us       models.UserService
+	gs       models.GalleryService
+	is       models.ImageService
+}
+
+func NewProfiles(us models.UserService, gs models.GalleryService,
+	is models.ImageService) *Profiles {
+	return &Profiles{
+		ShowView: views.NewView("bootstrap", false,
+			"profiles/show"),
+		EditView: views.NewView("bootstrap", false,
+			"profiles/edit"),
+		us: us,
+		gs: gs,
+		is: is,
+	}
+}
+
+// Show displays the public profile of a user along with their
+// galleries.
+//
+// GET /u/:handle
+func (p *Profiles) Show(w http.ResponseWriter, r *http.Request) {
+
+	user, err := p.us.ByHandle(mux.Vars(r)["handle"])
+	if err == nil && user.DeletionScheduled() {
+		err = models.ErrNotFound
+	}
+	switch err {
+	case nil:
+	case models.ErrNotFound:
+		http.Error(w, "Profile not found", http.StatusNotFound)
+		return
+	default:
+		http.Error(w, "Whoops! Something went wrong.",
+			http.StatusInternalServerError)
+		return
+	}
+
+	galleries, err := p.galleries(user)
+	if err != nil {
+		http.Error(w, "Whoops! Something went wrong.",
+			http.StatusInternalServerError)
+		return
+	}
+
+	// Don't link to an avatar that was deleted, or whose gallery was
+	// made private, since it was picked.
+	if avatar := user.Avatar(); avatar != nil &&
+		!hasImage(galleries, *avatar) {
+		user.AvatarGalleryID = 0
+		user.AvatarFilename = ""
+	}
+
+	var vd views.Data
+	vd.Yield = ProfileData{
+		User:      user,
+		Galleries: galleries,
+	}
+	p.ShowView.Render(w, r, vd)
+}
+
+// Edit displays the profile form of the current user.
+//
+// GET /account/profile
+func (p *Profiles) Edit(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+
+	user := context.User(r.Context())
+	data, err := p.editData(user)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = data
+
+	p.EditView.Render(w, r, vd)
+}
+
+// Update saves the profile of the current user.
+//
+// POST /account/profile
+func (p *Profiles) Update(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form ProfileForm
+
+	user := context.User(r.Context())
+	data, err := p.editData(user)
+	vd.Yield = data
+	if err != nil {
+		vd.SetAlert(err)
+		p.EditView.Render(w, r, vd)
+		return
+	}
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		p.EditView.Render(w, r, vd)
+		return
+	}
+
+	// Work on a copy, so a failed update doesn't leave the current
+	// user half changed for the rest of the request.
+	updated := *user
+	updated.Handle = form.Handle
+	updated.DisplayName = form.DisplayName
+	updated.Bio = form.Bio
+	updated.Website = form.Website
+	updated.AvatarGalleryID = 0
+	updated.AvatarFilename = ""
+	data.User = &updated
+
+	if form.Avatar != "" {
+		avatar, ok := parseAvatar(form.Avatar)
+		if !ok || !hasImage(data.Galleries, avatar) {
+			vd.AlertError("Please pick an image of one of your " +
+				"public galleries as your avatar.")
+			p.EditView.Render(w, r, vd)
+			return
+		}
+		updated.AvatarGalleryID = avatar.GalleryID
+		updated.AvatarFilename = avatar.Filename
+	}
+
+	if err := p.us.Update(&updated); err != nil {
+		vd.SetAlert(err)
+		p.EditView.Render(w, r, vd)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your profile has been updated!",
+	}
+	views.RedirectAlert(w, r, "/account/profile", http.StatusFound,
+		alert)
+}
+
+/////////////////////////////////////////////////////////////////////
+//
+// Helper methods
+//
+/////////////////////////////////////////////////////////////////////
+
+// galleries returns the public galleries of the user with their
+// images. They are the only ones listed on profiles, and so the only
+// ones avatars can be picked from.
+func (p *Profiles) galleries(user *models.User) ([]models.Gallery, error) {
+
+	all, err := p.gs.ByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var galleries []models.Gallery
+	for _, gallery := range all {
+		if gallery.Visibility != models.VisibilityPublic {
+			continue
+		}
+		// The images of protected galleries are kept for those
+		// who know the password.
+		if !gallery.Protected() {
+			images, _ := p.is.ByGalleryID(gallery.ID)
+			gallery.SetImages(images)
+		}
+		galleries = append(galleries, gallery)
+	}
+
+	return galleries, nil
+}
+
+func (p *Profiles) editData(user *models.User) (*ProfileData, error) {
+
+	data := ProfileData{
+		User: user,
+	}
+
+	galleries, err := p.galleries(user)
+	if err != nil {
+		return &data, err
+	}
+
+	data.Galleries = galleries
+	for _, gallery := range galleries {
+		data.Images = append(data.Images, gallery.Images...)
+	}
+
+	return &data, nil
+}
+
+func parseAvatar(value string) (models.Image, bool) {
+
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return models.Image{}, false
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return models.Image{}, false
+	}
+
+	return models.Image{
+		GalleryID: uint(id),
+		Filename:  parts[1],
+	}, true
+}
+
+func hasImage(galleries []models.Gallery, image models.Image) bool {
+
+	for _, gallery := range galleries {
+		if gallery.ID != image.GalleryID {
+			continue
+		}
+		for _, img := range gallery.Images {
+			if img.Filename == image.Filename {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -2,13 +2,14 @@ package controllers
 
 import (
 	"fmt"
+	"log"
 	"net/http"
 	"time"
 
 	"lenslockedbr.com/context"
 	"lenslockedbr.com/email"
 	"lenslockedbr.com/models"
-	"lenslockedbr.com/rand"
+	"lenslockedbr.com/oidc"
 	"lenslockedbr.com/views"
 )
 
@@ -30,16 +31,41 @@ type ResetPwForm struct {
 	Password string `schema:"password"`
 }
 
+type LoginLinkForm struct {
+	Email string `schema:"email"`
+	Token string `schema:"token"`
+}
+
+type VerifyForm struct {
+	Token string `schema:"token"`
+}
+
 type Users struct {
-	NewView      *views.View
-	LoginView    *views.View
-	ForgotPwView *views.View
-	ResetPwView  *views.View
-	service      models.UserService
-	emailer      *email.Client
+	NewView       *views.View
+	LoginView     *views.View
+	ForgotPwView  *views.View
+	ResetPwView   *views.View
+	VerifyView    *views.View
+	TwoFactorView *views.View
+	LoginLinkView *views.View
+	service       models.UserService
+	emailer       *email.Client
+
+	// providers are the OAuth providers users can sign in with,
+	// listed on the login page.
+	providers []*oidc.Provider
 }
 
-func NewUsers(us models.UserService, emailer *email.Client) *Users {
+func NewUsers(us models.UserService, emailer *email.Client,
+	providers []*oidc.Provider) *Users {
+
+	var canSignIn []*oidc.Provider
+	for _, p := range providers {
+		if p.CanSignIn() {
+			canSignIn = append(canSignIn, p)
+		}
+	}
+
 	return &Users{
 		NewView: views.NewView("bootstrap", false,
 			"users/new"),
@@ -50,8 +76,15 @@ func NewUsers(us models.UserService, emailer *email.Client) *Users {
 			"users/forgot_pw"),
 		ResetPwView: views.NewView("bootstrap", false,
 			"users/reset_pw"),
-		service: us,
-		emailer: emailer,
+		VerifyView: views.NewView("bootstrap", false,
+			"users/verify"),
+		TwoFactorView: views.NewView("bootstrap", false,
+			"users/two_factor"),
+		LoginLinkView: views.NewView("bootstrap", false,
+			"users/login_link"),
+		service:   us,
+		emailer:   emailer,
+		providers: canSignIn,
 	}
 }
 
@@ -101,20 +134,37 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := u.signIn(w, &user)
+	err := signIn(w, r, u.service, &user)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
 	}
 
+	// The account is usable right away, so a failure to send the
+	// verification email shouldn't fail the signup. The user can
+	// always ask for a new one.
+	if err := u.sendVerification(&user); err != nil {
+		log.Println(err)
+	}
+
 	alert := views.Alert{
-		Level:   views.AlertLvlSuccess,
-		Message: "Welcome to LensLockedBR.com!",
+		Level: views.AlertLvlSuccess,
+		Message: "Welcome to LensLockedBR.com! Please check your " +
+			"inbox to verify your email address.",
 	}
 
 	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
 }
 
+// ShowLogin is used to render the login form, along with the OAuth
+// providers users can sign in with.
+//
+// GET /login
+//
+func (u *Users) ShowLogin(w http.ResponseWriter, r *http.Request) {
+	u.renderLogin(w, r, views.Data{})
+}
+
 // Login is used to process the login form when a user tries to log
 // in as an existing user(via email & pwd).
 //
@@ -127,12 +177,12 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 	form := LoginForm{}
 	if err := parseForm(r, &form); err != nil {
 		vd.SetAlert(err)
-		u.LoginView.Render(w, r, vd)
+		u.renderLogin(w, r, vd)
 		return
 	}
 
 	user, err := u.service.Authenticate(form.Email,
-		form.Password)
+		form.Password, clientInfo(r))
 	if err != nil {
 
 		switch err {
@@ -142,31 +192,172 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 		default:
 			vd.SetAlert(err)
 		}
-		u.LoginView.Render(w, r, vd)
+		u.renderLogin(w, r, vd)
+		return
+	}
+
+	if err := completeLogin(w, r, u.service, user); err != nil {
+		vd.SetAlert(err)
+		u.renderLogin(w, r, vd)
+	}
+}
+
+// LoginLink displays the form used to get a sign-in link by email.
+// When opened from the emailed link, it asks for a confirmation
+// instead of logging in right away, so that mail scanners following
+// links don't burn the single use token.
+//
+// GET /login/link
+func (u *Users) LoginLink(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form LoginLinkForm
+
+	vd.Yield = &form
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+	}
+
+	u.LoginLinkView.Render(w, r, vd)
+}
+
+// InitiateLoginLink emails a sign-in link to the user, for those who
+// would rather not use a password.
+//
+// POST /login/link
+func (u *Users) InitiateLoginLink(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form LoginLinkForm
+
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.LoginLinkView.Render(w, r, vd)
+		return
+	}
+
+	token, err := u.service.InitiateLoginLink(form.Email,
+		clientInfo(r))
+	if err != nil {
+		vd.SetAlert(err)
+		u.LoginLinkView.Render(w, r, vd)
+		return
+	}
+
+	// Unknown addresses get the same answer, so the form can't be
+	// used to find out who has an account.
+	if token != "" {
+		if err := u.emailer.LoginLink(form.Email, token); err != nil {
+			vd.SetAlert(err)
+			u.LoginLinkView.Render(w, r, vd)
+			return
+		}
+	}
+
+	v := views.Alert{
+		Level: views.AlertLvlSuccess,
+		Message: "If an account uses this address, a sign-in link " +
+			"has been emailed to it. It expires in 15 minutes.",
+	}
+	views.RedirectAlert(w, r, "/login", http.StatusFound, v)
+}
+
+// CompleteLoginLink logs the user in with the token from a sign-in
+// link. Two-factor authentication still applies.
+//
+// POST /login/link/complete
+func (u *Users) CompleteLoginLink(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form LoginLinkForm
+
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.LoginLinkView.Render(w, r, vd)
 		return
 	}
 
-	err = u.signIn(w, user)
+	user, err := u.service.CompleteLoginLink(form.Token)
 	if err != nil {
+		form.Token = ""
 		vd.SetAlert(err)
-		u.LoginView.Render(w, r, vd)
+		u.LoginLinkView.Render(w, r, vd)
 		return
 	}
 
-	alert := views.Alert{
-		Level:   views.AlertLvlSuccess,
-		Message: "Welcome back " + user.Name,
+	if err := completeLogin(w, r, u.service, user); err != nil {
+		form.Token = ""
+		vd.SetAlert(err)
+		u.LoginLinkView.Render(w, r, vd)
+	}
+}
+
+// CompleteTwoFactor is the second login step for users with
+// two-factor authentication enabled. The user is only signed in
+// once the TOTP or recovery code is verified.
+//
+// POST /login/2fa
+func (u *Users) CompleteTwoFactor(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form TwoFactorForm
+
+	cookie, err := r.Cookie("twofactor_token")
+	if err != nil {
+		alert := views.Alert{
+			Level:   views.AlertLvlWarning,
+			Message: "Your login has expired. Please log in again.",
+		}
+		views.RedirectAlert(w, r, "/login", http.StatusFound, alert)
+		return
+	}
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.TwoFactorView.Render(w, r, vd)
+		return
+	}
+
+	user, err := u.service.CompleteTwoFactor(cookie.Value, form.Code)
+	if err != nil {
+		if err == models.ErrTokenInvalid {
+			u.clearTwoFactor(w)
+			alert := views.Alert{
+				Level: views.AlertLvlWarning,
+				Message: "Your login has expired. Please " +
+					"log in again.",
+			}
+			views.RedirectAlert(w, r, "/login",
+				http.StatusFound, alert)
+			return
+		}
+		vd.SetAlert(err)
+		u.TwoFactorView.Render(w, r, vd)
+		return
+	}
+
+	u.clearTwoFactor(w)
+
+	alert := welcomeBack(user)
+	err = signIn(w, r, u.service, user)
+	if err != nil {
+		vd.SetAlert(err)
+		u.TwoFactorView.Render(w, r, vd)
+		return
 	}
 
 	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
 }
 
-// Logout is used to delete a user's session cookie and invalidate
-// theis current remember token, which will sign the current user out.
+// Logout is used to delete a user's session cookie and revoke their
+// current session, which will sign the current user out. Sessions on
+// other devices are not affected.
 func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
 	// First expire the user's cookie
 	cookie := http.Cookie{
-		Name:     "remember_token",
+		Name:     "remember_cookie",
 		Value:    "",
 		Expires:  time.Now(),
 		HttpOnly: true,
@@ -174,14 +365,15 @@ func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
 
 	http.SetCookie(w, &cookie)
 
-	// Then we update the user with a new remember token
-	user := context.User(r.Context())
+	// Then we revoke the session so the token can't be reused.
 	// We are ignoring errors for now because they are unlikely,
 	// and even if they do occur we can't recover now that the
 	// user doesn't have a valid cookie
-	token, _ := rand.RememberToken()
-	user.Remember = token
-	u.service.Update(user)
+	// The session belongs to the admin, not to the current user,
+	// while impersonating someone.
+	if session := context.Session(r.Context()); session != nil {
+		u.service.RevokeSession(session.UserID, session.ID)
+	}
 	// Finally send the user to the home page
 	alert := views.Alert{
 		Level:   views.AlertLvlSuccess,
@@ -204,7 +396,7 @@ func (u *Users) InitiateReset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := u.service.InitiateReset(form.Email)
+	token, err := u.service.InitiateReset(form.Email, clientInfo(r))
 	if err != nil {
 		vd.SetAlert(err)
 		u.ForgotPwView.Render(w, r, vd)
@@ -257,21 +449,91 @@ func (u *Users) CompleteReset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := u.service.CompleteReset(form.Token, form.Password)
+	user, err := u.service.CompleteReset(form.Token, form.Password,
+		clientInfo(r))
 	if err != nil {
 		vd.SetAlert(err)
 		u.ResetPwView.Render(w, r, vd)
 		return
 	}
 
-	u.signIn(w, user)
+	if err := u.emailer.PasswordChanged(user.Name, user.Email); err != nil {
+		log.Println(err)
+	}
+
+	// The reset only proves access to the mailbox, users with
+	// two-factor authentication still have to enter a code.
+	if err := completeLogin(w, r, u.service, user); err != nil {
+		log.Println(err)
+		vd.AlertError("Your password has been reset, but we " +
+			"couldn't log you in. Please log in with it.")
+		u.renderLogin(w, r, vd)
+	}
+}
+
+// Verify confirms the user's email address when a token is provided
+// via the URL query params. Without a token it displays a page
+// where a signed in user can request a new verification email.
+//
+// GET /verify
+func (u *Users) Verify(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form VerifyForm
+
+	vd.Yield = context.User(r.Context())
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.VerifyView.Render(w, r, vd)
+		return
+	}
+
+	if form.Token == "" {
+		u.VerifyView.Render(w, r, vd)
+		return
+	}
+
+	_, err := u.service.CompleteVerification(form.Token)
+	if err != nil {
+		vd.SetAlert(err)
+		u.VerifyView.Render(w, r, vd)
+		return
+	}
+
+	v := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your email address has been verified!",
+	}
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, v)
+}
+
+// ResendVerification emails a new verification link to the current
+// user.
+//
+// POST /verify
+func (u *Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+
+	user := context.User(r.Context())
+	vd.Yield = user
+	if user.EmailVerified() {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+
+	if err := u.sendVerification(user); err != nil {
+		vd.SetAlert(err)
+		u.VerifyView.Render(w, r, vd)
+		return
+	}
 
 	v := views.Alert{
 		Level: views.AlertLvlSuccess,
-		Message: "Your password has been reset and you have " +
-			"been logged in!",
+		Message: "A new verification link has been emailed " +
+			"to you.",
 	}
-	views.RedirectAlert(w, r, "/galleries", http.StatusFound, v)
+	views.RedirectAlert(w, r, "/verify", http.StatusFound, v)
 }
 
 // CookieTest is used to display cookies set on the current user
@@ -282,13 +544,14 @@ func (u *Users) CookieTest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := u.service.ByRemember(cookie.Value)
+	user, session, err := u.service.BySession(cookie.Value)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	fmt.Fprintln(w, "User found is:", user)
+	fmt.Fprintln(w, "Session found is:", session)
 }
 
 /////////////////////////////////////////////////////////////////////
@@ -297,33 +560,54 @@ func (u *Users) CookieTest(w http.ResponseWriter, r *http.Request) {
 //
 /////////////////////////////////////////////////////////////////////
 
-// signIn is used to sign the given user in via cookies
-func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
-
-	// Set a remember token if none is found
-	if user.Remember == "" {
+// welcomeBack builds the alert displayed after a successful login. It
+// has to be called before signIn, which restores accounts that are
+// scheduled for deletion.
+func welcomeBack(user *models.User) views.Alert {
 
-		token, err := rand.RememberToken()
-		if err != nil {
-			return err
+	if user.DeletionScheduled() {
+		return views.Alert{
+			Level: views.AlertLvlSuccess,
+			Message: "Welcome back " + user.Name + "! Your " +
+				"account will not be deleted after all.",
 		}
+	}
 
-		user.Remember = token
+	return views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Welcome back " + user.Name,
+	}
+}
 
-		err = u.service.Update(user)
-		if err != nil {
-			return err
-		}
+// renderLogin renders the login form with the providers users can
+// sign in with.
+func (u *Users) renderLogin(w http.ResponseWriter, r *http.Request,
+	vd views.Data) {
 
-	}
+	vd.Yield = u.providers
+	u.LoginView.Render(w, r, vd)
+}
 
-	// Set a cookie with remember token from user
+// clearTwoFactor expires the cookie holding a pending two-factor
+// login.
+func (u *Users) clearTwoFactor(w http.ResponseWriter) {
 	cookie := http.Cookie{
-		Name:     "remember_cookie",
-		Value:    user.Remember,
+		Name:     "twofactor_token",
+		Value:    "",
+		Expires:  time.Now(),
 		HttpOnly: true,
 	}
 	http.SetCookie(w, &cookie)
+}
+
+// sendVerification creates a new verification token for the user and
+// emails it to their current address.
+func (u *Users) sendVerification(user *models.User) error {
+
+	token, err := u.service.InitiateVerification(user)
+	if err != nil {
+		return err
+	}
 
-	return nil
+	return u.emailer.VerifyEmail(user.Email, token)
 }
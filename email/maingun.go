@@ -2,15 +2,30 @@ package email
 
 import (
 	"fmt"
+	"html/template"
 	"net/url"
+	"time"
 
 	mailgun "gopkg.in/mailgun/mailgun-go.v1"
 )
 
 const (
-	welcomeSubject = "Welcome to LensLockedBR.com!"
-	resetSubject   = "Instructions for reseting your password."
-	resetBaseURL   = "https://www.leandr0.net/reset"
+	welcomeSubject     = "Welcome to LensLockedBR.com!"
+	resetSubject       = "Instructions for reseting your password."
+	resetBaseURL       = "https://www.leandr0.net/reset"
+	verifySubject      = "Please verify your email address."
+	verifyBaseURL      = "https://www.leandr0.net/verify"
+	pwChangedSubject   = "Your password was changed."
+	forgotURL          = "https://www.leandr0.net/forgot"
+	deletionSubject    = "Your account is scheduled for deletion."
+	loginURL           = "https://www.leandr0.net/login"
+	emailChangeSubject = "Please confirm your new email address."
+	emailChangeURL     = "https://www.leandr0.net/account/email/confirm"
+	emailNoticeSubject = "A change of email address was requested."
+	loginLinkSubject   = "Your sign-in link for LensLockedBR.com"
+	loginLinkBaseURL   = "https://www.leandr0.net/login/link"
+	exportSubject      = "Your LensLockedBR.com data export is ready."
+	exportBaseURL      = "https://www.leandr0.net/account/export/download"
 )
 
 //
@@ -41,6 +56,87 @@ If you didn't request a password reset you can safely ignore this email and your
 Best, LensLockedBR Support
 `
 
+const verifyTextTmpl = `Hi there!
+
+Thanks for signing up to LensLockedBR.com! Please confirm that this is your email address by following the link below:
+
+%s
+
+If you didn't create an account you can safely ignore this email.
+
+Best, LensLockedBR Support
+`
+
+const pwChangedTextTmpl = `Hi %s,
+
+The password of your LensLockedBR.com account was just changed, and every device that was logged in to your account has been signed out.
+
+If you made this change you don't need to do anything else.
+
+If you didn't, please reset your password right away:
+
+%s
+
+Best, LensLockedBR Support
+`
+
+const deletionTextTmpl = `Hi %s,
+
+As requested, your LensLockedBR.com account and everything in it, including all of your galleries and photos, will be permanently deleted on %s.
+
+Changed your mind? Just log in before then and your account will be restored:
+
+%s
+
+Best, LensLockedBR Support
+`
+
+const emailChangeTextTmpl = `Hi there!
+
+Someone asked to use this address for their LensLockedBR.com account. If this was you, please confirm the change by following the link below:
+
+%s
+
+The link is valid for 24 hours. If you didn't request this you can safely ignore this email.
+
+Best, LensLockedBR Support
+`
+
+const emailNoticeTextTmpl = `Hi %s,
+
+Someone asked to change the email address of your LensLockedBR.com account to %s. The change will only happen once the new address is confirmed.
+
+If you made this request you don't need to do anything else.
+
+If you didn't, please reset your password right away:
+
+%s
+
+Best, LensLockedBR Support
+`
+
+const loginLinkTextTmpl = `Hi there!
+
+Follow the link below to log in to LensLockedBR.com:
+
+%s
+
+The link can only be used once and expires in 15 minutes. If you didn't ask for it you can safely ignore this email.
+
+Best, LensLockedBR Support
+`
+
+const exportTextTmpl = `Hi %s,
+
+The copy of your LensLockedBR.com data you asked for is ready. You can download it until %s, after logging in, by following the link below:
+
+%s
+
+If you didn't ask for it, please change your password right away.
+
+Best, LensLockedBR Support
+`
+
 //
 // Email HTML
 //
@@ -71,6 +167,94 @@ Best,<br/>
 LensLockedBR Support<br/>
 `
 
+const verifyHTMLTmpl = `Hi there!<br/>
+<br/>
+Thanks for signing up to LensLockedBR.com! Please confirm that this is your email address by following the link below:<br/>
+<br/>
+<a href="%s">%s</a><br/>
+<br/>
+If you didn't create an account you can safely ignore this email.<br/>
+<br/>
+Best,<br/>
+LensLockedBR Support<br/>
+`
+
+const pwChangedHTMLTmpl = `Hi %s,<br/>
+<br/>
+The password of your LensLockedBR.com account was just changed, and every device that was logged in to your account has been signed out.<br/>
+<br/>
+If you made this change you don't need to do anything else.<br/>
+<br/>
+If you didn't, please reset your password right away:<br/>
+<br/>
+<a href="%s">%s</a><br/>
+<br/>
+Best,<br/>
+LensLockedBR Support<br/>
+`
+
+const deletionHTMLTmpl = `Hi %s,<br/>
+<br/>
+As requested, your LensLockedBR.com account and everything in it, including all of your galleries and photos, will be permanently deleted on %s.<br/>
+<br/>
+Changed your mind? Just log in before then and your account will be restored:<br/>
+<br/>
+<a href="%s">%s</a><br/>
+<br/>
+Best,<br/>
+LensLockedBR Support<br/>
+`
+
+const emailChangeHTMLTmpl = `Hi there!<br/>
+<br/>
+Someone asked to use this address for their LensLockedBR.com account. If this was you, please confirm the change by following the link below:<br/>
+<br/>
+<a href="%s">%s</a><br/>
+<br/>
+The link is valid for 24 hours. If you didn't request this you can safely ignore this email.<br/>
+<br/>
+Best,<br/>
+LensLockedBR Support<br/>
+`
+
+const emailNoticeHTMLTmpl = `Hi %s,<br/>
+<br/>
+Someone asked to change the email address of your LensLockedBR.com account to %s. The change will only happen once the new address is confirmed.<br/>
+<br/>
+If you made this request you don't need to do anything else.<br/>
+<br/>
+If you didn't, please reset your password right away:<br/>
+<br/>
+<a href="%s">%s</a><br/>
+<br/>
+Best,<br/>
+LensLockedBR Support<br/>
+`
+
+const loginLinkHTMLTmpl = `Hi there!<br/>
+<br/>
+Follow the link below to log in to LensLockedBR.com:<br/>
+<br/>
+<a href="%s">%s</a><br/>
+<br/>
+The link can only be used once and expires in 15 minutes. If you didn't ask for it you can safely ignore this email.<br/>
+<br/>
+Best,<br/>
+LensLockedBR Support<br/>
+`
+
+const exportHTMLTmpl = `Hi %s,<br/>
+<br/>
+The copy of your LensLockedBR.com data you asked for is ready. You can download it until %s, after logging in, by following the link below:<br/>
+<br/>
+<a href="%s">%s</a><br/>
+<br/>
+If you didn't ask for it, please change your password right away.<br/>
+<br/>
+Best,<br/>
+LensLockedBR Support<br/>
+`
+
 //
 // Structs and Methods
 //
@@ -108,6 +292,149 @@ func (c *Client) ResetPw(toEmail, token string) error {
 	return err
 }
 
+func (c *Client) VerifyEmail(toEmail, token string) error {
+
+	v := url.Values{}
+	v.Set("token", token)
+
+	verifyUrl := verifyBaseURL + "?" + v.Encode()
+
+	verifyText := fmt.Sprintf(verifyTextTmpl, verifyUrl)
+	message := mailgun.NewMessage(c.from, verifySubject, verifyText,
+		toEmail)
+
+	verifyHTML := fmt.Sprintf(verifyHTMLTmpl, verifyUrl, verifyUrl)
+	message.SetHtml(verifyHTML)
+	_, _, err := c.mg.Send(message)
+
+	return err
+}
+
+func (c *Client) PasswordChanged(toName, toEmail string) error {
+
+	name := toName
+	if name == "" {
+		name = "there"
+	}
+
+	text := fmt.Sprintf(pwChangedTextTmpl, name, forgotURL)
+	message := mailgun.NewMessage(c.from, pwChangedSubject, text,
+		buildEmail(toName, toEmail))
+
+	html := fmt.Sprintf(pwChangedHTMLTmpl, template.HTMLEscapeString(name),
+		forgotURL, forgotURL)
+	message.SetHtml(html)
+	_, _, err := c.mg.Send(message)
+
+	return err
+}
+
+func (c *Client) DeletionScheduled(toName, toEmail string, date time.Time) error {
+
+	name := toName
+	if name == "" {
+		name = "there"
+	}
+	when := date.Format("January 2, 2006")
+
+	text := fmt.Sprintf(deletionTextTmpl, name, when, loginURL)
+	message := mailgun.NewMessage(c.from, deletionSubject, text,
+		buildEmail(toName, toEmail))
+
+	html := fmt.Sprintf(deletionHTMLTmpl, template.HTMLEscapeString(name),
+		when, loginURL, loginURL)
+	message.SetHtml(html)
+	_, _, err := c.mg.Send(message)
+
+	return err
+}
+
+func (c *Client) ConfirmEmailChange(toEmail, token string) error {
+
+	v := url.Values{}
+	v.Set("token", token)
+
+	confirmUrl := emailChangeURL + "?" + v.Encode()
+
+	text := fmt.Sprintf(emailChangeTextTmpl, confirmUrl)
+	message := mailgun.NewMessage(c.from, emailChangeSubject, text,
+		toEmail)
+
+	html := fmt.Sprintf(emailChangeHTMLTmpl, confirmUrl, confirmUrl)
+	message.SetHtml(html)
+	_, _, err := c.mg.Send(message)
+
+	return err
+}
+
+// EmailChangeRequested lets the owner of the current address know
+// that a change to newEmail is pending confirmation.
+func (c *Client) EmailChangeRequested(toName, toEmail, newEmail string) error {
+
+	name := toName
+	if name == "" {
+		name = "there"
+	}
+
+	text := fmt.Sprintf(emailNoticeTextTmpl, name, newEmail, forgotURL)
+	message := mailgun.NewMessage(c.from, emailNoticeSubject, text,
+		buildEmail(toName, toEmail))
+
+	html := fmt.Sprintf(emailNoticeHTMLTmpl,
+		template.HTMLEscapeString(name),
+		template.HTMLEscapeString(newEmail), forgotURL, forgotURL)
+	message.SetHtml(html)
+	_, _, err := c.mg.Send(message)
+
+	return err
+}
+
+func (c *Client) LoginLink(toEmail, token string) error {
+
+	v := url.Values{}
+	v.Set("token", token)
+
+	linkUrl := loginLinkBaseURL + "?" + v.Encode()
+
+	text := fmt.Sprintf(loginLinkTextTmpl, linkUrl)
+	message := mailgun.NewMessage(c.from, loginLinkSubject, text,
+		toEmail)
+
+	html := fmt.Sprintf(loginLinkHTMLTmpl, linkUrl, linkUrl)
+	message.SetHtml(html)
+	_, _, err := c.mg.Send(message)
+
+	return err
+}
+
+// ExportReady sends the link to download an export of the user's
+// data, which expires at the given time.
+func (c *Client) ExportReady(toName, toEmail, token string,
+	expires time.Time) error {
+
+	name := toName
+	if name == "" {
+		name = "there"
+	}
+	when := expires.Format("January 2, 2006 15:04 MST")
+
+	v := url.Values{}
+	v.Set("token", token)
+
+	exportUrl := exportBaseURL + "?" + v.Encode()
+
+	text := fmt.Sprintf(exportTextTmpl, name, when, exportUrl)
+	message := mailgun.NewMessage(c.from, exportSubject, text,
+		buildEmail(toName, toEmail))
+
+	html := fmt.Sprintf(exportHTMLTmpl, template.HTMLEscapeString(name),
+		when, exportUrl, exportUrl)
+	message.SetHtml(html)
+	_, _, err := c.mg.Send(message)
+
+	return err
+}
+
 type ClientConfig func(*Client)
 
 func NewClient(opts ...ClientConfig) *Client {
@@ -4,30 +4,57 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
-	"hash"
 )
 
 // HMAC is a wrapper around the crypto/hmac package making it a little
 // easier to use in our code.
+//
+// New hashes are always made with the primary key. Retired keys are
+// only kept around so that the values hashed with them before a key
+// rotation can still be looked up, see Hashes.
 type HMAC struct {
-	hmac hash.Hash
+	keys [][]byte
 }
 
 // NewHMAC creates and returns a new HMAC object
-func NewHMAC(key string) HMAC {
-	h := hmac.New(sha256.New, []byte(key))
+func NewHMAC(key string, retired ...string) HMAC {
+
+	keys := [][]byte{[]byte(key)}
+	for _, k := range retired {
+		keys = append(keys, []byte(k))
+	}
 
 	return HMAC{
-		hmac: h,
+		keys: keys,
 	}
 }
 
-// Hash will hash the provided input string using HMAC with the secret
-// key provided when the HMAC object was created
+// Hash will hash the provided input string using HMAC with the
+// primary key provided when the HMAC object was created
 func (h HMAC) Hash(input string) string {
-	h.hmac.Reset()
-	h.hmac.Write([]byte(input))
-	b := h.hmac.Sum(nil)
+	return sum(h.keys[0], input)
+}
+
+// Hashes will hash the provided input string with every key, the
+// primary key first followed by the retired ones in the order they
+// were provided.
+func (h HMAC) Hashes(input string) []string {
+
+	hashes := make([]string, len(h.keys))
+	for i, key := range h.keys {
+		hashes[i] = sum(key, input)
+	}
+
+	return hashes
+}
+
+// sum creates a new hash.Hash on every call, as they aren't safe to
+// share between goroutines.
+func sum(key []byte, input string) string {
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(input))
+	b := mac.Sum(nil)
 
 	return base64.URLEncoding.EncodeToString(b)
 }
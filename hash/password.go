@@ -0,0 +1,264 @@
+package hash
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Algorithms supported by Password.
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+)
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+var (
+	// ErrPasswordMismatch is returned by Password.Compare when the
+	// password doesn't match the hash.
+	ErrPasswordMismatch = errors.New("hash: password does not match")
+
+	// ErrUnknownHash is returned when a stored hash isn't in any of
+	// the formats we know about.
+	ErrUnknownHash = errors.New("hash: unknown password hash format")
+)
+
+// PasswordConfig picks the algorithm used to hash new passwords along
+// with its parameters. Zero values are replaced with the defaults.
+type PasswordConfig struct {
+	Algorithm  string
+	BcryptCost int
+
+	// Argon2Memory is in KiB.
+	Argon2Memory  uint32
+	Argon2Time    uint32
+	Argon2Threads uint8
+}
+
+// DefaultPasswordConfig returns the parameters recommended by the
+// x/crypto/argon2 documentation.
+func DefaultPasswordConfig() PasswordConfig {
+	return PasswordConfig{
+		Algorithm:     Argon2id,
+		BcryptCost:    bcrypt.DefaultCost,
+		Argon2Memory:  64 * 1024,
+		Argon2Time:    1,
+		Argon2Threads: 4,
+	}
+}
+
+// Password hashes passwords with an app-wide pepper. Every hash is
+// stored along with its algorithm and parameters, bcrypt's own
+// $2a$cost$ prefix or the PHC string format for argon2id, so the
+// parameters can be changed without breaking the existing hashes.
+//
+// Like with HMAC keys, retired peppers are only used to check the
+// passwords hashed before the pepper was rotated.
+type Password struct {
+	peppers []string
+	cfg     PasswordConfig
+}
+
+// NewPassword creates and returns a new Password object
+func NewPassword(cfg PasswordConfig, pepper string, retired ...string) Password {
+
+	def := DefaultPasswordConfig()
+	if cfg.Algorithm == "" {
+		cfg.Algorithm = def.Algorithm
+	}
+	if cfg.BcryptCost == 0 {
+		cfg.BcryptCost = def.BcryptCost
+	}
+	if cfg.Argon2Memory == 0 {
+		cfg.Argon2Memory = def.Argon2Memory
+	}
+	if cfg.Argon2Time == 0 {
+		cfg.Argon2Time = def.Argon2Time
+	}
+	if cfg.Argon2Threads == 0 {
+		cfg.Argon2Threads = def.Argon2Threads
+	}
+
+	return Password{
+		peppers: append([]string{pepper}, retired...),
+		cfg:     cfg,
+	}
+}
+
+// Hash will hash the password with the configured algorithm and the
+// primary pepper.
+func (p Password) Hash(password string) (string, error) {
+
+	pwBytes := []byte(password + p.peppers[0])
+
+	switch p.cfg.Algorithm {
+	case Bcrypt:
+		hashedBytes, err := bcrypt.GenerateFromPassword(pwBytes,
+			p.cfg.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hashedBytes), nil
+	case Argon2id:
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey(pwBytes, salt, p.cfg.Argon2Time,
+			p.cfg.Argon2Memory, p.cfg.Argon2Threads, argon2KeyLen)
+		return encodeArgon2id(argon2Params{
+			memory:  p.cfg.Argon2Memory,
+			time:    p.cfg.Argon2Time,
+			threads: p.cfg.Argon2Threads,
+			salt:    salt,
+			key:     key,
+		}), nil
+	default:
+		return "", fmt.Errorf("hash: unsupported algorithm %q",
+			p.cfg.Algorithm)
+	}
+}
+
+// Compare returns nil if the password matches the hash, whichever
+// algorithm and pepper it was made with, and ErrPasswordMismatch if
+// it doesn't. When it matches, rehash reports whether the hash is
+// out of date and the password should be hashed again while we have
+// it in clear text.
+func (p Password) Compare(hash, password string) (rehash bool, err error) {
+
+	for i, pepper := range p.peppers {
+		err = compare(hash, password+pepper)
+		if err == ErrPasswordMismatch {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		return i > 0 || p.outdated(hash), nil
+	}
+
+	return false, ErrPasswordMismatch
+}
+
+// outdated reports whether the hash was made with a different
+// algorithm or with other parameters than the configured ones.
+func (p Password) outdated(hash string) bool {
+
+	if isBcrypt(hash) {
+		if p.cfg.Algorithm != Bcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != p.cfg.BcryptCost
+	}
+
+	params, err := decodeArgon2id(hash)
+	if err != nil || p.cfg.Algorithm != Argon2id {
+		return true
+	}
+
+	return params.memory != p.cfg.Argon2Memory ||
+		params.time != p.cfg.Argon2Time ||
+		params.threads != p.cfg.Argon2Threads ||
+		len(params.salt) != argon2SaltLen ||
+		len(params.key) != argon2KeyLen
+}
+
+/////////////////////////////////////////////////////////////////////
+//
+// Helper Methods
+//
+/////////////////////////////////////////////////////////////////////
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// compare checks an already peppered password against the hash.
+func compare(hash, peppered string) error {
+
+	pwBytes := []byte(peppered)
+
+	if isBcrypt(hash) {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), pwBytes)
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return ErrPasswordMismatch
+		}
+		return err
+	}
+
+	params, err := decodeArgon2id(hash)
+	if err != nil {
+		return err
+	}
+
+	key := argon2.IDKey(pwBytes, params.salt, params.time,
+		params.memory, params.threads, uint32(len(params.key)))
+	if subtle.ConstantTimeCompare(key, params.key) != 1 {
+		return ErrPasswordMismatch
+	}
+
+	return nil
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2")
+}
+
+// encodeArgon2id formats the hash as a PHC string, like:
+//
+//	$argon2id$v=19$m=65536,t=1,p=4$<salt>$<key>
+func encodeArgon2id(p argon2Params) string {
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", Argon2id,
+		argon2.Version, p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(p.salt),
+		base64.RawStdEncoding.EncodeToString(p.key))
+}
+
+func decodeArgon2id(hash string) (argon2Params, error) {
+
+	var p argon2Params
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != Argon2id {
+		return p, ErrUnknownHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return p, ErrUnknownHash
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory,
+		&p.time, &p.threads)
+	if err != nil || p.time == 0 || p.threads == 0 {
+		return p, ErrUnknownHash
+	}
+
+	p.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, ErrUnknownHash
+	}
+
+	p.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(p.key) == 0 {
+		return p, ErrUnknownHash
+	}
+
+	return p, nil
+}
@@ -5,11 +5,12 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-
-	"golang.org/x/oauth2"
+	"os"
+	"time"
 
 	"lenslockedbr.com/controllers"
 	"lenslockedbr.com/email"
+	"lenslockedbr.com/hash"
 	"lenslockedbr.com/middleware"
 	"lenslockedbr.com/models"
 	"lenslockedbr.com/rand"
@@ -24,6 +25,18 @@ func main() {
 		"production. This ensures that a "+
 		".config file is provided before the "+
 		"application starts.")
+	adminPtr := flag.String("grant-admin", "", "Email address of "+
+		"a user to make an administrator. The application "+
+		"exits once it's done.")
+	importPtr := flag.String("import", "", "Path of an export "+
+		"archive to import for the user given with -import-user. "+
+		"The application exits once it's done.")
+	importUserPtr := flag.String("import-user", "", "Email address "+
+		"of the user to import the archive given with -import for.")
+	backfillPtr := flag.Bool("backfill-images", false, "Add the "+
+		"images found on disk that are missing from the database, "+
+		"then recount the storage of every user. The application "+
+		"exits once it's done.")
 	flag.Parse()
 
 	//
@@ -35,14 +48,21 @@ func main() {
 	// Database configuration
 	//
 	dbCfg := cfg.Database
+	pw := cfg.Password.Hasher(cfg.Pepper, cfg.RetiredPeppers...)
+	hmac := hash.NewHMAC(cfg.HMACKey, cfg.RetiredHMACKeys...)
 
 	services, err := models.NewServices(
 		models.WithGorm(dbCfg.Dialect(), dbCfg.ConnectionInfo()),
 		models.WithLogMode(!cfg.IsProd()),
-		models.WithUser(cfg.Pepper, cfg.HMACKey),
-		models.WithGallery(),
-		models.WithImage(),
-		models.WithOAuth())
+		models.WithUser(pw, hmac, cfg.Password.Policy()),
+		models.WithGallery(pw, hmac),
+		models.WithImage(cfg.StorageQuota),
+		models.WithShareLink(hmac),
+		models.WithOAuth(),
+		models.WithAdmin(),
+		models.WithAudit(),
+		models.WithExport(hmac),
+		models.WithImport())
 	if err != nil {
 		panic(err)
 	}
@@ -50,6 +70,24 @@ func main() {
 	defer services.Close()
 	services.AutoMigrate()
 
+	if *adminPtr != "" {
+		grantAdmin(services, *adminPtr)
+		return
+	}
+
+	if *importPtr != "" {
+		importArchive(services, *importPtr, *importUserPtr)
+		return
+	}
+
+	if *backfillPtr {
+		backfillImages(services)
+		return
+	}
+
+	go purgeDeletedUsers(services)
+	go deleteExpiredExports(services)
+
 	//
 	// Mailing configuration
 	//
@@ -63,24 +101,23 @@ func main() {
 	//
 	// OAuth configuration
 	//
-	oauthCfgs := make(map[string]*oauth2.Config)
-        oauthCfgs[models.OAuthDropbox] = &oauth2.Config{
-		ClientID: cfg.Dropbox.ID,
-		ClientSecret: cfg.Dropbox.Secret,
-		Endpoint: oauth2.Endpoint{
-			AuthURL: cfg.Dropbox.AuthURL,
-			TokenURL: cfg.Dropbox.TokenURL,
-		},
-		RedirectURL: cfg.Dropbox.RedirectURL,
-	}
+	providers := cfg.Providers()
 
 	r := mux.NewRouter()
 
 	staticC := controllers.NewStatic()
-	usersC := controllers.NewUsers(services.User, emailer)
+	usersC := controllers.NewUsers(services.User, emailer, providers)
 	galleriesC := controllers.NewGalleries(services.Gallery,
-		services.Image, r)
-	oauthsC := controllers.NewOAuths(services.OAuth, oauthCfgs)
+		services.Image, services.ShareLink, services.User,
+		services.Audit, r)
+	oauthsC := controllers.NewOAuths(services.OAuth, services.User,
+		providers)
+	accountC := controllers.NewAccount(services.User, services.Audit,
+		services.Export, services.Import, emailer)
+	adminC := controllers.NewAdmin(services.User, services.Gallery,
+		services.Image, services.Admin)
+	profilesC := controllers.NewProfiles(services.User,
+		services.Gallery, services.Image)
 
 	//
 	// Middleware setup
@@ -89,6 +126,19 @@ func main() {
 		UserService: services.User,
 	}
 	requireUserMw := middleware.RequireUser{}
+	requireSelfMw := middleware.RequireUser{
+		NotImpersonated: true,
+	}
+	readGalleriesMw := middleware.RequireUser{
+		Scope: models.ScopeReadGalleries,
+	}
+	writeGalleriesMw := middleware.RequireUser{
+		Scope: models.ScopeWriteGalleries,
+	}
+	writeImagesMw := middleware.RequireUser{
+		Scope: models.ScopeWriteImages,
+	}
+	requireAdminMw := middleware.RequireAdmin{}
 
 	b, err := rand.Bytes(32)
 	if err != nil {
@@ -107,8 +157,14 @@ func main() {
 
 	r.HandleFunc("/signup", usersC.New).Methods("GET")
 	r.HandleFunc("/signup", usersC.Create).Methods("POST")
-	r.Handle("/login", usersC.LoginView).Methods("GET")
+	r.HandleFunc("/login", usersC.ShowLogin).Methods("GET")
 	r.HandleFunc("/login", usersC.Login).Methods("POST")
+	r.Handle("/login/2fa", usersC.TwoFactorView).Methods("GET")
+	r.HandleFunc("/login/2fa", usersC.CompleteTwoFactor).Methods("POST")
+	r.HandleFunc("/login/link", usersC.LoginLink).Methods("GET")
+	r.HandleFunc("/login/link", usersC.InitiateLoginLink).Methods("POST")
+	r.HandleFunc("/login/link/complete",
+		usersC.CompleteLoginLink).Methods("POST")
 	r.Handle("/logout",
 		requireUserMw.ApplyFn(usersC.Logout)).Methods("POST")
 
@@ -117,13 +173,108 @@ func main() {
 	r.HandleFunc("/reset", usersC.ResetPw).Methods("GET")
 	r.HandleFunc("/reset", usersC.CompleteReset).Methods("POST")
 
+	r.HandleFunc("/verify", usersC.Verify).Methods("GET")
+	r.HandleFunc("/verify",
+		requireUserMw.ApplyFn(usersC.ResendVerification)).
+		Methods("POST")
+
 	r.HandleFunc("/cookietest", usersC.CookieTest).Methods("GET")
 
+	//
+	// Account routes
+	//
+	r.HandleFunc("/account",
+		requireUserMw.ApplyFn(accountC.Index)).Methods("GET")
+	r.HandleFunc("/account/2fa",
+		requireSelfMw.ApplyFn(accountC.TwoFactor)).Methods("GET")
+	r.HandleFunc("/account/2fa/enroll",
+		requireSelfMw.ApplyFn(accountC.EnrollTwoFactor)).
+		Methods("POST")
+	r.HandleFunc("/account/2fa/confirm",
+		requireSelfMw.ApplyFn(accountC.ConfirmTwoFactor)).
+		Methods("POST")
+	r.HandleFunc("/account/2fa/disable",
+		requireSelfMw.ApplyFn(accountC.DisableTwoFactor)).
+		Methods("POST")
+	r.Handle("/account/password",
+		requireSelfMw.Apply(accountC.PasswordView)).Methods("GET")
+	r.HandleFunc("/account/password",
+		requireSelfMw.ApplyFn(accountC.ChangePassword)).
+		Methods("POST")
+	r.Handle("/account/email",
+		requireSelfMw.Apply(accountC.EmailView)).Methods("GET")
+	r.HandleFunc("/account/email",
+		requireSelfMw.ApplyFn(accountC.ChangeEmail)).Methods("POST")
+	r.HandleFunc("/account/email/confirm",
+		accountC.ConfirmEmail).Methods("GET")
+	r.HandleFunc("/account/profile",
+		requireUserMw.ApplyFn(profilesC.Edit)).Methods("GET")
+	r.HandleFunc("/account/profile",
+		requireSelfMw.ApplyFn(profilesC.Update)).Methods("POST")
+	r.Handle("/account/delete",
+		requireSelfMw.Apply(accountC.DeleteView)).Methods("GET")
+	r.HandleFunc("/account/delete",
+		requireSelfMw.ApplyFn(accountC.Delete)).Methods("POST")
+	r.HandleFunc("/account/sessions",
+		requireUserMw.ApplyFn(accountC.Sessions)).Methods("GET")
+	r.HandleFunc("/account/sessions/revoke",
+		requireSelfMw.ApplyFn(accountC.RevokeOtherSessions)).
+		Methods("POST")
+	r.HandleFunc("/account/sessions/{id:[0-9]+}/revoke",
+		requireSelfMw.ApplyFn(accountC.RevokeSession)).
+		Methods("POST")
+	r.HandleFunc("/account/activity",
+		requireUserMw.ApplyFn(accountC.Activity)).Methods("GET")
+	r.HandleFunc("/account/export",
+		requireUserMw.ApplyFn(accountC.Export)).Methods("GET")
+	r.HandleFunc("/account/export",
+		requireSelfMw.ApplyFn(accountC.RequestExport)).Methods("POST")
+	r.HandleFunc("/account/export/download",
+		requireSelfMw.ApplyFn(accountC.DownloadExport)).Methods("GET")
+	r.HandleFunc("/account/import",
+		requireSelfMw.ApplyFn(accountC.ImportArchive)).Methods("POST")
+	r.HandleFunc("/account/tokens",
+		requireUserMw.ApplyFn(accountC.APITokens)).Methods("GET")
+	r.HandleFunc("/account/tokens",
+		requireSelfMw.ApplyFn(accountC.CreateAPIToken)).
+		Methods("POST")
+	r.HandleFunc("/account/tokens/{id:[0-9]+}/revoke",
+		requireSelfMw.ApplyFn(accountC.RevokeAPIToken)).
+		Methods("POST")
+
+	//
+	// Admin routes
+	//
+	r.Handle("/admin", http.RedirectHandler("/admin/users",
+		http.StatusFound)).Methods("GET")
+	r.HandleFunc("/admin/users",
+		requireAdminMw.ApplyFn(adminC.Users)).Methods("GET")
+	r.HandleFunc("/admin/users/{id:[0-9]+}",
+		requireAdminMw.ApplyFn(adminC.User)).Methods("GET")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/disable",
+		requireAdminMw.ApplyFn(adminC.Disable)).Methods("POST")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/enable",
+		requireAdminMw.ApplyFn(adminC.Enable)).Methods("POST")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/quota",
+		requireAdminMw.ApplyFn(adminC.SetQuota)).Methods("POST")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/impersonate",
+		requireAdminMw.ApplyFn(adminC.Impersonate)).Methods("POST")
+	r.HandleFunc("/admin/impersonate/stop",
+		requireUserMw.ApplyFn(adminC.StopImpersonating)).
+		Methods("POST")
+	r.HandleFunc("/admin/log",
+		requireAdminMw.ApplyFn(adminC.Log)).Methods("GET")
+
+	//
+	// Profile routes
+	//
+	r.HandleFunc("/u/{handle}", profilesC.Show).Methods("GET")
+
 	//
 	// Gallery routes
 	//
 	r.Handle("/galleries",
-		requireUserMw.ApplyFn(galleriesC.Index)).Methods("GET").
+		readGalleriesMw.ApplyFn(galleriesC.Index)).Methods("GET").
 		Name(controllers.IndexGallery)
 
 	r.Handle("/galleries/new",
@@ -134,39 +285,68 @@ func main() {
 		Name(controllers.ShowGallery)
 
 	r.HandleFunc("/galleries",
-		requireUserMw.ApplyFn(galleriesC.Create)).Methods("POST")
+		writeGalleriesMw.ApplyFn(galleriesC.Create)).Methods("POST")
+
+	r.HandleFunc("/galleries/{id:[0-9]+}/unlock",
+		galleriesC.Unlock).Methods("POST")
 
 	r.HandleFunc("/galleries/{id:[0-9]+}/edit",
-		requireUserMw.ApplyFn(galleriesC.Edit)).Methods("GET").
+		readGalleriesMw.ApplyFn(galleriesC.Edit)).Methods("GET").
 		Name(controllers.EditGallery)
 
 	r.HandleFunc("/galleries/{id:[0-9]+}/update",
-		requireUserMw.ApplyFn(galleriesC.Update)).Methods("POST")
+		writeGalleriesMw.ApplyFn(galleriesC.Update)).Methods("POST")
 
 	r.HandleFunc("/galleries/{id:[0-9]+}/delete",
-		requireUserMw.ApplyFn(galleriesC.Delete)).Methods("POST")
+		writeGalleriesMw.ApplyFn(galleriesC.Delete)).Methods("POST")
 
 	r.HandleFunc("/galleries/{id:[0-9]+}/images",
-		requireUserMw.ApplyFn(galleriesC.ImageUpload)).
+		writeImagesMw.ApplyFn(galleriesC.ImageUpload)).
 		Methods("POST")
 
 	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete",
-		requireUserMw.ApplyFn(galleriesC.ImageDelete)).
+		writeImagesMw.ApplyFn(galleriesC.ImageDelete)).
 		Methods("POST")
 
 	r.HandleFunc("/galleries/{id:[0-9]+}/images/link",
-		requireUserMw.ApplyFn(galleriesC.ImageViaLink)).
+		writeImagesMw.ApplyFn(galleriesC.ImageViaLink)).
+		Methods("POST")
+
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/order",
+		writeImagesMw.ApplyFn(galleriesC.ImageOrder)).
+		Methods("POST")
+
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/sort",
+		writeImagesMw.ApplyFn(galleriesC.ImageSort)).
+		Methods("POST")
+
+	r.HandleFunc("/galleries/{id:[0-9]+}/links",
+		writeGalleriesMw.ApplyFn(galleriesC.CreateShareLink)).
+		Methods("POST")
+
+	r.HandleFunc("/galleries/{id:[0-9]+}/links/{link_id:[0-9]+}/revoke",
+		writeGalleriesMw.ApplyFn(galleriesC.RevokeShareLink)).
 		Methods("POST")
 
 	//
 	// Image routes
 	//
-	imageHandler := http.FileServer(http.Dir("./images/"))
-	imageHandler = http.StripPrefix("/images/", imageHandler)
-	r.PathPrefix("/images/").Handler(imageHandler)
+	// Images are only served to those who can see their gallery.
+	r.HandleFunc("/images/galleries/{id:[0-9]+}/{filename}",
+		galleriesC.Image).Methods("GET")
+	r.HandleFunc("/g/{slug}", galleriesC.ShowBySlug).Methods("GET")
+	r.HandleFunc("/g/{slug}/unlock",
+		galleriesC.UnlockBySlug).Methods("POST")
+	r.HandleFunc("/g/{slug}/images/{filename}",
+		galleriesC.ImageBySlug).Methods("GET")
+	r.HandleFunc("/s/{token}", galleriesC.ShowByLink).Methods("GET")
+	r.HandleFunc("/s/{token}/images/{filename}",
+		galleriesC.ImageByLink).Methods("GET")
+	r.HandleFunc("/s/{token}/download",
+		galleriesC.DownloadByLink).Methods("GET")
 
 	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete",
-		requireUserMw.ApplyFn(galleriesC.ImageDelete)).
+		writeImagesMw.ApplyFn(galleriesC.ImageDelete)).
 		Methods("POST")
 
 	//
@@ -174,8 +354,8 @@ func main() {
 	//
 	r.HandleFunc("/oauth/{service:[a-z]+}/connect", 
                      requireUserMw.ApplyFn(oauthsC.Connect))
-	r.HandleFunc("/oauth/{service:[a-z]+}/callback", 
-                     requireUserMw.ApplyFn(oauthsC.Callback))
+	r.HandleFunc("/oauth/{service:[a-z]+}/login", oauthsC.Connect)
+	r.HandleFunc("/oauth/{service:[a-z]+}/callback", oauthsC.Callback)
 	r.HandleFunc("/oauth/{service:[a-z]+}/test", 
                      requireUserMw.ApplyFn(oauthsC.DropboxTest))
 
@@ -188,6 +368,93 @@ func main() {
 
 	log.Printf("Starting the server on :%d...\n", cfg.Port)
 
+	// The user middleware runs first, so requests authenticated with
+	// an API token can skip the CSRF check.
 	http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port),
-		csrfMw(userMw.Apply(r)))
+		userMw.Apply(csrfMw(r)))
+}
+
+// purgeDeletedUsers periodically removes the accounts whose deletion
+// grace period is over.
+func purgeDeletedUsers(services *models.Services) {
+	for {
+		if err := services.PurgeDeletedUsers(); err != nil {
+			log.Println("Failed to purge deleted users:", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// deleteExpiredExports periodically removes the exports that can no
+// longer be downloaded.
+func deleteExpiredExports(services *models.Services) {
+	for {
+		if err := services.Export.DeleteExpired(); err != nil {
+			log.Println("Failed to delete expired exports:", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// grantAdmin gives admin rights to the user with the email address.
+// It's the only way to create the first admin.
+func grantAdmin(services *models.Services, email string) {
+
+	user, err := services.User.ByEmail(email)
+	if err != nil {
+		log.Fatalln("Failed to find", email+":", err)
+	}
+
+	user.IsAdmin = true
+	if err := services.User.Update(user); err != nil {
+		log.Fatalln("Failed to grant admin rights:", err)
+	}
+
+	log.Println(email, "is now an admin")
+}
+
+// importArchive recreates the galleries of an export archive for the
+// user with the email address.
+func importArchive(services *models.Services, path, email string) {
+
+	user, err := services.User.ByEmail(email)
+	if err != nil {
+		log.Fatalln("Failed to find", email+":", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalln("Failed to open the archive:", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		log.Fatalln("Failed to open the archive:", err)
+	}
+
+	result, err := services.Import.Import(user, f, info.Size())
+	if err != nil {
+		log.Fatalln("Failed to import the archive:", err)
+	}
+
+	services.Audit.Log(user, nil, models.AuditArchiveImported,
+		result.Summary(), models.ClientInfo{})
+
+	for from, to := range result.Galleries {
+		log.Printf("Gallery %d imported as %d\n", from, to)
+	}
+	log.Println("Imported", result.Summary(), "for", email)
+}
+
+// backfillImages adds the images stored on disk before they were
+// kept in the database, or that failed to be added since.
+func backfillImages(services *models.Services) {
+
+	n, err := services.Image.Backfill()
+	if err != nil {
+		log.Fatalln("Failed to backfill images:", err)
+	}
+
+	log.Println("Backfilled", n, "images")
 }
@@ -4,11 +4,24 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/gorilla/csrf"
+
 	"lenslockedbr.com/context"
 	"lenslockedbr.com/models"
+	"lenslockedbr.com/views"
 )
 
-type RequireUser struct{}
+// RequireUser assumes that User middleware has already been run,
+// otherwise it will not work correctly. Requests made with an API
+// token are only let through if the token was granted Scope, so
+// routes without a Scope can't be used with API tokens at all.
+//
+// Routes with NotImpersonated set can only be used by the user
+// themselves, admins impersonating them are sent back to /account.
+type RequireUser struct {
+	Scope           string
+	NotImpersonated bool
+}
 
 func (mw *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter,
@@ -20,6 +33,24 @@ func (mw *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
+		token := context.APIToken(r.Context())
+		if token != nil && (mw.Scope == "" || !token.HasScope(mw.Scope)) {
+			http.Error(w, "This API token is not allowed to do that",
+				http.StatusForbidden)
+			return
+		}
+
+		if mw.NotImpersonated && context.Impersonator(r.Context()) != nil {
+			alert := views.Alert{
+				Level: views.AlertLvlWarning,
+				Message: "Only the user can do that, stop " +
+					"impersonating them first.",
+			}
+			views.RedirectAlert(w, r, "/account", http.StatusFound,
+				alert)
+			return
+		}
+
 		next(w, r)
 	})
 }
@@ -28,10 +59,39 @@ func (mw *RequireUser) Apply(next http.Handler) http.HandlerFunc {
 	return mw.ApplyFn(next.ServeHTTP)
 }
 
-// User middleware will lookup the current user via their remember_token
-// cookie using the UserService. If the user is found, they will be set
-// on the request context.
-// Regardless, the next handler is always called.
+// RequireAdmin assumes that User middleware has already been run,
+// otherwise it will not work correctly. Users that aren't admins get
+// a 404, the admin area isn't advertised to them.
+type RequireAdmin struct {
+	RequireUser
+}
+
+func (mw *RequireAdmin) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return mw.RequireUser.ApplyFn(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		user := context.User(r.Context())
+		if !user.IsAdmin {
+			http.NotFound(w, r)
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+func (mw *RequireAdmin) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// User middleware will lookup the current user and session via their
+// remember_cookie using the UserService. If they are found, they will
+// be set on the request context.
+// Regardless, the next handler is always called, unless the request
+// carries an API token in its Authorization header that isn't valid.
+//
+// It must run before csrf.Protect, as requests authenticated with an
+// API token skip the CSRF check.
 type User struct {
 	models.UserService
 }
@@ -39,26 +99,44 @@ type User struct {
 func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter,
 		r *http.Request) {
-		path := r.URL.Path
-		if strings.HasPrefix(path, "/assets/") ||
-			strings.HasPrefix(path, "/images/") {
+		// Images aren't skipped, Galleries.Image needs the user to
+		// serve those of private galleries to their owner. It only
+		// counts API tokens granted galleries:read as the owner.
+		if strings.HasPrefix(r.URL.Path, "/assets/") {
 			next(w, r)
 			return
 		}
 
+		if token, ok := bearerToken(r); ok {
+			mw.applyAPIToken(w, r, next, token)
+			return
+		}
+
 		cookie, err := r.Cookie("remember_cookie")
 		if err != nil {
 			next(w, r)
 			return
 		}
 
-		user, err := mw.UserService.ByRemember(cookie.Value)
+		user, session, err := mw.UserService.BySession(cookie.Value)
 		if err != nil {
 			next(w, r)
 			return
 		}
 
 		ctx := r.Context()
+		ctx = context.WithSession(ctx, session)
+
+		// While an admin impersonates someone, the rest of the
+		// app only sees the impersonated user.
+		if session.ImpersonatingID != 0 && user.IsAdmin {
+			target, err := mw.UserService.ByID(session.ImpersonatingID)
+			if err == nil {
+				ctx = context.WithImpersonator(ctx, user)
+				user = target
+			}
+		}
+
 		ctx = context.WithUser(ctx, user)
 		r = r.WithContext(ctx)
 		next(w, r)
@@ -68,3 +146,39 @@ func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 func (mw *User) Apply(next http.Handler) http.HandlerFunc {
 	return mw.ApplyFn(next.ServeHTTP)
 }
+
+// applyAPIToken sets the user of the API token on the request
+// context. Browsers never send our API tokens on their own, unlike
+// cookies, so these requests can't be forged by another site and
+// don't need the CSRF check.
+func (mw *User) applyAPIToken(w http.ResponseWriter, r *http.Request,
+	next http.HandlerFunc, token string) {
+
+	user, apiToken, err := mw.UserService.ByAPIToken(token)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate",
+			`Bearer error="invalid_token"`)
+		http.Error(w, "Invalid API token", http.StatusUnauthorized)
+		return
+	}
+
+	ctx := r.Context()
+	ctx = context.WithAPIToken(ctx, apiToken)
+	ctx = context.WithUser(ctx, user)
+	r = csrf.UnsafeSkipCheck(r.WithContext(ctx))
+	next(w, r)
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+
+	const prefix = "Bearer "
+
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(prefix) ||
+		!strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+
+	return strings.TrimSpace(header[len(prefix):]), true
+}
@@ -0,0 +1,176 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// Actions recorded in the admin log.
+const (
+	AdminActionDisable           = "disable"
+	AdminActionEnable            = "enable"
+	AdminActionImpersonate       = "impersonate"
+	AdminActionStopImpersonating = "stop_impersonating"
+	AdminActionSetQuota          = "set_quota"
+)
+
+const (
+	ErrAdminIDRequired modelError = "models: admin ID is required"
+	ErrActionRequired  modelError = "models: action is required"
+)
+
+/////////////////////////////////////////////////////////////////////
+//
+// Model AdminAction structures and methods
+//
+/////////////////////////////////////////////////////////////////////
+
+// AdminAction records something an administrator did to another
+// user's account. The email addresses are copied over so the log
+// stays readable once an account is purged.
+type AdminAction struct {
+	gorm.Model
+	AdminID      uint   `gorm:"not null;index"`
+	AdminEmail   string `gorm:"not null"`
+	TargetUserID uint   `gorm:"index"`
+	TargetEmail  string
+	Action       string `gorm:"not null"`
+	Details      string
+	IP           string
+}
+
+// AdminActionDB is used to interact with the admin log. The log is
+// append only, entries are never updated nor deleted.
+type AdminActionDB interface {
+	Create(action *AdminAction) error
+
+	// Recent returns the most recent actions first.
+	Recent(offset, limit int) ([]AdminAction, error)
+	ByTargetUserID(userID uint, limit int) ([]AdminAction, error)
+}
+
+// AdminService is used by the admin console to keep track of what
+// administrators do.
+type AdminService interface {
+	AdminActionDB
+
+	// Log records an action of the admin on the target user.
+	Log(admin, target *User, action, details string,
+		client ClientInfo) error
+}
+
+func NewAdminService(db *gorm.DB) AdminService {
+	return &adminService{
+		AdminActionDB: &adminActionValidator{
+			AdminActionDB: &adminActionGorm{db},
+		},
+	}
+}
+
+type adminService struct {
+	AdminActionDB
+}
+
+func (as *adminService) Log(admin, target *User, action, details string,
+	client ClientInfo) error {
+
+	a := AdminAction{
+		AdminID:    admin.ID,
+		AdminEmail: admin.Email,
+		Action:     action,
+		Details:    details,
+		IP:         client.IP,
+	}
+	if target != nil {
+		a.TargetUserID = target.ID
+		a.TargetEmail = target.Email
+	}
+
+	return as.Create(&a)
+}
+
+//
+// Gorm
+//
+
+type adminActionGorm struct {
+	db *gorm.DB
+}
+
+func (ag *adminActionGorm) Create(action *AdminAction) error {
+	return ag.db.Create(action).Error
+}
+
+func (ag *adminActionGorm) Recent(offset, limit int) ([]AdminAction, error) {
+
+	var actions []AdminAction
+
+	db := ag.db.Order("created_at desc").Offset(offset).Limit(limit)
+	if err := all(db, &actions); err != nil {
+		return nil, err
+	}
+
+	return actions, nil
+}
+
+func (ag *adminActionGorm) ByTargetUserID(userID uint, limit int) ([]AdminAction, error) {
+
+	var actions []AdminAction
+
+	db := ag.db.Where("target_user_id = ?", userID).
+		Order("created_at desc").Limit(limit)
+	if err := all(db, &actions); err != nil {
+		return nil, err
+	}
+
+	return actions, nil
+}
+
+//
+// Validator
+//
+
+type adminActionValFn func(*AdminAction) error
+
+func runAdminActionValFns(a *AdminAction, fns ...adminActionValFn) error {
+
+	for _, fn := range fns {
+		if err := fn(a); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type adminActionValidator struct {
+	AdminActionDB
+}
+
+func (av *adminActionValidator) requireAdminID(a *AdminAction) error {
+
+	if a.AdminID <= 0 {
+		return ErrAdminIDRequired
+	}
+
+	return nil
+}
+
+func (av *adminActionValidator) requireAction(a *AdminAction) error {
+
+	if a.Action == "" {
+		return ErrActionRequired
+	}
+
+	return nil
+}
+
+func (av *adminActionValidator) Create(a *AdminAction) error {
+
+	err := runAdminActionValFns(a, av.requireAdminID,
+		av.requireAction)
+	if err != nil {
+		return err
+	}
+
+	return av.AdminActionDB.Create(a)
+}
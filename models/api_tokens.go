@@ -0,0 +1,360 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"lenslockedbr.com/hash"
+	"lenslockedbr.com/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Scopes an API token can be granted.
+const (
+	ScopeReadGalleries  = "galleries:read"
+	ScopeWriteGalleries = "galleries:write"
+	ScopeWriteImages    = "images:write"
+)
+
+const (
+	// apiTokenPrefix makes our tokens easy to recognize when they
+	// end up somewhere they shouldn't, like a public repository.
+	apiTokenPrefix = "llb_"
+
+	maxAPITokenNameLen = 50
+)
+
+var (
+	// ErrTokenNameRequired is returned when an API token is created
+	// without a name.
+	ErrTokenNameRequired modelError = "models: please give the token " +
+		"a name"
+
+	// ErrTokenNameTooLong is returned when the name of an API token
+	// is longer than maxAPITokenNameLen characters.
+	ErrTokenNameTooLong modelError = "models: token name must be at " +
+		"most 50 characters long"
+
+	// ErrScopeRequired is returned when an API token is created
+	// without any scope.
+	ErrScopeRequired modelError = "models: please pick at least one " +
+		"scope for the token"
+
+	// ErrScopeInvalid is returned when an API token is created with
+	// a scope that doesn't exist.
+	ErrScopeInvalid modelError = "models: scope provided is not valid"
+)
+
+// APIScope describes a scope to the users picking the ones a new
+// token is granted.
+type APIScope struct {
+	Name        string
+	Description string
+}
+
+// APIScopes lists every scope, in the order they are displayed.
+var APIScopes = []APIScope{
+	{ScopeReadGalleries, "List and view your galleries"},
+	{ScopeWriteGalleries, "Create, update and delete your galleries"},
+	{ScopeWriteImages, "Upload and delete images in your galleries"},
+}
+
+func validScope(name string) bool {
+
+	for _, scope := range APIScopes {
+		if scope.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+/////////////////////////////////////////////////////////////////////
+//
+// Model APIToken structures and methods
+//
+/////////////////////////////////////////////////////////////////////
+
+// APIToken lets scripts act on behalf of a user, with the Bearer
+// authorization header instead of a browser session. Scopes is a
+// space separated list of the scopes granted to the token.
+type APIToken struct {
+	gorm.Model
+	UserID     uint   `gorm:"not null;index"`
+	Name       string `gorm:"not null"`
+	Scopes     string `gorm:"not null"`
+	Token      string `gorm:"-"`
+	TokenHash  string `gorm:"not null;unique_index"`
+	LastUsedAt *time.Time
+}
+
+// ScopeList returns the scopes granted to the token.
+func (t *APIToken) ScopeList() []string {
+	return strings.Fields(t.Scopes)
+}
+
+// HasScope reports whether the token was granted the scope.
+func (t *APIToken) HasScope(scope string) bool {
+
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+type apiTokenGorm struct {
+	db *gorm.DB
+}
+
+type apiTokenDB interface {
+	ByToken(token string) (*APIToken, error)
+	ByUserID(userID uint) ([]APIToken, error)
+	Create(t *APIToken) error
+	Update(t *APIToken) error
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+func (tg *apiTokenGorm) ByToken(token string) (*APIToken, error) {
+
+	var t APIToken
+
+	err := first(tg.db.Where("token_hash = ?", token), &t)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func (tg *apiTokenGorm) ByUserID(userID uint) ([]APIToken, error) {
+
+	var tokens []APIToken
+
+	db := tg.db.Where("user_id = ?", userID).Order("created_at desc")
+	if err := all(db, &tokens); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+func (tg *apiTokenGorm) Create(t *APIToken) error {
+	return tg.db.Create(t).Error
+}
+
+func (tg *apiTokenGorm) Update(t *APIToken) error {
+	return tg.db.Save(t).Error
+}
+
+func (tg *apiTokenGorm) Delete(id uint) error {
+
+	t := APIToken{
+		Model: gorm.Model{ID: id},
+	}
+
+	return tg.db.Unscoped().Delete(&t).Error
+}
+
+func (tg *apiTokenGorm) DeleteByUserID(userID uint) error {
+	return tg.db.Unscoped().Where("user_id = ?", userID).
+		Delete(&APIToken{}).Error
+}
+
+/////////////////////////////////////////////////////////////////////
+//
+// Validator structures and methods
+//
+/////////////////////////////////////////////////////////////////////
+
+type apiTokenValFn func(*APIToken) error
+
+func runAPITokenValFns(t *APIToken, fns ...apiTokenValFn) error {
+
+	for _, fn := range fns {
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type apiTokenValidator struct {
+	apiTokenDB
+	hmac hash.HMAC
+}
+
+func newAPITokenValidator(db apiTokenDB, hmac hash.HMAC) *apiTokenValidator {
+	return &apiTokenValidator{
+		apiTokenDB: db,
+		hmac:       hmac,
+	}
+}
+
+func (tv *apiTokenValidator) requireUserID(t *APIToken) error {
+
+	if t.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (tv *apiTokenValidator) normalizeName(t *APIToken) error {
+
+	t.Name = strings.TrimSpace(t.Name)
+
+	return nil
+}
+
+func (tv *apiTokenValidator) requireName(t *APIToken) error {
+
+	if t.Name == "" {
+		return ErrTokenNameRequired
+	}
+
+	if len([]rune(t.Name)) > maxAPITokenNameLen {
+		return ErrTokenNameTooLong
+	}
+
+	return nil
+}
+
+// normalizeScopes checks the scopes and lists them once each, in the
+// order of APIScopes.
+func (tv *apiTokenValidator) normalizeScopes(t *APIToken) error {
+
+	granted := t.ScopeList()
+	if len(granted) == 0 {
+		return ErrScopeRequired
+	}
+
+	for _, s := range granted {
+		if !validScope(s) {
+			return ErrScopeInvalid
+		}
+	}
+
+	var scopes []string
+	for _, scope := range APIScopes {
+		if t.HasScope(scope.Name) {
+			scopes = append(scopes, scope.Name)
+		}
+	}
+	t.Scopes = strings.Join(scopes, " ")
+
+	return nil
+}
+
+func (tv *apiTokenValidator) setTokenIfUnset(t *APIToken) error {
+
+	if t.Token != "" {
+		return nil
+	}
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+
+	t.Token = apiTokenPrefix + token
+
+	return nil
+}
+
+func (tv *apiTokenValidator) hmacToken(t *APIToken) error {
+
+	if t.Token == "" {
+		return nil
+	}
+
+	t.TokenHash = tv.hmac.Hash(t.Token)
+
+	return nil
+}
+
+func (tv *apiTokenValidator) tokenHashRequired(t *APIToken) error {
+
+	if t.TokenHash == "" {
+		return ErrRememberRequired
+	}
+
+	return nil
+}
+
+func (tv *apiTokenValidator) ByToken(token string) (*APIToken, error) {
+
+	var t *APIToken
+
+	rehash, err := byHash(tv.hmac, token, func(tokenHash string) error {
+		var err error
+		t, err = tv.apiTokenDB.ByToken(tokenHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens never expire, so move this one over to the primary key
+	// now instead of breaking the scripts using it once the retired
+	// key is dropped.
+	if rehash {
+		t.TokenHash = tv.hmac.Hash(token)
+		if err := tv.apiTokenDB.Update(t); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+func (tv *apiTokenValidator) Create(t *APIToken) error {
+
+	err := runAPITokenValFns(t, tv.requireUserID,
+		tv.normalizeName,
+		tv.requireName,
+		tv.normalizeScopes,
+		tv.setTokenIfUnset,
+		tv.hmacToken,
+		tv.tokenHashRequired)
+	if err != nil {
+		return err
+	}
+
+	return tv.apiTokenDB.Create(t)
+}
+
+func (tv *apiTokenValidator) Update(t *APIToken) error {
+
+	err := runAPITokenValFns(t, tv.requireUserID,
+		tv.tokenHashRequired)
+	if err != nil {
+		return err
+	}
+
+	return tv.apiTokenDB.Update(t)
+}
+
+func (tv *apiTokenValidator) Delete(id uint) error {
+
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	return tv.apiTokenDB.Delete(id)
+}
+
+func (tv *apiTokenValidator) DeleteByUserID(userID uint) error {
+
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return tv.apiTokenDB.DeleteByUserID(userID)
+}
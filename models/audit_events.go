@@ -0,0 +1,219 @@
+package models
+
+import (
+	"log"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Actions recorded in the audit log of a user.
+const (
+	AuditLogin                  = "login"
+	AuditLoginFailed            = "login_failed"
+	AuditPasswordResetRequested = "password_reset_requested"
+	AuditPasswordReset          = "password_reset"
+	AuditPasswordChanged        = "password_changed"
+	AuditOAuthConnected         = "oauth_connected"
+	AuditGalleryDeleted         = "gallery_deleted"
+	AuditExportRequested        = "export_requested"
+	AuditArchiveImported        = "archive_imported"
+)
+
+/////////////////////////////////////////////////////////////////////
+//
+// Model AuditEvent structures and methods
+//
+/////////////////////////////////////////////////////////////////////
+
+// AuditEvent records something that happened to a user's account, so
+// they can review it and spot what they didn't do themselves.
+//
+// ActorID is the user who did it, which is usually the owner of the
+// account but can also be an admin impersonating them, or no one at
+// all for a failed login. Target describes what the action was taken
+// on, like the title of a deleted gallery.
+type AuditEvent struct {
+	gorm.Model
+	UserID    uint `gorm:"not null;index"`
+	ActorID   uint
+	Action    string `gorm:"not null"`
+	Target    string
+	IP        string
+	UserAgent string
+}
+
+// Description is a sentence describing the event to the user.
+func (e *AuditEvent) Description() string {
+
+	switch e.Action {
+	case AuditLogin:
+		return "Logged in"
+	case AuditLoginFailed:
+		return "Failed login attempt"
+	case AuditPasswordResetRequested:
+		return "Password reset requested"
+	case AuditPasswordReset:
+		return "Password reset"
+	case AuditPasswordChanged:
+		return "Password changed"
+	case AuditOAuthConnected:
+		return "Connected " + strings.Title(e.Target)
+	case AuditGalleryDeleted:
+		return "Deleted the gallery " + e.Target
+	case AuditExportRequested:
+		return "Data export requested"
+	case AuditArchiveImported:
+		return "Imported " + e.Target + " from an export"
+	default:
+		return e.Action
+	}
+}
+
+// ByAdmin reports whether someone other than the user did it, which
+// can only be an admin acting as them.
+func (e *AuditEvent) ByAdmin() bool {
+	return e.ActorID != 0 && e.ActorID != e.UserID
+}
+
+// AuditEventDB is used to interact with the audit log. Events are
+// never updated, and only deleted along with their user.
+type AuditEventDB interface {
+	Create(event *AuditEvent) error
+
+	// ByUserID returns the most recent events of the user first.
+	ByUserID(userID uint, limit int) ([]AuditEvent, error)
+	DeleteByUserID(userID uint) error
+}
+
+// AuditService keeps track of the security related activity of each
+// user.
+type AuditService interface {
+	AuditEventDB
+
+	// Log records an action taken on the account of the user by
+	// actor, which can be nil when it's unknown. Failing to record
+	// it is logged rather than returned, as the action already
+	// happened.
+	Log(user, actor *User, action, target string, client ClientInfo)
+}
+
+func NewAuditService(db *gorm.DB) AuditService {
+	return &auditService{
+		AuditEventDB: &auditEventValidator{
+			AuditEventDB: &auditEventGorm{db},
+		},
+	}
+}
+
+type auditService struct {
+	AuditEventDB
+}
+
+func (as *auditService) Log(user, actor *User, action, target string,
+	client ClientInfo) {
+
+	e := AuditEvent{
+		UserID:    user.ID,
+		Action:    action,
+		Target:    target,
+		IP:        client.IP,
+		UserAgent: client.UserAgent,
+	}
+	if actor != nil {
+		e.ActorID = actor.ID
+	}
+
+	if err := as.Create(&e); err != nil {
+		log.Println("models: recording audit event:", err)
+	}
+}
+
+//
+// Gorm
+//
+
+type auditEventGorm struct {
+	db *gorm.DB
+}
+
+func (ag *auditEventGorm) Create(event *AuditEvent) error {
+	return ag.db.Create(event).Error
+}
+
+func (ag *auditEventGorm) ByUserID(userID uint, limit int) ([]AuditEvent, error) {
+
+	var events []AuditEvent
+
+	db := ag.db.Where("user_id = ?", userID).
+		Order("created_at desc").Limit(limit)
+	if err := all(db, &events); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+func (ag *auditEventGorm) DeleteByUserID(userID uint) error {
+	return ag.db.Unscoped().Where("user_id = ?", userID).
+		Delete(&AuditEvent{}).Error
+}
+
+//
+// Validator
+//
+
+type auditEventValFn func(*AuditEvent) error
+
+func runAuditEventValFns(e *AuditEvent, fns ...auditEventValFn) error {
+
+	for _, fn := range fns {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type auditEventValidator struct {
+	AuditEventDB
+}
+
+func (av *auditEventValidator) requireUserID(e *AuditEvent) error {
+
+	if e.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (av *auditEventValidator) requireAction(e *AuditEvent) error {
+
+	if e.Action == "" {
+		return ErrActionRequired
+	}
+
+	return nil
+}
+
+func (av *auditEventValidator) Create(e *AuditEvent) error {
+
+	err := runAuditEventValFns(e, av.requireUserID,
+		av.requireAction)
+	if err != nil {
+		return err
+	}
+
+	return av.AuditEventDB.Create(e)
+}
+
+func (av *auditEventValidator) DeleteByUserID(userID uint) error {
+
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return av.AuditEventDB.DeleteByUserID(userID)
+}
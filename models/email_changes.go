@@ -0,0 +1,180 @@
+package models
+
+import (
+	"lenslockedbr.com/hash"
+	"lenslockedbr.com/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+/////////////////////////////////////////////////////////////////////
+//
+// Model emailChange structures and methods
+//
+/////////////////////////////////////////////////////////////////////
+
+// emailChange is a pending change of a user's email address. The
+// address is only swapped once NewEmail is confirmed.
+type emailChange struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null"`
+	NewEmail  string `gorm:"not null"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+}
+
+type emailChangeGorm struct {
+	db *gorm.DB
+}
+
+type emailChangeDB interface {
+	ByToken(token string) (*emailChange, error)
+	Create(ec *emailChange) error
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+func (ecg *emailChangeGorm) ByToken(token string) (*emailChange, error) {
+
+	var ec emailChange
+
+	err := first(ecg.db.Where("token_hash = ?", token), &ec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ec, nil
+}
+
+func (ecg *emailChangeGorm) Create(ec *emailChange) error {
+	return ecg.db.Create(ec).Error
+}
+
+func (ecg *emailChangeGorm) Delete(id uint) error {
+
+	ec := emailChange{
+		Model: gorm.Model{ID: id},
+	}
+
+	return ecg.db.Delete(&ec).Error
+}
+
+func (ecg *emailChangeGorm) DeleteByUserID(userID uint) error {
+	return ecg.db.Unscoped().Where("user_id = ?", userID).
+		Delete(&emailChange{}).Error
+}
+
+/////////////////////////////////////////////////////////////////////
+//
+// Validator structures and methods
+//
+/////////////////////////////////////////////////////////////////////
+
+type emailChangeValFn func(*emailChange) error
+
+func runEmailChangeValFns(ec *emailChange, fns ...emailChangeValFn) error {
+
+	for _, fn := range fns {
+		if err := fn(ec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type emailChangeValidator struct {
+	emailChangeDB
+	hmac hash.HMAC
+}
+
+func newEmailChangeValidator(db emailChangeDB, hmac hash.HMAC) *emailChangeValidator {
+	return &emailChangeValidator{
+		emailChangeDB: db,
+		hmac:          hmac,
+	}
+}
+
+func (ecv *emailChangeValidator) requireUserID(ec *emailChange) error {
+
+	if ec.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (ecv *emailChangeValidator) setTokenIfUnset(ec *emailChange) error {
+
+	if ec.Token != "" {
+		return nil
+	}
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+
+	ec.Token = token
+
+	return nil
+}
+
+func (ecv *emailChangeValidator) hmacToken(ec *emailChange) error {
+
+	if ec.Token == "" {
+		return nil
+	}
+
+	ec.TokenHash = ecv.hmac.Hash(ec.Token)
+
+	return nil
+}
+
+func (ecv *emailChangeValidator) ByToken(token string) (*emailChange, error) {
+
+	var ec *emailChange
+
+	// Email changes are deleted once confirmed, so there is no point in
+	// rehashing one found under a retired key.
+	_, err := byHash(ecv.hmac, token, func(tokenHash string) error {
+		var err error
+		ec, err = ecv.emailChangeDB.ByToken(tokenHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ec, nil
+}
+
+func (ecv *emailChangeValidator) Create(ec *emailChange) error {
+
+	err := runEmailChangeValFns(ec, ecv.requireUserID,
+		ecv.setTokenIfUnset,
+		ecv.hmacToken)
+	if err != nil {
+		return err
+	}
+
+	return ecv.emailChangeDB.Create(ec)
+}
+
+func (ecv *emailChangeValidator) Delete(id uint) error {
+
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	return ecv.emailChangeDB.Delete(id)
+}
+
+func (ecv *emailChangeValidator) DeleteByUserID(userID uint) error {
+
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return ecv.emailChangeDB.DeleteByUserID(userID)
+}
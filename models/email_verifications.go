@@ -0,0 +1,177 @@
+package models
+
+import (
+	"lenslockedbr.com/hash"
+	"lenslockedbr.com/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+/////////////////////////////////////////////////////////////////////
+//
+// Model emailVerification structures and methods
+//
+/////////////////////////////////////////////////////////////////////
+
+type emailVerification struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+}
+
+type emailVerificationGorm struct {
+	db *gorm.DB
+}
+
+type emailVerificationDB interface {
+	ByToken(token string) (*emailVerification, error)
+	Create(ev *emailVerification) error
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+func (evg *emailVerificationGorm) ByToken(token string) (*emailVerification, error) {
+
+	var ev emailVerification
+
+	err := first(evg.db.Where("token_hash = ?", token), &ev)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ev, nil
+}
+
+func (evg *emailVerificationGorm) Create(ev *emailVerification) error {
+	return evg.db.Create(ev).Error
+}
+
+func (evg *emailVerificationGorm) Delete(id uint) error {
+
+	ev := emailVerification{
+		Model: gorm.Model{ID: id},
+	}
+
+	return evg.db.Delete(&ev).Error
+}
+
+func (evg *emailVerificationGorm) DeleteByUserID(userID uint) error {
+	return evg.db.Unscoped().Where("user_id = ?", userID).
+		Delete(&emailVerification{}).Error
+}
+
+/////////////////////////////////////////////////////////////////////
+//
+// Validator structures and methods
+//
+/////////////////////////////////////////////////////////////////////
+
+type emailVerificationValFn func(*emailVerification) error
+
+func runEmailVerificationValFns(ev *emailVerification, fns ...emailVerificationValFn) error {
+
+	for _, fn := range fns {
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type emailVerificationValidator struct {
+	emailVerificationDB
+	hmac hash.HMAC
+}
+
+func newEmailVerificationValidator(db emailVerificationDB, hmac hash.HMAC) *emailVerificationValidator {
+	return &emailVerificationValidator{
+		emailVerificationDB: db,
+		hmac:                hmac,
+	}
+}
+
+func (evv *emailVerificationValidator) requireUserID(ev *emailVerification) error {
+
+	if ev.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (evv *emailVerificationValidator) setTokenIfUnset(ev *emailVerification) error {
+
+	if ev.Token != "" {
+		return nil
+	}
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+
+	ev.Token = token
+
+	return nil
+}
+
+func (evv *emailVerificationValidator) hmacToken(ev *emailVerification) error {
+
+	if ev.Token == "" {
+		return nil
+	}
+
+	ev.TokenHash = evv.hmac.Hash(ev.Token)
+
+	return nil
+}
+
+func (evv *emailVerificationValidator) ByToken(token string) (*emailVerification, error) {
+
+	var ev *emailVerification
+
+	// Verifications are deleted once used, so there is no point in
+	// rehashing one found under a retired key.
+	_, err := byHash(evv.hmac, token, func(tokenHash string) error {
+		var err error
+		ev, err = evv.emailVerificationDB.ByToken(tokenHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ev, nil
+}
+
+func (evv *emailVerificationValidator) Create(ev *emailVerification) error {
+
+	err := runEmailVerificationValFns(ev, evv.requireUserID,
+		evv.setTokenIfUnset,
+		evv.hmacToken)
+	if err != nil {
+		return err
+	}
+
+	return evv.emailVerificationDB.Create(ev)
+}
+
+func (evv *emailVerificationValidator) Delete(id uint) error {
+
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	return evv.emailVerificationDB.Delete(id)
+}
+
+func (evv *emailVerificationValidator) DeleteByUserID(userID uint) error {
+
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return evv.emailVerificationDB.DeleteByUserID(userID)
+}
@@ -0,0 +1,712 @@
+package models
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"lenslockedbr.com/hash"
+	"lenslockedbr.com/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Status of an export.
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+const (
+	// ExportTTL is how long an archive can be downloaded once it is
+	// ready, before it is deleted.
+	ExportTTL = 3 * 24 * time.Hour
+
+	// exportTimeout is how long an export can stay pending before
+	// another one can be requested. It only happens when the server
+	// restarted while building it.
+	exportTimeout = time.Hour
+
+	exportDir = "exports"
+)
+
+var (
+	// ErrExportInProgress is returned when a user asks for an export
+	// while the previous one is still being built.
+	ErrExportInProgress modelError = "models: your previous export " +
+		"is still being prepared. You will get an email as soon as " +
+		"it is ready"
+
+	// ErrExportExpired is returned when downloading an export that
+	// is no longer available.
+	ErrExportExpired modelError = "models: this export has expired. " +
+		"Please request a new one"
+)
+
+/////////////////////////////////////////////////////////////////////
+//
+// Model Export structures and methods
+//
+/////////////////////////////////////////////////////////////////////
+
+// Export is an archive of the personal data of a user, which they
+// download with the link emailed to them once it is built. The token
+// of the link is only known while the export is being requested and
+// built.
+type Export struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	Status    string `gorm:"not null"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+	Size      int64
+	ExpiresAt *time.Time
+}
+
+// Path returns where the archive is stored on disk.
+func (e *Export) Path() string {
+	return filepath.Join(exportDir, fmt.Sprintf("%d.zip", e.ID))
+}
+
+// Filename is the name the archive is downloaded as.
+func (e *Export) Filename() string {
+	return fmt.Sprintf("lenslockedbr-export-%s.zip",
+		e.CreatedAt.Format("2006-01-02"))
+}
+
+// Available reports whether the archive can be downloaded.
+func (e *Export) Available() bool {
+	return e.Status == ExportReady && e.ExpiresAt != nil &&
+		time.Now().Before(*e.ExpiresAt)
+}
+
+// InProgress reports whether the archive is still being built.
+func (e *Export) InProgress() bool {
+	return e.Status == ExportPending &&
+		time.Since(e.CreatedAt) < exportTimeout
+}
+
+type exportDB interface {
+	ByToken(token string) (*Export, error)
+
+	// Latest returns the most recent export of the user.
+	Latest(userID uint) (*Export, error)
+
+	// ExpiredBefore returns the exports that expired before t.
+	ExpiredBefore(t time.Time) ([]Export, error)
+
+	Create(e *Export) error
+	Update(e *Export) error
+	Delete(id uint) error
+	ByUserID(userID uint) ([]Export, error)
+}
+
+// ExportService builds the archives users download to get a copy of
+// everything we store about them.
+type ExportService interface {
+	// Request starts a new export for the user. Build must then be
+	// called with it to create the archive.
+	Request(user *User) (*Export, error)
+
+	// Build writes the archive of the export, with a manifest.json
+	// describing the user's profile, galleries, connected accounts
+	// and activity, along with the files of their images. The
+	// export is marked as failed if anything goes wrong.
+	Build(user *User, e *Export) error
+
+	// Latest returns the most recent export of the user, or
+	// ErrNotFound if they never asked for one.
+	Latest(user *User) (*Export, error)
+
+	// Download returns the export of the user with the token, or
+	// ErrExportExpired once it can no longer be downloaded.
+	Download(user *User, token string) (*Export, error)
+
+	// DeleteExpired removes the exports past their expiration
+	// date, along with their archives.
+	DeleteExpired() error
+
+	// DeleteByUserID removes every export of the user.
+	DeleteByUserID(userID uint) error
+}
+
+// NewExportService needs the other services to gather the data of
+// the users.
+func NewExportService(db *gorm.DB, hmac hash.HMAC, gs GalleryService,
+	is ImageService, oas OAuthService, as AuditService) ExportService {
+	return &exportService{
+		exportDB: newExportValidator(&exportGorm{db}, hmac),
+		gs:       gs,
+		is:       is,
+		oauth:    oas,
+		as:       as,
+	}
+}
+
+type exportService struct {
+	exportDB exportDB
+	gs       GalleryService
+	is       ImageService
+	oauth    OAuthService
+	as       AuditService
+}
+
+func (es *exportService) Request(user *User) (*Export, error) {
+
+	latest, err := es.exportDB.Latest(user.ID)
+	switch err {
+	case nil:
+		if latest.InProgress() {
+			return nil, ErrExportInProgress
+		}
+	case ErrNotFound:
+	default:
+		return nil, err
+	}
+
+	e := Export{
+		UserID: user.ID,
+		Status: ExportPending,
+	}
+	if err := es.exportDB.Create(&e); err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+func (es *exportService) Build(user *User, e *Export) error {
+
+	size, err := es.writeArchive(user, e)
+	if err != nil {
+		os.Remove(e.Path())
+		e.Status = ExportFailed
+		if uerr := es.exportDB.Update(e); uerr != nil {
+			return uerr
+		}
+		return err
+	}
+
+	expiresAt := time.Now().Add(ExportTTL)
+	e.Status = ExportReady
+	e.Size = size
+	e.ExpiresAt = &expiresAt
+
+	return es.exportDB.Update(e)
+}
+
+func (es *exportService) Latest(user *User) (*Export, error) {
+	return es.exportDB.Latest(user.ID)
+}
+
+func (es *exportService) Download(user *User, token string) (*Export, error) {
+
+	e, err := es.exportDB.ByToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.UserID != user.ID {
+		return nil, ErrNotFound
+	}
+
+	if !e.Available() {
+		return nil, ErrExportExpired
+	}
+
+	return e, nil
+}
+
+func (es *exportService) DeleteExpired() error {
+
+	exports, err := es.exportDB.ExpiredBefore(time.Now())
+	if err != nil {
+		return err
+	}
+
+	return es.delete(exports)
+}
+
+func (es *exportService) DeleteByUserID(userID uint) error {
+
+	exports, err := es.exportDB.ByUserID(userID)
+	if err != nil {
+		return err
+	}
+
+	return es.delete(exports)
+}
+
+func (es *exportService) delete(exports []Export) error {
+
+	for _, e := range exports {
+		err := os.Remove(e.Path())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if err := es.exportDB.Delete(e.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//
+// Archive
+//
+
+// exportManifest is the manifest.json file of an archive. Its JSON
+// names are part of what we hand out to users, don't change them.
+type exportManifest struct {
+	ExportedAt  time.Time          `json:"exported_at"`
+	Profile     exportProfile      `json:"profile"`
+	Galleries   []exportGallery    `json:"galleries"`
+	Connections []exportConnection `json:"connections"`
+	Activity    []exportEvent      `json:"activity"`
+}
+
+type exportProfile struct {
+	ID               uint       `json:"id"`
+	Email            string     `json:"email"`
+	EmailVerifiedAt  *time.Time `json:"email_verified_at"`
+	Name             string     `json:"name"`
+	Age              int        `json:"age"`
+	Handle           string     `json:"handle"`
+	DisplayName      string     `json:"display_name"`
+	Bio              string     `json:"bio"`
+	Website          string     `json:"website"`
+	TwoFactorEnabled bool       `json:"two_factor_enabled"`
+	StorageUsed      int64      `json:"storage_used"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+type exportGallery struct {
+	ID          uint          `json:"id"`
+	Title       string        `json:"title"`
+	Description string        `json:"description"`
+	EventDate   *time.Time    `json:"event_date"`
+	CoverImage  string        `json:"cover_image"`
+	Visibility  string        `json:"visibility"`
+	CreatedAt   time.Time     `json:"created_at"`
+	Images      []exportImage `json:"images"`
+}
+
+// exportImage describes an image, whose file is stored at Path in
+// the archive. SHA256 is the hex encoded hash of the file.
+type exportImage struct {
+	Filename string `json:"filename"`
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+}
+
+// exportConnection describes a connected account, without its
+// tokens.
+type exportConnection struct {
+	Service     string    `json:"service"`
+	Subject     string    `json:"subject"`
+	Email       string    `json:"email"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+type exportEvent struct {
+	Action      string    `json:"action"`
+	Description string    `json:"description"`
+	Target      string    `json:"target"`
+	ByAdmin     bool      `json:"by_admin"`
+	IP          string    `json:"ip"`
+	UserAgent   string    `json:"user_agent"`
+	At          time.Time `json:"at"`
+}
+
+// writeArchive writes the archive of the export and returns its
+// size. It is written aside first, so an archive is never served
+// half written.
+func (es *exportService) writeArchive(user *User, e *Export) (int64, error) {
+
+	if err := os.MkdirAll(exportDir, 0700); err != nil {
+		return 0, err
+	}
+
+	f, err := ioutil.TempFile(exportDir, "export-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	if err := es.writeZip(f, user); err != nil {
+		f.Close()
+		return 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(f.Name(), e.Path()); err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+func (es *exportService) writeZip(w io.Writer, user *User) error {
+
+	manifest := exportManifest{
+		ExportedAt: time.Now(),
+		Profile: exportProfile{
+			ID:               user.ID,
+			Email:            user.Email,
+			EmailVerifiedAt:  user.EmailVerifiedAt,
+			Name:             user.Name,
+			Age:              user.Age,
+			Handle:           user.Handle,
+			DisplayName:      user.DisplayName,
+			Bio:              user.Bio,
+			Website:          user.Website,
+			TwoFactorEnabled: user.TwoFactorEnabled(),
+			StorageUsed:      user.StorageUsed,
+			CreatedAt:        user.CreatedAt,
+		},
+		Galleries:   []exportGallery{},
+		Connections: []exportConnection{},
+		Activity:    []exportEvent{},
+	}
+
+	zw := zip.NewWriter(w)
+
+	galleries, err := es.gs.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, gallery := range galleries {
+		g, err := es.writeGallery(zw, &gallery)
+		if err != nil {
+			return err
+		}
+		manifest.Galleries = append(manifest.Galleries, *g)
+	}
+
+	oauths, err := es.oauth.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, oauth := range oauths {
+		manifest.Connections = append(manifest.Connections,
+			exportConnection{
+				Service:     oauth.Service,
+				Subject:     oauth.Subject,
+				Email:       oauth.Email,
+				ConnectedAt: oauth.CreatedAt,
+			})
+	}
+
+	// A negative limit lists every event.
+	events, err := es.as.ByUserID(user.ID, -1)
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		manifest.Activity = append(manifest.Activity, exportEvent{
+			Action:      event.Action,
+			Description: event.Description(),
+			Target:      event.Target,
+			ByAdmin:     event.ByAdmin(),
+			IP:          event.IP,
+			UserAgent:   event.UserAgent,
+			At:          event.CreatedAt,
+		})
+	}
+
+	mw, err := zw.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(mw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(&manifest); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// writeGallery adds the images of the gallery to the archive, under
+// galleries/{id}/.
+func (es *exportService) writeGallery(zw *zip.Writer, gallery *Gallery) (*exportGallery, error) {
+
+	g := exportGallery{
+		ID:          gallery.ID,
+		Title:       gallery.Title,
+		Description: gallery.Description,
+		EventDate:   gallery.EventDate,
+		CoverImage:  gallery.CoverImage,
+		Visibility:  gallery.Visibility,
+		CreatedAt:   gallery.CreatedAt,
+		Images:      []exportImage{},
+	}
+
+	images, err := es.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, image := range images {
+		path := exportImagePath(gallery.ID, image.Filename)
+
+		size, err := copyToZip(zw, path, image.RelativePath())
+		if err != nil {
+			return nil, err
+		}
+
+		g.Images = append(g.Images, exportImage{
+			Filename: image.Filename,
+			Path:     path,
+			Size:     size,
+			SHA256:   image.Hash,
+		})
+	}
+
+	return &g, nil
+}
+
+// exportImagePath is where an image is stored in an archive.
+func exportImagePath(galleryID uint, filename string) string {
+	return fmt.Sprintf("galleries/%d/%s", galleryID, filename)
+}
+
+func copyToZip(zw *zip.Writer, name, path string) (int64, error) {
+
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	// Images are already compressed, so they are only stored.
+	dst, err := zw.CreateHeader(&zip.FileHeader{
+		Name:   name,
+		Method: zip.Store,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return io.Copy(dst, src)
+}
+
+//
+// Gorm
+//
+
+type exportGorm struct {
+	db *gorm.DB
+}
+
+func (eg *exportGorm) ByToken(token string) (*Export, error) {
+
+	var e Export
+
+	err := first(eg.db.Where("token_hash = ?", token), &e)
+	if err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+func (eg *exportGorm) Latest(userID uint) (*Export, error) {
+
+	var e Export
+
+	db := eg.db.Where("user_id = ?", userID).Order("created_at desc")
+	if err := first(db, &e); err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+func (eg *exportGorm) ExpiredBefore(t time.Time) ([]Export, error) {
+
+	var exports []Export
+
+	// Exports that never got ready have no expiration date.
+	db := eg.db.Where("expires_at < ? OR "+
+		"(expires_at IS NULL AND created_at < ?)",
+		t, t.Add(-ExportTTL))
+	if err := all(db, &exports); err != nil {
+		return nil, err
+	}
+
+	return exports, nil
+}
+
+func (eg *exportGorm) ByUserID(userID uint) ([]Export, error) {
+
+	var exports []Export
+
+	if err := all(eg.db.Where("user_id = ?", userID), &exports); err != nil {
+		return nil, err
+	}
+
+	return exports, nil
+}
+
+func (eg *exportGorm) Create(e *Export) error {
+	return eg.db.Create(e).Error
+}
+
+func (eg *exportGorm) Update(e *Export) error {
+	return eg.db.Save(e).Error
+}
+
+func (eg *exportGorm) Delete(id uint) error {
+
+	e := Export{
+		Model: gorm.Model{ID: id},
+	}
+
+	return eg.db.Unscoped().Delete(&e).Error
+}
+
+//
+// Validator
+//
+
+type exportValFn func(*Export) error
+
+func runExportValFns(e *Export, fns ...exportValFn) error {
+
+	for _, fn := range fns {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type exportValidator struct {
+	exportDB
+	hmac hash.HMAC
+}
+
+func newExportValidator(db exportDB, hmac hash.HMAC) *exportValidator {
+	return &exportValidator{
+		exportDB: db,
+		hmac:     hmac,
+	}
+}
+
+func (ev *exportValidator) requireUserID(e *Export) error {
+
+	if e.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (ev *exportValidator) setTokenIfUnset(e *Export) error {
+
+	if e.Token != "" {
+		return nil
+	}
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+
+	e.Token = token
+
+	return nil
+}
+
+func (ev *exportValidator) hmacToken(e *Export) error {
+
+	if e.Token == "" {
+		return nil
+	}
+
+	e.TokenHash = ev.hmac.Hash(e.Token)
+
+	return nil
+}
+
+func (ev *exportValidator) tokenHashRequired(e *Export) error {
+
+	if e.TokenHash == "" {
+		return ErrRememberRequired
+	}
+
+	return nil
+}
+
+func (ev *exportValidator) ByToken(token string) (*Export, error) {
+
+	var e *Export
+
+	_, err := byHash(ev.hmac, token, func(tokenHash string) error {
+		var err error
+		e, err = ev.exportDB.ByToken(tokenHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (ev *exportValidator) Create(e *Export) error {
+
+	err := runExportValFns(e, ev.requireUserID,
+		ev.setTokenIfUnset,
+		ev.hmacToken,
+		ev.tokenHashRequired)
+	if err != nil {
+		return err
+	}
+
+	return ev.exportDB.Create(e)
+}
+
+func (ev *exportValidator) Update(e *Export) error {
+
+	err := runExportValFns(e, ev.requireUserID,
+		ev.tokenHashRequired)
+	if err != nil {
+		return err
+	}
+
+	return ev.exportDB.Update(e)
+}
+
+func (ev *exportValidator) Delete(id uint) error {
+
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	return ev.exportDB.Delete(id)
+}
@@ -1,14 +1,83 @@
 package models
 
 import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"lenslockedbr.com/hash"
+	"lenslockedbr.com/rand"
+
 	"github.com/jinzhu/gorm"
 )
 
 const (
 	ErrUserIDRequired modelError = "models: user ID is required"
 	ErrTitleRequired  modelError = "models: title is required"
+
+	// ErrVisibilityInvalid is returned when a gallery is given a
+	// visibility that doesn't exist.
+	ErrVisibilityInvalid modelError = "models: please pick who can " +
+		"see the gallery"
+
+	// ErrGalleryPasswordTooShort is returned when a gallery is given
+	// a password shorter than minGalleryPasswordLen characters.
+	ErrGalleryPasswordTooShort modelError = "models: gallery " +
+		"passwords must be at least 6 characters long"
+
+	// ErrDescriptionTooLong is returned when the description of a
+	// gallery is longer than maxDescriptionLen characters.
+	ErrDescriptionTooLong modelError = "models: descriptions must be " +
+		"at most 10000 characters long"
+
+	// ErrEventDateInvalid is returned when a gallery is given an
+	// event date that can't be right, like one before photography
+	// was invented.
+	ErrEventDateInvalid modelError = "models: please enter a valid " +
+		"event date"
+
+	// ErrCoverImageInvalid is returned when the cover image of a
+	// gallery isn't a valid image filename.
+	ErrCoverImageInvalid modelError = "models: please pick one of " +
+		"the images of the gallery as its cover"
+)
+
+const (
+	minGalleryPasswordLen = 6
+	maxDescriptionLen     = 10000
+
+	// Event dates can't be before the first photograph, nor too far
+	// in the future.
+	minEventYear       = 1826
+	maxEventYearsAhead = 10
+
+	// UnlockTTL is how long a visitor who entered the password of a
+	// gallery can see it without entering it again.
+	UnlockTTL = 30 * 24 * time.Hour
+)
+
+// Visibility of a gallery, which decides who can see it and its
+// images.
+const (
+	// VisibilityPrivate galleries can only be seen by their owner.
+	VisibilityPrivate = "private"
+
+	// VisibilityUnlisted galleries can be seen by anyone with their
+	// link, which contains an unguessable slug.
+	VisibilityUnlisted = "unlisted"
+
+	// VisibilityPublic galleries can be seen by anyone and are
+	// listed on the profile of their owner.
+	VisibilityPublic = "public"
 )
 
+// slugBytes is the number of random bytes in the slug of unlisted
+// galleries.
+const slugBytes = 12
+
 var _ GalleryDB = &galleryGorm{}
 
 type Gallery struct {
@@ -17,8 +86,94 @@ type Gallery struct {
 	UserID uint    `gorm:not_null;index`
 	Title  string  `gorm:not_null`
 	Images []Image `gorm:"-"`
+	Owner  *User   `gorm:"-"`
+
+	// Visibility is one of the Visibility constants. Slug is only
+	// set for unlisted galleries, and unique among them thanks to an
+	// index created in Services.AutoMigrate.
+	Visibility string `gorm:"not null;default:'private'"`
+	Slug       string
+
+	// Description is Markdown, which is sanitised when rendered.
+	// CoverImage is the filename of the image shown for the
+	// gallery, see Cover.
+	Description string `gorm:"type:text"`
+	EventDate   *time.Time
+	CoverImage  string
+
+	// Galleries with a password can only be seen by others once
+	// they enter it, see GalleryService.Unlock.
+	Password     string `gorm:"-"`
+	PasswordHash string
+
+	// ShareLinks are only loaded for the owner. SharedVia is the
+	// link the gallery is being seen through, if any.
+	ShareLinks []ShareLink `gorm:"-"`
+	SharedVia  *ShareLink  `gorm:"-"`
+}
+
+// Cover returns the image chosen as the cover of the gallery, or its
+// first image when none was chosen or it was deleted since. It
+// returns nil for galleries without images.
+func (g *Gallery) Cover() *Image {
+
+	if len(g.Images) == 0 {
+		return nil
+	}
+
+	for i := range g.Images {
+		if g.Images[i].Filename == g.CoverImage {
+			return &g.Images[i]
+		}
+	}
+
+	return &g.Images[0]
+}
+
+// Protected reports whether the gallery has a password.
+func (g *Gallery) Protected() bool {
+	return g.PasswordHash != ""
+}
+
+// VisibleTo reports whether the user, who can be nil, can see the
+// gallery at its /galleries/:id address. Unlisted galleries can only
+// be seen by others through SharePath.
+func (g *Gallery) VisibleTo(user *User) bool {
+	if user != nil && user.ID == g.UserID {
+		return true
+	}
+
+	return g.Visibility == VisibilityPublic
+}
+
+// SharePath returns the path anyone can see an unlisted gallery at,
+// or an empty string for other galleries.
+func (g *Gallery) SharePath() string {
+	if g.Visibility != VisibilityUnlisted || g.Slug == "" {
+		return ""
+	}
+
+	return "/g/" + g.Slug
+}
+
+// SetImages sets the images of the gallery, pointing them at its
+// share path when it is unlisted.
+func (g *Gallery) SetImages(images []Image) {
+	g.SetImagesBase(g.SharePath(), images)
+}
+
+// SetImagesBase sets the images of the gallery, pointing them at
+// base, or at their own path when it is empty.
+func (g *Gallery) SetImagesBase(base string, images []Image) {
+	for i := range images {
+		images[i].Base = base
+	}
+
+	g.Images = images
 }
 
+// ImagesSplitN splits the images into n columns, so that reading
+// them row by row follows their order.
 func (g *Gallery) ImagesSplitN(n int) [][]Image {
 
 	// Create our 2D slice
@@ -53,26 +208,113 @@ type GalleryDB interface {
 	Update(gallery *Gallery) error
 	Delete(id uint) error
 
+	// DeleteByUserID permanently deletes every gallery of the
+	// user, including the ones previously deleted with Delete.
+	DeleteByUserID(userID uint) error
+
 	ByID(id uint) (*Gallery, error)
+	BySlug(slug string) (*Gallery, error)
 	ByUserID(userID uint) ([]Gallery, error)
 }
 
 type GalleryService interface {
 	GalleryDB
+
+	// Unlock checks the password of a protected gallery and returns
+	// a token proving the visitor entered it, valid for UnlockTTL or
+	// until the password changes. It returns ErrPasswordIncorrect if
+	// the password doesn't match, and ErrTooManyAttempts after too
+	// many failed attempts on the gallery from the client.
+	Unlock(gallery *Gallery, password string,
+		client ClientInfo) (string, error)
+
+	// Unlocked reports whether the token was returned by Unlock for
+	// the current password of the gallery, and hasn't expired.
+	Unlocked(gallery *Gallery, token string) bool
 }
 
 type galleryService struct {
 	GalleryDB
+	pw        hash.Password
+	hmac      hash.HMAC
+	throttler *throttler
 }
 
-func NewGalleryService(db *gorm.DB) GalleryService {
+func NewGalleryService(db *gorm.DB, pw hash.Password,
+	hmac hash.HMAC) GalleryService {
 	return &galleryService{
 		GalleryDB: &galleryValidator{
 			GalleryDB: &galleryGorm{
 				db: db,
 			},
+			pw: pw,
 		},
+		pw:        pw,
+		hmac:      hmac,
+		throttler: &throttler{&throttleGorm{db}},
+	}
+}
+
+func (gs *galleryService) Unlock(gallery *Gallery, password string,
+	client ClientInfo) (string, error) {
+
+	// Attempts are only counted per client. A key shared by every
+	// visitor would let anyone lock the others out of the gallery.
+	key := fmt.Sprintf("gallery:%d:ip:%s", gallery.ID, client.IP)
+	if err := gs.throttler.check(key); err != nil {
+		return "", err
+	}
+
+	rehash, err := gs.pw.Compare(gallery.PasswordHash, password)
+	switch err {
+	case nil:
+	case hash.ErrPasswordMismatch:
+		if err := gs.throttler.hit(key, galleryPolicy); err != nil {
+			log.Println("models: recording failed unlock:", err)
+		}
+		return "", ErrPasswordIncorrect
+	default:
+		return "", err
+	}
+
+	if rehash {
+		gallery.Password = password
+		if err := gs.Update(gallery); err != nil {
+			log.Println("models: rehashing gallery password:", err)
+		}
+	}
+
+	expires := time.Now().Add(UnlockTTL).Unix()
+	return fmt.Sprintf("%d.%s", expires,
+		gs.hmac.Hash(unlockInput(gallery, expires))), nil
+}
+
+func (gs *galleryService) Unlocked(gallery *Gallery, token string) bool {
+
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || !gallery.Protected() {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
 	}
+
+	for _, h := range gs.hmac.Hashes(unlockInput(gallery, expires)) {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(parts[1])) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unlockInput is what the tokens returned by Unlock sign. It includes
+// the password hash so that changing the password locks everyone out.
+func unlockInput(gallery *Gallery, expires int64) string {
+	return fmt.Sprintf("gallery-unlock:%d:%s:%d", gallery.ID,
+		gallery.PasswordHash, expires)
 }
 
 //
@@ -97,6 +339,11 @@ func (g *galleryGorm) Delete(id uint) error {
 	return g.db.Delete(&gallery).Error
 }
 
+func (g *galleryGorm) DeleteByUserID(userID uint) error {
+	return g.db.Unscoped().Where("user_id = ?", userID).
+		Delete(&Gallery{}).Error
+}
+
 func (g *galleryGorm) ByID(id uint) (*Gallery, error) {
 	var gallery Gallery
 	db := g.db.Where("id = ?", id)
@@ -108,6 +355,19 @@ func (g *galleryGorm) ByID(id uint) (*Gallery, error) {
 	return &gallery, nil
 }
 
+func (g *galleryGorm) BySlug(slug string) (*Gallery, error) {
+
+	var gallery Gallery
+
+	db := g.db.Where("slug = ?", slug).
+		Where("visibility = ?", VisibilityUnlisted)
+	if err := first(db, &gallery); err != nil {
+		return nil, err
+	}
+
+	return &gallery, nil
+}
+
 func (g *galleryGorm) ByUserID(userID uint) ([]Gallery, error) {
 
 	var galleries []Gallery
@@ -127,6 +387,7 @@ func (g *galleryGorm) ByUserID(userID uint) ([]Gallery, error) {
 
 type galleryValidator struct {
 	GalleryDB
+	pw hash.Password
 }
 
 func (gv *galleryValidator) userIDRequired(g *Gallery) error {
@@ -145,6 +406,123 @@ func (gv *galleryValidator) titleRequired(g *Gallery) error {
 	return nil
 }
 
+func (gv *galleryValidator) normalizeDescription(g *Gallery) error {
+	g.Description = strings.TrimSpace(g.Description)
+	return nil
+}
+
+func (gv *galleryValidator) descriptionMaxLength(g *Gallery) error {
+
+	if len([]rune(g.Description)) > maxDescriptionLen {
+		return ErrDescriptionTooLong
+	}
+
+	return nil
+}
+
+func (gv *galleryValidator) eventDateInRange(g *Gallery) error {
+
+	if g.EventDate == nil {
+		return nil
+	}
+
+	max := time.Now().Year() + maxEventYearsAhead
+	if year := g.EventDate.Year(); year < minEventYear || year > max {
+		return ErrEventDateInvalid
+	}
+
+	return nil
+}
+
+// coverImageValid only checks the cover image is a filename images
+// could be stored with, as galleries don't know about their images.
+// Galleries.Update checks the image exists, and Cover ignores it once
+// it doesn't match any of them.
+func (gv *galleryValidator) coverImageValid(g *Gallery) error {
+
+	if g.CoverImage != "" && !validImageFilename(g.CoverImage) {
+		return ErrCoverImageInvalid
+	}
+
+	return nil
+}
+
+func (gv *galleryValidator) normalizeVisibility(g *Gallery) error {
+
+	switch g.Visibility {
+	case "":
+		g.Visibility = VisibilityPrivate
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+	default:
+		return ErrVisibilityInvalid
+	}
+
+	return nil
+}
+
+// setSlug gives unlisted galleries a slug. Other galleries lose
+// theirs, so that unlisting a gallery again gives it a new link
+// instead of bringing back the one it was shared with before.
+func (gv *galleryValidator) setSlug(g *Gallery) error {
+
+	if g.Visibility != VisibilityUnlisted {
+		g.Slug = ""
+		return nil
+	}
+
+	if g.Slug != "" {
+		return nil
+	}
+
+	slug, err := rand.String(slugBytes)
+	if err != nil {
+		return err
+	}
+	g.Slug = slug
+
+	return nil
+}
+
+func (gv *galleryValidator) passwordMinLength(g *Gallery) error {
+
+	if g.Password == "" {
+		return nil
+	}
+
+	if len([]rune(g.Password)) < minGalleryPasswordLen {
+		return ErrGalleryPasswordTooShort
+	}
+
+	return nil
+}
+
+// hashPassword hashes the password the same way as the ones of users,
+// with the pepper.
+func (gv *galleryValidator) hashPassword(g *Gallery) error {
+
+	if g.Password == "" {
+		return nil
+	}
+
+	hashed, err := gv.pw.Hash(g.Password)
+	if err != nil {
+		return err
+	}
+	g.PasswordHash = hashed
+	g.Password = ""
+
+	return nil
+}
+
+func (gv *galleryValidator) BySlug(slug string) (*Gallery, error) {
+
+	if slug == "" {
+		return nil, ErrNotFound
+	}
+
+	return gv.GalleryDB.BySlug(slug)
+}
+
 func (gv *galleryValidator) nonZeroID(gallery *Gallery) error {
 	if gallery.ID <= 0 {
 		return ErrIDInvalid
@@ -157,7 +535,15 @@ func (gv *galleryValidator) Create(gallery *Gallery) error {
 
 	err := runGalleryValFns(gallery,
 		gv.userIDRequired,
-		gv.titleRequired)
+		gv.titleRequired,
+		gv.normalizeVisibility,
+		gv.normalizeDescription,
+		gv.descriptionMaxLength,
+		gv.eventDateInRange,
+		gv.coverImageValid,
+		gv.setSlug,
+		gv.passwordMinLength,
+		gv.hashPassword)
 
 	if err != nil {
 		return err
@@ -170,7 +556,15 @@ func (gv *galleryValidator) Update(gallery *Gallery) error {
 
 	err := runGalleryValFns(gallery,
 		gv.userIDRequired,
-		gv.titleRequired)
+		gv.titleRequired,
+		gv.normalizeVisibility,
+		gv.normalizeDescription,
+		gv.descriptionMaxLength,
+		gv.eventDateInRange,
+		gv.coverImageValid,
+		gv.setSlug,
+		gv.passwordMinLength,
+		gv.hashPassword)
 
 	if err != nil {
 		return err
@@ -193,6 +587,15 @@ func (gv *galleryValidator) Delete(id uint) error {
 	return gv.GalleryDB.Delete(gallery.ID)
 }
 
+func (gv *galleryValidator) DeleteByUserID(userID uint) error {
+
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return gv.GalleryDB.DeleteByUserID(userID)
+}
+
 type galleryValFn func(*Gallery) error
 
 func runGalleryValFns(gallery *Gallery, fns ...galleryValFn) error {
@@ -1,29 +1,85 @@
 package models
 
 import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"time"
 
-	"lenslockedbr.com/hash"
+	"github.com/jinzhu/gorm"
+	"github.com/rwcarlsen/goexif/exif"
+)
 
-	"log"
+// Presets images can be sorted with, see ImageService.Sort.
+const (
+	ImageSortFilename = "filename"
+	ImageSortUploaded = "uploaded"
+	ImageSortCaptured = "captured"
+)
+
+var (
+	// ErrImageOrderInvalid is returned when reordering the images of
+	// a gallery with filenames it doesn't have.
+	ErrImageOrderInvalid modelError = "models: some of these images " +
+		"are no longer in the gallery, reload the page and try again"
+
+	// ErrImageSortInvalid is returned when sorting images with a
+	// preset that doesn't exist.
+	ErrImageSortInvalid modelError = "models: please pick how to sort " +
+		"the images"
 )
 
-// Image is used to represent images stored in a Gallery.
-// Image is NOT stored in the database, and instead references data
-// stored on disk.
+// Image is an image stored in a Gallery. Its file lives on disk at
+// RelativePath, and the images table keeps what we know about it so
+// pages don't have to read the files. Hash is the hex encoded SHA-256
+// hash of the file, and Width and Height are zero for files that
+// can't be decoded as an image. CapturedAt comes from the EXIF data
+// of photos that have it.
+//
+// Images are shown by Position, then by filename for those with the
+// same one.
+//
+// Base is the path of the gallery the image is seen through when it
+// isn't its own, like the share path of an unlisted gallery or a
+// share link.
 type Image struct {
-	GalleryID uint
-	Filename  string
-	Hash string
+	gorm.Model
+	GalleryID   uint   `gorm:"not null;unique_index:uix_images_gallery_id_filename"`
+	Filename    string `gorm:"not null;unique_index:uix_images_gallery_id_filename"`
+	Size        int64  `gorm:"not null"`
+	ContentType string
+	Hash        string
+	Width       int
+	Height      int
+	CapturedAt  *time.Time
+	UploadedAt  time.Time
+	Position    int    `gorm:"not null;default:0"`
+	Base        string `gorm:"-"`
 }
 
 // Path is used to build the absolute path used to reference this image
 // via web request.
 func (i *Image) Path() string {
+	if i.Base != "" {
+		temp := url.URL{
+			Path: i.Base + "/images/" + i.Filename,
+		}
+		return temp.String()
+	}
+
 	temp := url.URL{
 		Path: "/" + i.RelativePath(),
 	}
@@ -42,64 +98,323 @@ func (i *Image) RelativePath() string {
 		i.Filename))
 }
 
+// ZipImages writes the images to w as a ZIP archive.
+func ZipImages(w io.Writer, images []Image) error {
+
+	zw := zip.NewWriter(w)
+	for _, img := range images {
+		_, err := copyToZip(zw, img.Filename, img.RelativePath())
+		if err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// ImageService stores the images of galleries on disk, keeps their
+// metadata in the database, and accounts for the bytes they take
+// against the storage quota of the owner of the gallery.
 type ImageService interface {
-	Create(galleryID uint, r io.Reader, filename string) error
+	// Create stores the image, replacing the one with the same
+	// filename if any. ErrStorageQuotaExceeded is returned when
+	// there is no room left for it.
+	Create(gallery *Gallery, r io.Reader, filename string) error
+
+	// ByGalleryID returns the images of the gallery in the order
+	// they should be shown.
 	ByGalleryID(galleryID uint) ([]Image, error)
-	Delete(i *Image) error
+
+	Delete(gallery *Gallery, filename string) error
+
+	// Reorder puts the images with the filenames first, in that
+	// order, followed by the others in their current order. It
+	// returns ErrImageOrderInvalid when a filename isn't one of the
+	// gallery's.
+	Reorder(gallery *Gallery, filenames []string) error
+
+	// Sort orders the images with one of the ImageSort presets.
+	// Images without a capture time come last when sorting by it.
+	Sort(gallery *Gallery, by string) error
+
+	// DeleteAll removes every image of the gallery.
+	DeleteAll(gallery *Gallery) error
+
+	// DiskUsage returns the number of bytes used by the images of
+	// the gallery.
+	DiskUsage(galleryID uint) (int64, error)
+
+	// Storage returns the storage used by the user, along with
+	// their quota.
+	Storage(user *User) (*Storage, error)
+
+	// Recount sets the storage used by each user from the images of
+	// their galleries.
+	Recount() error
+
+	// Backfill adds the images found on disk that the database
+	// doesn't know about, for galleries that still exist, then
+	// recounts the storage of every user. It returns the number of
+	// images added.
+	Backfill() (int, error)
+}
+
+func NewImageService(db *gorm.DB, defaultQuota int64) ImageService {
+	if defaultQuota <= 0 {
+		defaultQuota = DefaultStorageQuota
+	}
+
+	return &imageService{
+		db:           db,
+		imageDB:      &imageGorm{db},
+		storageDB:    &storageGorm{db},
+		defaultQuota: defaultQuota,
+	}
 }
 
-func NewImageService() ImageService {
-	return &imageService{}
+type imageService struct {
+	db           *gorm.DB
+	imageDB      imageDB
+	storageDB    storageDB
+	defaultQuota int64
 }
 
-type imageService struct{}
+func (is *imageService) Create(gallery *Gallery, r io.Reader, filename string) error {
 
-func (is *imageService) Create(galleryID uint, r io.Reader, filename string) error {
+	path, err := is.mkImagePath(gallery.ID)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(path, filename)
 
-	path, err := is.mkImagePath(galleryID)
+	storage, err := is.storage(gallery.UserID)
 	if err != nil {
 		return err
 	}
 
-	// Create a destination file
-	dst, err := os.Create(filepath.Join(path, filename))
+	img := Image{
+		GalleryID: gallery.ID,
+		Filename:  filename,
+	}
+
+	// The image being replaced frees its own bytes and keeps its
+	// place, new ones go last.
+	var replaced int64
+	existing, err := is.imageDB.ByFilename(gallery.ID, filename)
+	switch err {
+	case nil:
+		replaced = existing.Size
+		img.Model = existing.Model
+		img.Position = existing.Position
+	case ErrNotFound:
+		img.Position, err = is.imageDB.NextPosition(gallery.ID)
+		if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	// Write the upload aside first, so a failed one doesn't leave a
+	// truncated image behind, and stop reading as soon as it turns
+	// out to be too big.
+	tmp, err := is.tempFile()
 	if err != nil {
 		return err
 	}
-	defer dst.Close()
+	defer os.Remove(tmp.Name())
 
-	// Copy uploaded file data to the destination file
-	_, err = io.Copy(dst, r)
+	limit := storage.Remaining() + replaced
+	n, err := io.Copy(tmp, io.LimitReader(r, limit+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
 		return err
 	}
+	if n > limit {
+		return ErrStorageQuotaExceeded
+	}
 
-	return nil
-}
+	if err := readImageInfo(tmp.Name(), &img); err != nil {
+		return err
+	}
+	img.UploadedAt = time.Now()
 
-func (is *imageService) Delete(i *Image) error {
-	return os.Remove(i.RelativePath())
+	// Other uploads may have happened in the meantime, so the quota
+	// is checked again while reserving the bytes.
+	delta := img.Size - replaced
+	if err := is.reserve(gallery.UserID, delta); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		is.reserve(gallery.UserID, -delta)
+		return err
+	}
+
+	// The file is in place by now, so should this fail Backfill
+	// can still add it.
+	return is.imageDB.Save(&img)
 }
 
 func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
+	return is.imageDB.ByGalleryID(galleryID)
+}
 
-	path := is.imagePath(galleryID)
-	strings, err := filepath.Glob(filepath.Join(path, "*"))
+func (is *imageService) Delete(gallery *Gallery, filename string) error {
+
+	img, err := is.imageDB.ByFilename(gallery.ID, filename)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	err = os.Remove(img.RelativePath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := is.imageDB.Delete(img.ID); err != nil {
+		return err
+	}
+
+	return is.storageDB.Release(gallery.UserID, img.Size)
+}
+
+func (is *imageService) Reorder(gallery *Gallery, filenames []string) error {
+
+	images, err := is.imageDB.ByGalleryID(gallery.ID)
+	if err != nil {
+		return err
+	}
+
+	byFilename := make(map[string]*Image)
+	for i := range images {
+		byFilename[images[i].Filename] = &images[i]
+	}
+
+	var ordered []Image
+	for _, filename := range filenames {
+		img, ok := byFilename[filename]
+		if !ok {
+			return ErrImageOrderInvalid
+		}
+		ordered = append(ordered, *img)
+		delete(byFilename, filename)
+	}
+
+	for _, img := range images {
+		if _, ok := byFilename[img.Filename]; ok {
+			ordered = append(ordered, img)
+		}
+	}
+
+	return is.imageDB.SetPositions(ordered)
+}
+
+func (is *imageService) Sort(gallery *Gallery, by string) error {
+
+	images, err := is.imageDB.ByGalleryID(gallery.ID)
+	if err != nil {
+		return err
+	}
+
+	var less func(a, b *Image) bool
+	switch by {
+	case ImageSortFilename:
+		less = func(a, b *Image) bool {
+			return a.Filename < b.Filename
+		}
+	case ImageSortUploaded:
+		less = func(a, b *Image) bool {
+			return a.UploadedAt.Before(b.UploadedAt)
+		}
+	case ImageSortCaptured:
+		less = func(a, b *Image) bool {
+			if a.CapturedAt == nil || b.CapturedAt == nil {
+				return a.CapturedAt != nil && b.CapturedAt == nil
+			}
+			return a.CapturedAt.Before(*b.CapturedAt)
+		}
+	default:
+		return ErrImageSortInvalid
+	}
+
+	sort.SliceStable(images, func(i, j int) bool {
+		return less(&images[i], &images[j])
+	})
+
+	return is.imageDB.SetPositions(images)
+}
+
+func (is *imageService) DeleteAll(gallery *Gallery) error {
+
+	size, err := is.DiskUsage(gallery.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(is.imagePath(gallery.ID)); err != nil {
+		return err
+	}
+
+	if err := is.imageDB.DeleteByGalleryID(gallery.ID); err != nil {
+		return err
+	}
+
+	return is.storageDB.Release(gallery.UserID, size)
+}
+
+func (is *imageService) DiskUsage(galleryID uint) (int64, error) {
+	return is.imageDB.TotalSize(galleryID)
+}
+
+func (is *imageService) Storage(user *User) (*Storage, error) {
+	return is.storage(user.ID)
+}
+
+func (is *imageService) Recount() error {
+
+	var galleries []Gallery
+	if err := all(is.db, &galleries); err != nil {
+		return err
+	}
+
+	used := make(map[uint]int64)
+	for _, gallery := range galleries {
+		size, err := is.DiskUsage(gallery.ID)
+		if err != nil {
+			return err
+		}
+		used[gallery.UserID] += size
+	}
+
+	for userID, n := range used {
+		if err := is.storageDB.Set(userID, n); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (is *imageService) Backfill() (int, error) {
+
+	var galleries []Gallery
+	if err := all(is.db, &galleries); err != nil {
+		return 0, err
 	}
 
-	// Setup the Image slice we are returning
-	ret := make([]Image, len(strings))
-	for i, imgStr := range strings {
-		ret[i] = Image{
-			GalleryID: galleryID,
-			Filename:  filepath.Base(imgStr),
-			Hash: is.hashFile(imgStr),
+	added := 0
+	for _, gallery := range galleries {
+		n, err := is.backfill(gallery.ID)
+		added += n
+		if err != nil {
+			return added, err
 		}
 	}
 
-	return ret, nil
+	return added, is.Recount()
 }
 
 /////////////////////////////////////////////////////////////////////
@@ -108,6 +423,62 @@ func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
 //
 /////////////////////////////////////////////////////////////////////
 
+// backfill adds the files of the gallery missing from the database.
+func (is *imageService) backfill(galleryID uint) (int, error) {
+
+	images, err := is.imageDB.ByGalleryID(galleryID)
+	if err != nil {
+		return 0, err
+	}
+
+	known := make(map[string]bool)
+	for _, img := range images {
+		known[img.Filename] = true
+	}
+
+	paths, err := filepath.Glob(filepath.Join(is.imagePath(galleryID), "*"))
+	if err != nil {
+		return 0, err
+	}
+
+	added := 0
+	for _, path := range paths {
+		filename := filepath.Base(path)
+		if known[filename] {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			log.Println("models: skipping", path+":", err)
+			continue
+		}
+
+		img := Image{
+			GalleryID:  galleryID,
+			Filename:   filename,
+			UploadedAt: info.ModTime(),
+		}
+		if err := readImageInfo(path, &img); err != nil {
+			return added, err
+		}
+
+		// Files are globbed in filename order, which is how
+		// galleries were shown before they had one of their own.
+		img.Position, err = is.imageDB.NextPosition(galleryID)
+		if err != nil {
+			return added, err
+		}
+
+		if err := is.imageDB.Save(&img); err != nil {
+			return added, err
+		}
+		added++
+	}
+
+	return added, nil
+}
+
 func (is *imageService) mkImagePath(galleryID uint) (string, error) {
 
 	galleryPath := is.imagePath(galleryID)
@@ -119,19 +490,227 @@ func (is *imageService) mkImagePath(galleryID uint) (string, error) {
 	return galleryPath, nil
 }
 
+// tempFile creates a file to write an upload to, on the same disk as
+// the images so it can be renamed into place.
+func (is *imageService) tempFile() (*os.File, error) {
+
+	path := filepath.Join("images", "uploads")
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+
+	return ioutil.TempFile(path, "upload-")
+}
+
+// storage returns the storage of the user, with their actual quota.
+func (is *imageService) storage(userID uint) (*Storage, error) {
+
+	storage, err := is.storageDB.ByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if storage.Quota == 0 {
+		storage.Quota = is.defaultQuota
+	}
+
+	return storage, nil
+}
+
+// reserve adds delta bytes to the usage of the user, or releases
+// them when delta is negative.
+func (is *imageService) reserve(userID uint, delta int64) error {
+	switch {
+	case delta > 0:
+		return is.storageDB.Reserve(userID, delta, is.defaultQuota)
+	case delta < 0:
+		return is.storageDB.Release(userID, -delta)
+	default:
+		return nil
+	}
+}
+
 func (is *imageService) imagePath(galleryID uint) string {
 	return filepath.Join("images", "galleries",
 		fmt.Sprintf("%v", galleryID))
 }
 
-func (is *imageService) hashFile(path string) string {
+// readImageInfo sets the size, content type, hash, dimensions and
+// capture time of the image from the file at path.
+func readImageInfo(path string, img *Image) error {
 
-	file, err := os.Open(path)
+	f, err := os.Open(path)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	defer f.Close()
+
+	// DetectContentType only looks at the first 512 bytes.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	img.ContentType = http.DetectContentType(head[:n])
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	img.Size = size
+	img.Hash = hex.EncodeToString(h.Sum(nil))
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if cfg, _, err := image.DecodeConfig(f); err == nil {
+		img.Width = cfg.Width
+		img.Height = cfg.Height
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if x, err := exif.Decode(f); err == nil {
+		if t, err := x.DateTime(); err == nil {
+			img.CapturedAt = &t
+		}
 	}
 
-	defer file.Close()
+	return nil
+}
+
+// imageDB is used to interact with the images table.
+type imageDB interface {
+	// ByGalleryID returns the images of the gallery, ordered by
+	// position and filename.
+	ByGalleryID(galleryID uint) ([]Image, error)
+
+	ByFilename(galleryID uint, filename string) (*Image, error)
+
+	// TotalSize returns the number of bytes used by the images of
+	// the gallery.
+	TotalSize(galleryID uint) (int64, error)
+
+	// Save creates the image, or updates it when it has an ID.
+	Save(img *Image) error
+
+	// NextPosition returns the position after the last image of
+	// the gallery.
+	NextPosition(galleryID uint) (int, error)
+
+	// SetPositions numbers the images in the order given, all at
+	// once.
+	SetPositions(images []Image) error
+
+	Delete(id uint) error
+	DeleteByGalleryID(galleryID uint) error
+}
+
+//
+// Gorm
+//
+
+type imageGorm struct {
+	db *gorm.DB
+}
+
+func (ig *imageGorm) ByGalleryID(galleryID uint) ([]Image, error) {
+
+	var images []Image
+
+	db := ig.db.Where("gallery_id = ?", galleryID).
+		Order("position").Order("filename")
+	if err := all(db, &images); err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+func (ig *imageGorm) ByFilename(galleryID uint, filename string) (*Image, error) {
+
+	var img Image
+
+	db := ig.db.Where("gallery_id = ? AND filename = ?",
+		galleryID, filename)
+	if err := first(db, &img); err != nil {
+		return nil, err
+	}
+
+	return &img, nil
+}
+
+func (ig *imageGorm) TotalSize(galleryID uint) (int64, error) {
+
+	var total struct {
+		Size int64
+	}
+
+	err := ig.db.Model(&Image{}).Select("COALESCE(SUM(size), 0) AS size").
+		Where("gallery_id = ?", galleryID).Scan(&total).Error
+	if err != nil {
+		return 0, err
+	}
+
+	return total.Size, nil
+}
+
+func (ig *imageGorm) Save(img *Image) error {
+	return ig.db.Save(img).Error
+}
+
+func (ig *imageGorm) NextPosition(galleryID uint) (int, error) {
+
+	var next struct {
+		Position int
+	}
+
+	err := ig.db.Model(&Image{}).
+		Select("COALESCE(MAX(position) + 1, 0) AS position").
+		Where("gallery_id = ?", galleryID).Scan(&next).Error
+	if err != nil {
+		return 0, err
+	}
+
+	return next.Position, nil
+}
+
+func (ig *imageGorm) SetPositions(images []Image) error {
+
+	tx := ig.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	for i, img := range images {
+		err := tx.Model(&Image{}).Where("id = ?", img.ID).
+			UpdateColumn("position", i).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+// Images are deleted for good, or their filename couldn't be used
+// again.
+func (ig *imageGorm) Delete(id uint) error {
+
+	img := Image{
+		Model: gorm.Model{ID: id},
+	}
+
+	return ig.db.Unscoped().Delete(&img).Error
+}
 
-	return hash.ReaderSHA256(file)
+func (ig *imageGorm) DeleteByGalleryID(galleryID uint) error {
+	return ig.db.Unscoped().Where("gallery_id = ?", galleryID).
+		Delete(&Image{}).Error
 }
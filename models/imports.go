@@ -0,0 +1,274 @@
+package models
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+)
+
+// maxManifestSize is the size past which a manifest.json is not
+// worth reading.
+const maxManifestSize = 10 << 20 // 10 megabytes
+
+var (
+	// ErrImportInvalid is returned when importing a file that isn't
+	// an archive made by ExportService.
+	ErrImportInvalid modelError = "models: this file is not a valid " +
+		"LensLockedBR export"
+
+	// ErrImportCorrupted is returned when an image of an archive
+	// doesn't match the hash of its manifest.
+	ErrImportCorrupted modelError = "models: this export is " +
+		"corrupted, some of its images don't match their checksum"
+)
+
+// ImportResult describes what an import created. Galleries maps the
+// IDs of the galleries in the archive to the ones created for them.
+type ImportResult struct {
+	Galleries map[uint]uint
+	Images    int
+}
+
+// Summary describes the result for humans, like "2 galleries and 5
+// images".
+func (r *ImportResult) Summary() string {
+	return fmt.Sprintf("%s and %s", plural(len(r.Galleries), "gallery",
+		"galleries"), plural(r.Images, "image", "images"))
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return "1 " + one
+	}
+
+	return fmt.Sprintf("%d %s", n, many)
+}
+
+// ImportService recreates the galleries of an archive built by the
+// ExportService, possibly on another instance.
+type ImportService interface {
+	// Import creates the galleries of the archive and their images
+	// for the user. Nothing is created unless every image matches
+	// its hash and they all fit in the user's storage quota.
+	// Archives with unlisted or public galleries can only be
+	// imported once the user verified their email address.
+	Import(user *User, r io.ReaderAt, size int64) (*ImportResult, error)
+}
+
+func NewImportService(gs GalleryService, is ImageService,
+	us UserService) ImportService {
+
+	return &importService{
+		gs: gs,
+		is: is,
+		us: us,
+	}
+}
+
+type importService struct {
+	gs GalleryService
+	is ImageService
+	us UserService
+}
+
+func (ims *importService) Import(user *User, r io.ReaderAt, size int64) (*ImportResult, error) {
+
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, ErrImportInvalid
+	}
+
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	manifest, err := readManifest(files["manifest.json"])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, g := range manifest.Galleries {
+		if g.Visibility == VisibilityUnlisted ||
+			g.Visibility == VisibilityPublic {
+
+			if err := ims.us.RequireVerified(user); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	storage, err := ims.is.Storage(user)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifyArchive(manifest, files, storage.Remaining()); err != nil {
+		return nil, err
+	}
+
+	result := ImportResult{
+		Galleries: make(map[uint]uint),
+	}
+
+	var created []*Gallery
+	for _, g := range manifest.Galleries {
+		gallery, n, err := ims.importGallery(user, &g, files)
+		if gallery != nil {
+			created = append(created, gallery)
+		}
+		if err != nil {
+			ims.rollback(created)
+			return nil, err
+		}
+		result.Galleries[g.ID] = gallery.ID
+		result.Images += n
+	}
+
+	return &result, nil
+}
+
+// importGallery creates the gallery with its images. The gallery is
+// returned as soon as it is created, even when an image then fails.
+func (ims *importService) importGallery(user *User, g *exportGallery,
+	files map[string]*zip.File) (*Gallery, int, error) {
+
+	gallery := Gallery{
+		UserID:      user.ID,
+		Title:       g.Title,
+		Description: g.Description,
+		EventDate:   g.EventDate,
+		CoverImage:  g.CoverImage,
+		Visibility:  g.Visibility,
+	}
+	if err := ims.gs.Create(&gallery); err != nil {
+		return nil, 0, err
+	}
+
+	for i, image := range g.Images {
+		rc, err := files[image.Path].Open()
+		if err != nil {
+			return &gallery, i, err
+		}
+
+		err = ims.is.Create(&gallery, rc, image.Filename)
+		rc.Close()
+		if err != nil {
+			return &gallery, i, err
+		}
+	}
+
+	return &gallery, len(g.Images), nil
+}
+
+// rollback deletes the galleries of an import that failed half way.
+func (ims *importService) rollback(galleries []*Gallery) {
+
+	for _, gallery := range galleries {
+		if err := ims.is.DeleteAll(gallery); err != nil {
+			log.Println("models: rolling back import:", err)
+		}
+		if err := ims.gs.Delete(gallery.ID); err != nil {
+			log.Println("models: rolling back import:", err)
+		}
+	}
+}
+
+func readManifest(f *zip.File) (*exportManifest, error) {
+
+	if f == nil {
+		return nil, ErrImportInvalid
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, ErrImportInvalid
+	}
+	defer rc.Close()
+
+	var manifest exportManifest
+
+	dec := json.NewDecoder(io.LimitReader(rc, maxManifestSize))
+	if err := dec.Decode(&manifest); err != nil {
+		return nil, ErrImportInvalid
+	}
+
+	return &manifest, nil
+}
+
+// verifyArchive checks that every image of the manifest is in the
+// archive where it should be, matches its hash, and that they take
+// at most quota bytes altogether.
+func verifyArchive(manifest *exportManifest, files map[string]*zip.File,
+	quota int64) error {
+
+	var total int64
+
+	for _, g := range manifest.Galleries {
+		if strings.TrimSpace(g.Title) == "" {
+			return ErrImportInvalid
+		}
+
+		for _, image := range g.Images {
+			if !validImageFilename(image.Filename) ||
+				image.Path != exportImagePath(g.ID, image.Filename) {
+				return ErrImportInvalid
+			}
+
+			f := files[image.Path]
+			if f == nil {
+				return ErrImportInvalid
+			}
+
+			// Don't trust the sizes of the archive, which
+			// would let a tiny one fill the disk.
+			n, sum, err := hashZipFile(f, quota-total+1)
+			if err != nil {
+				return err
+			}
+			total += n
+			if total > quota {
+				return ErrStorageQuotaExceeded
+			}
+
+			if !strings.EqualFold(sum, image.SHA256) {
+				return ErrImportCorrupted
+			}
+		}
+	}
+
+	return nil
+}
+
+// hashZipFile returns the size and hex encoded SHA-256 hash of the
+// file, reading at most limit bytes of it.
+func hashZipFile(f *zip.File, limit int64) (int64, string, error) {
+
+	rc, err := f.Open()
+	if err != nil {
+		return 0, "", ErrImportInvalid
+	}
+	defer rc.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, io.LimitReader(rc, limit))
+	if err != nil {
+		return 0, "", ErrImportCorrupted
+	}
+
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// validImageFilename reports whether name can be used as is to store
+// an image, without escaping the directory of its gallery.
+func validImageFilename(name string) bool {
+	return name != "" && name == path.Base(name) &&
+		!strings.HasPrefix(name, ".") && !strings.Contains(name, `\`)
+}
@@ -0,0 +1,185 @@
+package models
+
+import (
+	"lenslockedbr.com/hash"
+	"lenslockedbr.com/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+/////////////////////////////////////////////////////////////////////
+//
+// Model loginChallenge structures and methods
+//
+/////////////////////////////////////////////////////////////////////
+
+// loginChallenge represents a login that has passed the password check
+// but is still waiting for the user's second factor.
+type loginChallenge struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null"`
+	Attempts  int    `gorm:"not null"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+}
+
+type loginChallengeGorm struct {
+	db *gorm.DB
+}
+
+type loginChallengeDB interface {
+	ByToken(token string) (*loginChallenge, error)
+	Create(lc *loginChallenge) error
+	Update(lc *loginChallenge) error
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+func (lcg *loginChallengeGorm) ByToken(token string) (*loginChallenge, error) {
+
+	var lc loginChallenge
+
+	err := first(lcg.db.Where("token_hash = ?", token), &lc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lc, nil
+}
+
+func (lcg *loginChallengeGorm) Create(lc *loginChallenge) error {
+	return lcg.db.Create(lc).Error
+}
+
+func (lcg *loginChallengeGorm) Update(lc *loginChallenge) error {
+	return lcg.db.Save(lc).Error
+}
+
+func (lcg *loginChallengeGorm) Delete(id uint) error {
+
+	lc := loginChallenge{
+		Model: gorm.Model{ID: id},
+	}
+
+	return lcg.db.Delete(&lc).Error
+}
+
+func (lcg *loginChallengeGorm) DeleteByUserID(userID uint) error {
+	return lcg.db.Unscoped().Where("user_id = ?", userID).
+		Delete(&loginChallenge{}).Error
+}
+
+/////////////////////////////////////////////////////////////////////
+//
+// Validator structures and methods
+//
+/////////////////////////////////////////////////////////////////////
+
+type loginChallengeValFn func(*loginChallenge) error
+
+func runLoginChallengeValFns(lc *loginChallenge, fns ...loginChallengeValFn) error {
+
+	for _, fn := range fns {
+		if err := fn(lc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type loginChallengeValidator struct {
+	loginChallengeDB
+	hmac hash.HMAC
+}
+
+func newLoginChallengeValidator(db loginChallengeDB, hmac hash.HMAC) *loginChallengeValidator {
+	return &loginChallengeValidator{
+		loginChallengeDB: db,
+		hmac:             hmac,
+	}
+}
+
+func (lcv *loginChallengeValidator) requireUserID(lc *loginChallenge) error {
+
+	if lc.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (lcv *loginChallengeValidator) setTokenIfUnset(lc *loginChallenge) error {
+
+	if lc.Token != "" {
+		return nil
+	}
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+
+	lc.Token = token
+
+	return nil
+}
+
+func (lcv *loginChallengeValidator) hmacToken(lc *loginChallenge) error {
+
+	if lc.Token == "" {
+		return nil
+	}
+
+	lc.TokenHash = lcv.hmac.Hash(lc.Token)
+
+	return nil
+}
+
+func (lcv *loginChallengeValidator) ByToken(token string) (*loginChallenge, error) {
+
+	var lc *loginChallenge
+
+	// Challenges only last a few minutes, so there is no point in
+	// rehashing one found under a retired key.
+	_, err := byHash(lcv.hmac, token, func(tokenHash string) error {
+		var err error
+		lc, err = lcv.loginChallengeDB.ByToken(tokenHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return lc, nil
+}
+
+func (lcv *loginChallengeValidator) Create(lc *loginChallenge) error {
+
+	err := runLoginChallengeValFns(lc, lcv.requireUserID,
+		lcv.setTokenIfUnset,
+		lcv.hmacToken)
+	if err != nil {
+		return err
+	}
+
+	return lcv.loginChallengeDB.Create(lc)
+}
+
+func (lcv *loginChallengeValidator) Delete(id uint) error {
+
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	return lcv.loginChallengeDB.Delete(id)
+}
+
+func (lcv *loginChallengeValidator) DeleteByUserID(userID uint) error {
+
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return lcv.loginChallengeDB.DeleteByUserID(userID)
+}
@@ -0,0 +1,179 @@
+package models
+
+import (
+	"lenslockedbr.com/hash"
+	"lenslockedbr.com/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+/////////////////////////////////////////////////////////////////////
+//
+// Model loginLink structures and methods
+//
+/////////////////////////////////////////////////////////////////////
+
+// loginLink is a single use token emailed to a user so they can log
+// in without their password.
+type loginLink struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+}
+
+type loginLinkGorm struct {
+	db *gorm.DB
+}
+
+type loginLinkDB interface {
+	ByToken(token string) (*loginLink, error)
+	Create(ll *loginLink) error
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+func (llg *loginLinkGorm) ByToken(token string) (*loginLink, error) {
+
+	var ll loginLink
+
+	err := first(llg.db.Where("token_hash = ?", token), &ll)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ll, nil
+}
+
+func (llg *loginLinkGorm) Create(ll *loginLink) error {
+	return llg.db.Create(ll).Error
+}
+
+func (llg *loginLinkGorm) Delete(id uint) error {
+
+	ll := loginLink{
+		Model: gorm.Model{ID: id},
+	}
+
+	return llg.db.Unscoped().Delete(&ll).Error
+}
+
+func (llg *loginLinkGorm) DeleteByUserID(userID uint) error {
+	return llg.db.Unscoped().Where("user_id = ?", userID).
+		Delete(&loginLink{}).Error
+}
+
+/////////////////////////////////////////////////////////////////////
+//
+// Validator structures and methods
+//
+/////////////////////////////////////////////////////////////////////
+
+type loginLinkValFn func(*loginLink) error
+
+func runLoginLinkValFns(ll *loginLink, fns ...loginLinkValFn) error {
+
+	for _, fn := range fns {
+		if err := fn(ll); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type loginLinkValidator struct {
+	loginLinkDB
+	hmac hash.HMAC
+}
+
+func newLoginLinkValidator(db loginLinkDB, hmac hash.HMAC) *loginLinkValidator {
+	return &loginLinkValidator{
+		loginLinkDB: db,
+		hmac:        hmac,
+	}
+}
+
+func (llv *loginLinkValidator) requireUserID(ll *loginLink) error {
+
+	if ll.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (llv *loginLinkValidator) setTokenIfUnset(ll *loginLink) error {
+
+	if ll.Token != "" {
+		return nil
+	}
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+
+	ll.Token = token
+
+	return nil
+}
+
+func (llv *loginLinkValidator) hmacToken(ll *loginLink) error {
+
+	if ll.Token == "" {
+		return nil
+	}
+
+	ll.TokenHash = llv.hmac.Hash(ll.Token)
+
+	return nil
+}
+
+func (llv *loginLinkValidator) ByToken(token string) (*loginLink, error) {
+
+	var ll *loginLink
+
+	// Links are deleted once used, so there is no point in
+	// rehashing one found under a retired key.
+	_, err := byHash(llv.hmac, token, func(tokenHash string) error {
+		var err error
+		ll, err = llv.loginLinkDB.ByToken(tokenHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ll, nil
+}
+
+func (llv *loginLinkValidator) Create(ll *loginLink) error {
+
+	err := runLoginLinkValFns(ll, llv.requireUserID,
+		llv.setTokenIfUnset,
+		llv.hmacToken)
+	if err != nil {
+		return err
+	}
+
+	return llv.loginLinkDB.Create(ll)
+}
+
+func (llv *loginLinkValidator) Delete(id uint) error {
+
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	return llv.loginLinkDB.Delete(id)
+}
+
+func (llv *loginLinkValidator) DeleteByUserID(userID uint) error {
+
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return llv.loginLinkDB.DeleteByUserID(userID)
+}
@@ -8,27 +8,132 @@ import (
 const (
 	ErrServiceRequired modelError = "models: service is required"
 	OAuthDropbox = "dropbox"
+
+	// ErrSubjectRequired is returned when signing in with a
+	// provider that didn't say which of its users signed in.
+	ErrSubjectRequired modelError = "models: the provider didn't " +
+		"say who you are"
+
+	// ErrIdentityTaken is returned when connecting an account of a
+	// provider that is already connected to another user.
+	ErrIdentityTaken modelError = "models: this account is already " +
+		"connected to another user"
+
+	// ErrIdentityEmailUnverified is returned when signing up with a
+	// provider that couldn't vouch for the user's email address.
+	ErrIdentityEmailUnverified modelError = "models: please verify " +
+		"your email address with the provider first, or sign up " +
+		"with a password"
 )
 
+// OAuth connects a user to their account on a provider. Subject is
+// the ID of that account, set when the provider can tell us who the
+// token was issued to, which is what lets the user sign in with it.
 type OAuth struct {
 	gorm.Model
 	UserID uint `gorm:"not null;unique_index:user_id_service"`
 	Service string `gorm:"not null;unique_index:user_id_service"`
+	Subject string
+	Email   string
 	oauth2.Token
 }
 
+// Identity is what a provider told us about a user who signed in
+// with it.
+type Identity struct {
+	Service       string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Token         oauth2.Token
+}
+
+// OAuth returns the connection of the identity, to be stored for a
+// user.
+func (i Identity) OAuth() *OAuth {
+	return &OAuth{
+		Service: i.Service,
+		Subject: i.Subject,
+		Email:   i.Email,
+		Token:   i.Token,
+	}
+}
+
 type OAuthDB interface {
 	Find(userID uint, service string) (*OAuth, error)
+	BySubject(service, subject string) (*OAuth, error)
+	ByUserID(userID uint) ([]OAuth, error)
 	Create(oauth *OAuth) error
 	Delete(id uint) error
+	DeleteByUserID(userID uint) error
 }
 
 type OAuthService interface {
 	OAuthDB
+
+	// Connect stores the token of a service the user just
+	// connected, replacing any previous one, and records it in the
+	// audit log of the user. If the provider's account is already
+	// connected to someone else ErrIdentityTaken is returned.
+	Connect(user *User, oauth *OAuth, client ClientInfo) error
 }
 
 func NewOAuthService(db *gorm.DB) OAuthService {
-	return &oauthValidator{&oauthGorm{db}}
+	return &oauthService{
+		OAuthDB: &oauthValidator{&oauthGorm{db}},
+		audit:   NewAuditService(db),
+	}
+}
+
+type oauthService struct {
+	OAuthDB
+	audit AuditService
+}
+
+func (oas *oauthService) Connect(user *User, oauth *OAuth, client ClientInfo) error {
+
+	if oauth.Subject != "" {
+		other, err := oas.BySubject(oauth.Service, oauth.Subject)
+		switch err {
+		case nil:
+			if other.UserID != user.ID {
+				return ErrIdentityTaken
+			}
+		case ErrNotFound:
+		default:
+			return err
+		}
+	}
+
+	// Signing in again with a connected account only refreshes its
+	// token, that isn't worth an audit event.
+	reconnect := false
+
+	existing, err := oas.Find(user.ID, oauth.Service)
+	switch err {
+	case nil:
+		reconnect = oauth.Subject != "" &&
+			existing.Subject == oauth.Subject
+		if err := oas.Delete(existing.ID); err != nil {
+			return err
+		}
+	case ErrNotFound:
+	default:
+		return err
+	}
+
+	oauth.UserID = user.ID
+	if err := oas.Create(oauth); err != nil {
+		return err
+	}
+
+	if !reconnect {
+		oas.audit.Log(user, user, AuditOAuthConnected, oauth.Service,
+			client)
+	}
+
+	return nil
 }
 
 type oauthValidator struct {
@@ -76,6 +181,26 @@ func (ov *oauthValidator) Delete(id uint) error {
 	return ov.OAuthDB.Delete(id)
 }
 
+// BySubject never matches an empty subject, which connections made
+// before subjects were recorded all share.
+func (ov *oauthValidator) BySubject(service, subject string) (*OAuth, error) {
+
+	if subject == "" {
+		return nil, ErrNotFound
+	}
+
+	return ov.OAuthDB.BySubject(service, subject)
+}
+
+func (ov *oauthValidator) DeleteByUserID(userID uint) error {
+
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return ov.OAuthDB.DeleteByUserID(userID)
+}
+
 type oauthGorm struct {
 	db *gorm.DB
 }
@@ -94,6 +219,31 @@ func (og *oauthGorm)Find(userID uint, service string) (*OAuth, error) {
 	return &oauth, nil
 }
 
+func (og *oauthGorm) BySubject(service, subject string) (*OAuth, error) {
+
+	var oauth OAuth
+
+	db := og.db.Where("service = ?", service).
+		Where("subject = ?", subject)
+	if err := first(db, &oauth); err != nil {
+		return nil, err
+	}
+
+	return &oauth, nil
+}
+
+func (og *oauthGorm) ByUserID(userID uint) ([]OAuth, error) {
+
+	var oauths []OAuth
+
+	db := og.db.Where("user_id = ?", userID).Order("service")
+	if err := all(db, &oauths); err != nil {
+		return nil, err
+	}
+
+	return oauths, nil
+}
+
 func (og *oauthGorm)Create(oauth *OAuth) error {
 	return og.db.Create(oauth).Error
 }
@@ -104,6 +254,11 @@ func (og *oauthGorm)Delete(id uint) error {
 	return og.db.Unscoped().Delete(&oauth).Error
 }
 
+func (og *oauthGorm) DeleteByUserID(userID uint) error {
+	return og.db.Unscoped().Where("user_id = ?", userID).
+		Delete(&OAuth{}).Error
+}
+
 type oauthValFn func(*OAuth) error
 
 func runOAuthValFns(oauth *OAuth, fns ...oauthValFn) error {
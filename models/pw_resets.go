@@ -28,6 +28,7 @@ type pwResetDB interface {
 	ByToken(token string) (*pwReset, error)
 	Create(pwr *pwReset) error
 	Delete(id uint) error
+	DeleteByUserID(userID uint) error
 }
 
 func (pwrg *pwResetGorm) ByToken(token string) (*pwReset, error) {
@@ -55,6 +56,11 @@ func (pwrg *pwResetGorm) Delete(id uint) error {
 	return pwrg.db.Delete(&pwr).Error
 }
 
+func (pwrg *pwResetGorm) DeleteByUserID(userID uint) error {
+	return pwrg.db.Unscoped().Where("user_id = ?", userID).
+		Delete(&pwReset{}).Error
+}
+
 /////////////////////////////////////////////////////////////////////
 //
 // Validator structures and methods
@@ -124,14 +130,20 @@ func (pwrv *pwResetValidator) hmacToken(pwr *pwReset) error {
 
 func (pwrv *pwResetValidator) ByToken(token string) (*pwReset, error) {
 
-	pwr := pwReset{Token: token}
+	var pwr *pwReset
 
-	err := runPwResetValFns(&pwr, pwrv.hmacToken)
+	// Resets are deleted once used, so there is no point in
+	// rehashing one found under a retired key.
+	_, err := byHash(pwrv.hmac, token, func(tokenHash string) error {
+		var err error
+		pwr, err = pwrv.pwResetDB.ByToken(tokenHash)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return pwrv.pwResetDB.ByToken(pwr.TokenHash)
+	return pwr, nil
 }
 
 func (pwrv *pwResetValidator) Create(pwr *pwReset) error {
@@ -154,3 +166,12 @@ func (pwrv *pwResetValidator) Delete(id uint) error {
 
 	return pwrv.pwResetDB.Delete(id)
 }
+
+func (pwrv *pwResetValidator) DeleteByUserID(userID uint) error {
+
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return pwrv.pwResetDB.DeleteByUserID(userID)
+}
@@ -0,0 +1,238 @@
+package models
+
+import (
+	"encoding/base32"
+	"strings"
+
+	"lenslockedbr.com/hash"
+	"lenslockedbr.com/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// recoveryCodeCount is how many recovery codes a user receives
+	// when enabling two-factor authentication.
+	recoveryCodeCount = 10
+
+	// recoveryCodeBytes is the amount of randomness in each code.
+	// 5 bytes encode to exactly 8 base32 characters.
+	recoveryCodeBytes = 5
+)
+
+/////////////////////////////////////////////////////////////////////
+//
+// Model recoveryCode structures and methods
+//
+/////////////////////////////////////////////////////////////////////
+
+// recoveryCode is a single use code that can replace a TOTP code when
+// the user has lost access to their authenticator app.
+type recoveryCode struct {
+	gorm.Model
+	UserID   uint   `gorm:"not null;index"`
+	Code     string `gorm:"-"`
+	CodeHash string `gorm:"not null;unique_index"`
+}
+
+type recoveryCodeGorm struct {
+	db *gorm.DB
+}
+
+type recoveryCodeDB interface {
+	ByCode(userID uint, code string) (*recoveryCode, error)
+	Create(rc *recoveryCode) error
+
+	// Delete removes the code with the ID if it belongs to the
+	// user, or returns ErrNotFound. Codes are used by deleting
+	// them, so only one of two concurrent uses can succeed.
+	Delete(userID, id uint) error
+
+	DeleteByUserID(userID uint) error
+}
+
+func (rcg *recoveryCodeGorm) ByCode(userID uint, code string) (*recoveryCode, error) {
+
+	var rc recoveryCode
+
+	db := rcg.db.Where("user_id = ?", userID).
+		Where("code_hash = ?", code)
+	err := first(db, &rc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rc, nil
+}
+
+func (rcg *recoveryCodeGorm) Create(rc *recoveryCode) error {
+	return rcg.db.Create(rc).Error
+}
+
+func (rcg *recoveryCodeGorm) Delete(userID, id uint) error {
+
+	db := rcg.db.Unscoped().Where("id = ? AND user_id = ?", id, userID).
+		Delete(&recoveryCode{})
+	if db.Error != nil {
+		return db.Error
+	}
+
+	if db.RowsAffected != 1 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (rcg *recoveryCodeGorm) DeleteByUserID(userID uint) error {
+	return rcg.db.Unscoped().Where("user_id = ?", userID).
+		Delete(&recoveryCode{}).Error
+}
+
+/////////////////////////////////////////////////////////////////////
+//
+// Validator structures and methods
+//
+/////////////////////////////////////////////////////////////////////
+
+type recoveryCodeValFn func(*recoveryCode) error
+
+func runRecoveryCodeValFns(rc *recoveryCode, fns ...recoveryCodeValFn) error {
+
+	for _, fn := range fns {
+		if err := fn(rc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type recoveryCodeValidator struct {
+	recoveryCodeDB
+	hmac hash.HMAC
+}
+
+func newRecoveryCodeValidator(db recoveryCodeDB, hmac hash.HMAC) *recoveryCodeValidator {
+	return &recoveryCodeValidator{
+		recoveryCodeDB: db,
+		hmac:           hmac,
+	}
+}
+
+func (rcv *recoveryCodeValidator) requireUserID(rc *recoveryCode) error {
+
+	if rc.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (rcv *recoveryCodeValidator) setCodeIfUnset(rc *recoveryCode) error {
+
+	if rc.Code != "" {
+		return nil
+	}
+
+	b, err := rand.Bytes(recoveryCodeBytes)
+	if err != nil {
+		return err
+	}
+
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+	rc.Code = code[:4] + "-" + code[4:]
+
+	return nil
+}
+
+// normalizeCode makes the code comparison forgiving about the casing
+// and separators people tend to type.
+func (rcv *recoveryCodeValidator) normalizeCode(rc *recoveryCode) error {
+
+	code := strings.ToLower(rc.Code)
+	code = strings.Replace(code, "-", "", -1)
+	code = strings.Replace(code, " ", "", -1)
+	rc.Code = code
+
+	return nil
+}
+
+func (rcv *recoveryCodeValidator) hmacCode(rc *recoveryCode) error {
+
+	if rc.Code == "" {
+		return nil
+	}
+
+	rc.CodeHash = rcv.hmac.Hash(rc.Code)
+
+	return nil
+}
+
+func (rcv *recoveryCodeValidator) ByCode(userID uint, code string) (*recoveryCode, error) {
+
+	rc := recoveryCode{Code: code}
+
+	err := runRecoveryCodeValFns(&rc, rcv.normalizeCode)
+	if err != nil {
+		return nil, err
+	}
+
+	// Codes are deleted once used, and the unused ones can't be
+	// rehashed since we don't keep them in clear text. Their key
+	// can only be dropped once they have been regenerated.
+	var found *recoveryCode
+	_, err = byHash(rcv.hmac, rc.Code, func(codeHash string) error {
+		var err error
+		found, err = rcv.recoveryCodeDB.ByCode(userID, codeHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+// Create will generate a code if none is set. The plain text code is
+// left in rc.Code so it can be shown to the user once.
+func (rcv *recoveryCodeValidator) Create(rc *recoveryCode) error {
+
+	err := runRecoveryCodeValFns(rc, rcv.requireUserID,
+		rcv.setCodeIfUnset)
+	if err != nil {
+		return err
+	}
+
+	plain := rc.Code
+	err = runRecoveryCodeValFns(rc, rcv.normalizeCode,
+		rcv.hmacCode)
+	if err != nil {
+		return err
+	}
+	rc.Code = plain
+
+	return rcv.recoveryCodeDB.Create(rc)
+}
+
+func (rcv *recoveryCodeValidator) Delete(userID, id uint) error {
+
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	return rcv.recoveryCodeDB.Delete(userID, id)
+}
+
+func (rcv *recoveryCodeValidator) DeleteByUserID(userID uint) error {
+
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return rcv.recoveryCodeDB.DeleteByUserID(userID)
+}
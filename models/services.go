@@ -1,6 +1,12 @@
 package models
 
 import (
+	"log"
+	"time"
+
+	"lenslockedbr.com/hash"
+	"lenslockedbr.com/pwcheck"
+
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 )
@@ -10,11 +16,16 @@ import (
 type ServicesConfig func(*Services) error
 
 type Services struct {
-	User    UserService
-	Gallery GalleryService
-	Image   ImageService
-	OAuth   OAuthService
-	db      *gorm.DB
+	User      UserService
+	Gallery   GalleryService
+	Image     ImageService
+	ShareLink ShareLinkService
+	OAuth     OAuthService
+	Admin     AdminService
+	Audit     AuditService
+	Export    ExportService
+	Import    ImportService
+	db        *gorm.DB
 }
 
 func NewServices(cfgs ...ServicesConfig) (*Services, error) {
@@ -41,14 +52,140 @@ func (s *Services) Close() error {
 
 // Automigrate will attempt to automatically migrate all tables
 func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Gallery{}, 
-                                &OAuth{}, &pwReset{}).Error
+
+	// Storage used to go unaccounted, count it the first time.
+	recount := !s.db.Dialect().HasColumn("users", "storage_used")
+
+	// Images used to only be on disk, add them the first time.
+	backfill := !s.db.HasTable(&Image{})
+
+	err := s.db.AutoMigrate(&User{}, &Gallery{},
+		&OAuth{}, &pwReset{}, &emailVerification{},
+		&recoveryCode{}, &loginChallenge{}, &Session{},
+		&throttle{}, &emailChange{}, &AdminAction{},
+		&loginLink{}, &APIToken{}, &AuditEvent{}, &Export{},
+		&ShareLink{}, &Image{}).Error
+	if err != nil {
+		return err
+	}
+
+	// Remember tokens used to be stored in the users table, a
+	// single one per user, before sessions were introduced.
+	if s.db.Dialect().HasColumn("users", "remember_hash") {
+		err = s.db.Model(&User{}).DropColumn("remember_hash").Error
+		if err != nil {
+			return err
+		}
+	}
+
+	// Handles are optional, so only the non empty ones have to be
+	// unique. gorm tags can't describe a partial index.
+	err = s.db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS " +
+		"uix_users_handle ON users (handle) " +
+		"WHERE handle <> ''").Error
+	if err != nil {
+		return err
+	}
+
+	// Likewise, an account of a provider can only be connected to
+	// a single user, but older connections have no subject.
+	err = s.db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS " +
+		"uix_o_auths_service_subject ON o_auths (service, subject) " +
+		"WHERE subject <> ''").Error
+	if err != nil {
+		return err
+	}
+
+	// Only unlisted galleries have a slug.
+	err = s.db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS " +
+		"uix_galleries_slug ON galleries (slug) " +
+		"WHERE slug <> ''").Error
+	if err != nil {
+		return err
+	}
+
+	if backfill {
+		n, err := s.Image.Backfill()
+		if err != nil {
+			return err
+		}
+		log.Printf("models: backfilled %d images\n", n)
+		return nil
+	}
+
+	// Backfilling recounts storage already.
+	if recount {
+		return s.Image.Recount()
+	}
+
+	return nil
+}
+
+// PurgeDeletedUsers permanently deletes every account whose deletion
+// was scheduled more than DeletionGracePeriod ago.
+func (s *Services) PurgeDeletedUsers() error {
+
+	before := time.Now().Add(-DeletionGracePeriod)
+	users, err := s.User.DeletionScheduledBefore(before)
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if err := s.PurgeUser(user.ID); err != nil {
+			return err
+		}
+		log.Printf("models: purged user %d\n", user.ID)
+	}
+
+	return nil
+}
+
+// PurgeUser permanently deletes the user and everything they own:
+// their galleries with their share links and the images stored for
+// them, their OAuth connections, their exports and finally their
+// account.
+func (s *Services) PurgeUser(userID uint) error {
+
+	if err := s.Export.DeleteByUserID(userID); err != nil {
+		return err
+	}
+
+	galleries, err := s.Gallery.ByUserID(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, gallery := range galleries {
+		if err := s.ShareLink.DeleteByGalleryID(gallery.ID); err != nil {
+			return err
+		}
+		if err := s.Image.DeleteAll(&gallery); err != nil {
+			return err
+		}
+	}
+
+	err = s.Gallery.DeleteByUserID(userID)
+	if err != nil {
+		return err
+	}
+
+	err = s.OAuth.DeleteByUserID(userID)
+	if err != nil {
+		return err
+	}
+
+	return s.User.Purge(userID)
 }
 
 // DestructiveReset drops all tables and rebuilds them
 func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&User{}, &Gallery{}, 
-                                      &OAuth{}, &pwReset{}).Error
+	err := s.db.DropTableIfExists(&User{}, &Gallery{},
+		&OAuth{}, &pwReset{}, &emailVerification{},
+		&recoveryCode{}, &loginChallenge{}, &Session{},
+		&throttle{}, &emailChange{}, &AdminAction{},
+		&loginLink{}, &APIToken{}, &AuditEvent{}, &Export{},
+		&ShareLink{}, &Image{}).Error
 	if err != nil {
 		return err
 	}
@@ -76,23 +213,67 @@ func WithLogMode(mode bool) ServicesConfig {
 	}
 }
 
-func WithUser(pepper, hmacKey string) ServicesConfig {
+func WithUser(pw hash.Password, hmac hash.HMAC,
+	policy pwcheck.Policy) ServicesConfig {
+	return func(s *Services) error {
+		s.User = NewUserService(s.db, pw, hmac, policy)
+		return nil
+	}
+}
+
+// WithGallery sets up the gallery service, which hashes the
+// passwords of galleries like the ones of users.
+func WithGallery(pw hash.Password, hmac hash.HMAC) ServicesConfig {
+	return func(s *Services) error {
+		s.Gallery = NewGalleryService(s.db, pw, hmac)
+		return nil
+	}
+}
+
+// WithImage sets up the image service. defaultQuota is the number of
+// bytes each user can store, DefaultStorageQuota when zero.
+func WithImage(defaultQuota int64) ServicesConfig {
+	return func(s *Services) error {
+		s.Image = NewImageService(s.db, defaultQuota)
+		return nil
+	}
+}
+
+func WithAdmin() ServicesConfig {
+	return func(s *Services) error {
+		s.Admin = NewAdminService(s.db)
+		return nil
+	}
+}
+
+func WithAudit() ServicesConfig {
+	return func(s *Services) error {
+		s.Audit = NewAuditService(s.db)
+		return nil
+	}
+}
+
+// WithExport must come after the gallery, image, OAuth and audit
+// services, which it gathers the data of users from.
+func WithExport(hmac hash.HMAC) ServicesConfig {
 	return func(s *Services) error {
-		s.User = NewUserService(s.db, pepper, hmacKey)
+		s.Export = NewExportService(s.db, hmac, s.Gallery, s.Image,
+			s.OAuth, s.Audit)
 		return nil
 	}
 }
 
-func WithGallery() ServicesConfig {
+func WithShareLink(hmac hash.HMAC) ServicesConfig {
 	return func(s *Services) error {
-		s.Gallery = NewGalleryService(s.db)
+		s.ShareLink = NewShareLinkService(s.db, hmac)
 		return nil
 	}
 }
 
-func WithImage() ServicesConfig {
+// WithImport must come after the gallery, image and user services.
+func WithImport() ServicesConfig {
 	return func(s *Services) error {
-		s.Image = NewImageService()
+		s.Import = NewImportService(s.Gallery, s.Image, s.User)
 		return nil
 	}
 }
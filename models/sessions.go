@@ -0,0 +1,296 @@
+package models
+
+import (
+	"time"
+
+	"lenslockedbr.com/hash"
+	"lenslockedbr.com/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// sessionDuration is how long a session stays valid without
+	// being used. Every use pushes the expiration forward.
+	sessionDuration = 30 * 24 * time.Hour
+
+	// sessionTouchInterval avoids writing to the database on every
+	// single request just to record that a session is still in use.
+	sessionTouchInterval = 5 * time.Minute
+)
+
+// ClientInfo describes the browser or device a request came from.
+type ClientInfo struct {
+	IP        string
+	UserAgent string
+}
+
+/////////////////////////////////////////////////////////////////////
+//
+// Model Session structures and methods
+//
+/////////////////////////////////////////////////////////////////////
+
+// Session represents a single signed in browser or device. Each
+// session has its own remember token, so a user can be logged in on
+// several devices and sign out of each of them individually.
+type Session struct {
+	gorm.Model
+	UserID     uint   `gorm:"not null;index"`
+	Token      string `gorm:"-"`
+	TokenHash  string `gorm:"not null;unique_index"`
+	UserAgent  string
+	IP         string
+	LastSeenAt time.Time
+	ExpiresAt  time.Time `gorm:"not null"`
+
+	// ImpersonatingID is the user an admin is currently acting as
+	// for support, see UserService.Impersonate.
+	ImpersonatingID uint
+}
+
+// Expired reports whether the session can no longer be used.
+func (s *Session) Expired() bool {
+	return time.Now().After(s.ExpiresAt)
+}
+
+type sessionGorm struct {
+	db *gorm.DB
+}
+
+type sessionDB interface {
+	ByToken(token string) (*Session, error)
+	ByUserID(userID uint) ([]Session, error)
+	Create(s *Session) error
+	Update(s *Session) error
+	Delete(id uint) error
+	DeleteByUserID(userID, exceptID uint) error
+}
+
+func (sg *sessionGorm) ByToken(token string) (*Session, error) {
+
+	var s Session
+
+	err := first(sg.db.Where("token_hash = ?", token), &s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (sg *sessionGorm) ByUserID(userID uint) ([]Session, error) {
+
+	var sessions []Session
+
+	db := sg.db.Where("user_id = ?", userID).
+		Where("expires_at > ?", time.Now()).
+		Order("last_seen_at desc")
+	if err := all(db, &sessions); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (sg *sessionGorm) Create(s *Session) error {
+	return sg.db.Create(s).Error
+}
+
+func (sg *sessionGorm) Update(s *Session) error {
+	return sg.db.Save(s).Error
+}
+
+func (sg *sessionGorm) Delete(id uint) error {
+
+	s := Session{
+		Model: gorm.Model{ID: id},
+	}
+
+	return sg.db.Unscoped().Delete(&s).Error
+}
+
+// DeleteByUserID deletes every session of the user except the one
+// with exceptID. Pass 0 to delete all of them.
+func (sg *sessionGorm) DeleteByUserID(userID, exceptID uint) error {
+	return sg.db.Unscoped().Where("user_id = ?", userID).
+		Where("id <> ?", exceptID).
+		Delete(&Session{}).Error
+}
+
+/////////////////////////////////////////////////////////////////////
+//
+// Validator structures and methods
+//
+/////////////////////////////////////////////////////////////////////
+
+type sessionValFn func(*Session) error
+
+func runSessionValFns(s *Session, fns ...sessionValFn) error {
+
+	for _, fn := range fns {
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type sessionValidator struct {
+	sessionDB
+	hmac hash.HMAC
+}
+
+func newSessionValidator(db sessionDB, hmac hash.HMAC) *sessionValidator {
+	return &sessionValidator{
+		sessionDB: db,
+		hmac:      hmac,
+	}
+}
+
+func (sv *sessionValidator) requireUserID(s *Session) error {
+
+	if s.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (sv *sessionValidator) setTokenIfUnset(s *Session) error {
+
+	if s.Token != "" {
+		return nil
+	}
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+
+	s.Token = token
+
+	return nil
+}
+
+func (sv *sessionValidator) tokenMinBytes(s *Session) error {
+
+	if s.Token == "" {
+		return nil
+	}
+
+	n, err := rand.NBytes(s.Token)
+	if err != nil {
+		return err
+	}
+
+	if n < 32 {
+		return ErrRememberTooShort
+	}
+
+	return nil
+}
+
+func (sv *sessionValidator) hmacToken(s *Session) error {
+
+	if s.Token == "" {
+		return nil
+	}
+
+	s.TokenHash = sv.hmac.Hash(s.Token)
+
+	return nil
+}
+
+func (sv *sessionValidator) tokenHashRequired(s *Session) error {
+
+	if s.TokenHash == "" {
+		return ErrRememberRequired
+	}
+
+	return nil
+}
+
+func (sv *sessionValidator) setTimesIfUnset(s *Session) error {
+
+	now := time.Now()
+	if s.LastSeenAt.IsZero() {
+		s.LastSeenAt = now
+	}
+
+	if s.ExpiresAt.IsZero() {
+		s.ExpiresAt = now.Add(sessionDuration)
+	}
+
+	return nil
+}
+
+func (sv *sessionValidator) ByToken(token string) (*Session, error) {
+
+	var s *Session
+
+	rehash, err := byHash(sv.hmac, token, func(tokenHash string) error {
+		var err error
+		s, err = sv.sessionDB.ByToken(tokenHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Sessions last for weeks, so move this one over to the primary
+	// key now instead of waiting for the retired key to be dropped.
+	if rehash {
+		s.TokenHash = sv.hmac.Hash(token)
+		if err := sv.sessionDB.Update(s); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (sv *sessionValidator) Create(s *Session) error {
+
+	err := runSessionValFns(s, sv.requireUserID,
+		sv.setTokenIfUnset,
+		sv.tokenMinBytes,
+		sv.hmacToken,
+		sv.tokenHashRequired,
+		sv.setTimesIfUnset)
+	if err != nil {
+		return err
+	}
+
+	return sv.sessionDB.Create(s)
+}
+
+func (sv *sessionValidator) Update(s *Session) error {
+
+	err := runSessionValFns(s, sv.requireUserID,
+		sv.tokenHashRequired)
+	if err != nil {
+		return err
+	}
+
+	return sv.sessionDB.Update(s)
+}
+
+func (sv *sessionValidator) Delete(id uint) error {
+
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	return sv.sessionDB.Delete(id)
+}
+
+func (sv *sessionValidator) DeleteByUserID(userID, exceptID uint) error {
+
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return sv.sessionDB.DeleteByUserID(userID, exceptID)
+}
@@ -0,0 +1,361 @@
+package models
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"lenslockedbr.com/hash"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// MaxShareLinkDays is the longest a share link can work for.
+	MaxShareLinkDays = 365
+
+	maxShareLinkLabelLen = 100
+)
+
+var (
+	// ErrShareLinkExpired is returned when looking up a share link
+	// past its expiration date.
+	ErrShareLinkExpired modelError = "models: this link has expired, " +
+		"ask for a new one"
+
+	// ErrShareLinkDaysInvalid is returned when creating a share link
+	// that works for less than a day or more than MaxShareLinkDays.
+	ErrShareLinkDaysInvalid modelError = "models: share links must " +
+		"work for 1 to 365 days"
+
+	// ErrShareLinkLabelTooLong is returned when the label of a share
+	// link is longer than maxShareLinkLabelLen characters.
+	ErrShareLinkLabelTooLong modelError = "models: labels must be at " +
+		"most 100 characters long"
+
+	ErrGalleryIDRequired modelError = "models: gallery ID is required"
+)
+
+/////////////////////////////////////////////////////////////////////
+//
+// Model ShareLink structures and methods
+//
+/////////////////////////////////////////////////////////////////////
+
+// ShareLink lets anyone with its URL see a gallery until it expires
+// or its owner revokes it, whatever the visibility and password of
+// the gallery. Label is for the owner to remember who they sent it
+// to, and Views counts how many times the gallery was seen with it.
+//
+// Days is how long a new link works for, from which ExpiresAt is set
+// on creation. Token is the signed part of the URL, set by the
+// ShareLinkService.
+type ShareLink struct {
+	gorm.Model
+	GalleryID     uint   `gorm:"not null;index"`
+	Label         string `gorm:"not null"`
+	Days          int    `gorm:"-"`
+	ExpiresAt     time.Time
+	AllowDownload bool   `gorm:"not null;default:false"`
+	Views         int64  `gorm:"not null;default:0"`
+	Token         string `gorm:"-"`
+}
+
+// Path is where the gallery can be seen through the link.
+func (l *ShareLink) Path() string {
+	return "/s/" + l.Token
+}
+
+func (l *ShareLink) Expired() bool {
+	return time.Now().After(l.ExpiresAt)
+}
+
+// shareLinkDB is used to interact with the share_links table.
+type shareLinkDB interface {
+	ByID(id uint) (*ShareLink, error)
+
+	// ByGalleryID returns the links of the gallery, most recent
+	// first.
+	ByGalleryID(galleryID uint) ([]ShareLink, error)
+
+	Create(link *ShareLink) error
+
+	// Delete removes the link with the ID if it belongs to the
+	// gallery, or returns ErrNotFound.
+	Delete(galleryID, id uint) error
+
+	DeleteByGalleryID(galleryID uint) error
+
+	// AddView adds one to the views of the link.
+	AddView(id uint) error
+}
+
+// ShareLinkService manages the links owners send to let others see
+// a gallery for a while. Their URLs are signed with the HMAC key, so
+// they can't be guessed from the IDs they contain.
+type ShareLinkService interface {
+	// Create saves the link and sets its Token.
+	Create(link *ShareLink) error
+
+	// ByGalleryID returns the links of the gallery with their
+	// Token set, expired ones included.
+	ByGalleryID(galleryID uint) ([]ShareLink, error)
+
+	// ByToken returns the link the token was signed for. It
+	// returns ErrNotFound when the signature is wrong or the link
+	// was revoked, and ErrShareLinkExpired once it expired.
+	ByToken(token string) (*ShareLink, error)
+
+	// Viewed counts a view of the gallery through the link.
+	Viewed(link *ShareLink) error
+
+	// Revoke deletes the link with the ID if it belongs to the
+	// gallery, so that it stops working right away.
+	Revoke(galleryID, id uint) error
+
+	DeleteByGalleryID(galleryID uint) error
+}
+
+func NewShareLinkService(db *gorm.DB, hmac hash.HMAC) ShareLinkService {
+	return &shareLinkService{
+		shareLinkDB: &shareLinkValidator{&shareLinkGorm{db}},
+		hmac:        hmac,
+	}
+}
+
+type shareLinkService struct {
+	shareLinkDB
+	hmac hash.HMAC
+}
+
+func (ss *shareLinkService) Create(link *ShareLink) error {
+
+	if err := ss.shareLinkDB.Create(link); err != nil {
+		return err
+	}
+
+	ss.sign(link)
+
+	return nil
+}
+
+func (ss *shareLinkService) ByGalleryID(galleryID uint) ([]ShareLink, error) {
+
+	links, err := ss.shareLinkDB.ByGalleryID(galleryID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range links {
+		ss.sign(&links[i])
+	}
+
+	return links, nil
+}
+
+func (ss *shareLinkService) ByToken(token string) (*ShareLink, error) {
+
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, ErrNotFound
+	}
+
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	link, err := ss.shareLinkDB.ByID(uint(id))
+	if err != nil {
+		return nil, err
+	}
+
+	valid := false
+	for _, h := range ss.hmac.Hashes(shareLinkInput(link)) {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(parts[1])) == 1 {
+			valid = true
+		}
+	}
+	if !valid {
+		return nil, ErrNotFound
+	}
+
+	if link.Expired() {
+		return nil, ErrShareLinkExpired
+	}
+
+	link.Token = token
+
+	return link, nil
+}
+
+func (ss *shareLinkService) Viewed(link *ShareLink) error {
+
+	if err := ss.shareLinkDB.AddView(link.ID); err != nil {
+		return err
+	}
+
+	link.Views++
+
+	return nil
+}
+
+func (ss *shareLinkService) Revoke(galleryID, id uint) error {
+	return ss.shareLinkDB.Delete(galleryID, id)
+}
+
+// sign sets the token of the link with the primary key. Links sent
+// before a key rotation keep working as long as the retired key is
+// configured.
+func (ss *shareLinkService) sign(link *ShareLink) {
+	link.Token = fmt.Sprintf("%d.%s", link.ID,
+		ss.hmac.Hash(shareLinkInput(link)))
+}
+
+// shareLinkInput is what the tokens of share links sign. Including
+// the creation time means a link can't be confused with another one
+// that got the same ID after a database reset.
+func shareLinkInput(link *ShareLink) string {
+	return fmt.Sprintf("share-link:%d:%d:%d", link.ID, link.GalleryID,
+		link.CreatedAt.Unix())
+}
+
+//
+// Gorm
+//
+
+type shareLinkGorm struct {
+	db *gorm.DB
+}
+
+func (sg *shareLinkGorm) ByID(id uint) (*ShareLink, error) {
+
+	var link ShareLink
+
+	if err := first(sg.db.Where("id = ?", id), &link); err != nil {
+		return nil, err
+	}
+
+	return &link, nil
+}
+
+func (sg *shareLinkGorm) ByGalleryID(galleryID uint) ([]ShareLink, error) {
+
+	var links []ShareLink
+
+	db := sg.db.Where("gallery_id = ?", galleryID).
+		Order("created_at desc")
+	if err := all(db, &links); err != nil {
+		return nil, err
+	}
+
+	return links, nil
+}
+
+func (sg *shareLinkGorm) Create(link *ShareLink) error {
+	return sg.db.Create(link).Error
+}
+
+func (sg *shareLinkGorm) Delete(galleryID, id uint) error {
+
+	db := sg.db.Unscoped().Where("gallery_id = ? AND id = ?",
+		galleryID, id).Delete(&ShareLink{})
+	if db.Error != nil {
+		return db.Error
+	}
+
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (sg *shareLinkGorm) DeleteByGalleryID(galleryID uint) error {
+	return sg.db.Unscoped().Where("gallery_id = ?", galleryID).
+		Delete(&ShareLink{}).Error
+}
+
+func (sg *shareLinkGorm) AddView(id uint) error {
+	return sg.db.Model(&ShareLink{}).Where("id = ?", id).
+		UpdateColumn("views", gorm.Expr("views + 1")).Error
+}
+
+//
+// Validator
+//
+
+type shareLinkValFn func(*ShareLink) error
+
+func runShareLinkValFns(link *ShareLink, fns ...shareLinkValFn) error {
+
+	for _, fn := range fns {
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type shareLinkValidator struct {
+	shareLinkDB
+}
+
+func (sv *shareLinkValidator) requireGalleryID(link *ShareLink) error {
+
+	if link.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+
+	return nil
+}
+
+func (sv *shareLinkValidator) normalizeLabel(link *ShareLink) error {
+	link.Label = strings.TrimSpace(link.Label)
+	return nil
+}
+
+func (sv *shareLinkValidator) labelMaxLength(link *ShareLink) error {
+
+	if len([]rune(link.Label)) > maxShareLinkLabelLen {
+		return ErrShareLinkLabelTooLong
+	}
+
+	return nil
+}
+
+func (sv *shareLinkValidator) setExpiresAt(link *ShareLink) error {
+
+	if link.Days < 1 || link.Days > MaxShareLinkDays {
+		return ErrShareLinkDaysInvalid
+	}
+
+	link.ExpiresAt = time.Now().AddDate(0, 0, link.Days)
+
+	return nil
+}
+
+func (sv *shareLinkValidator) Create(link *ShareLink) error {
+
+	err := runShareLinkValFns(link, sv.requireGalleryID,
+		sv.normalizeLabel,
+		sv.labelMaxLength,
+		sv.setExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	return sv.shareLinkDB.Create(link)
+}
+
+func (sv *shareLinkValidator) Delete(galleryID, id uint) error {
+
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	return sv.shareLinkDB.Delete(galleryID, id)
+}
@@ -0,0 +1,120 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// DefaultStorageQuota is the number of bytes of images each user can
+// store, unless configured otherwise.
+const DefaultStorageQuota int64 = 1 << 30 // 1 gigabyte
+
+var (
+	// ErrStorageQuotaExceeded is returned when storing an image would
+	// take a user over their storage quota.
+	ErrStorageQuotaExceeded modelError = "models: there is not enough " +
+		"room left in your storage for this upload. Delete some " +
+		"images first"
+
+	// ErrStorageQuotaInvalid is returned when a user is given a
+	// negative storage quota.
+	ErrStorageQuotaInvalid modelError = "models: storage quota can't " +
+		"be negative"
+)
+
+// Storage describes how much of their quota the images of a user
+// take, in bytes.
+type Storage struct {
+	Used  int64
+	Quota int64
+}
+
+// Remaining returns the number of bytes the user can still store.
+func (s *Storage) Remaining() int64 {
+	if s.Used >= s.Quota {
+		return 0
+	}
+
+	return s.Quota - s.Used
+}
+
+// Percent returns the share of the quota used, between 0 and 100.
+func (s *Storage) Percent() int {
+	if s.Quota <= 0 || s.Used >= s.Quota {
+		return 100
+	}
+
+	return int(s.Used * 100 / s.Quota)
+}
+
+// storageDB keeps track of the bytes used by the images of each
+// user. Usage is stored along with the users, but never through
+// UserDB.Update, so that a stale user can't overwrite it.
+type storageDB interface {
+	// ByUserID returns the storage of the user, with a zero Quota
+	// if they use the default one.
+	ByUserID(userID uint) (*Storage, error)
+
+	// Reserve adds n bytes to the usage of the user, unless that
+	// takes them over their quota, in which case it returns
+	// ErrStorageQuotaExceeded. defaultQuota applies to users without
+	// a quota of their own.
+	Reserve(userID uint, n, defaultQuota int64) error
+
+	// Release removes n bytes from the usage of the user.
+	Release(userID uint, n int64) error
+
+	// Set overwrites the usage of the user, once it was counted
+	// from the images on disk.
+	Set(userID uint, used int64) error
+}
+
+type storageGorm struct {
+	db *gorm.DB
+}
+
+func (sg *storageGorm) ByUserID(userID uint) (*Storage, error) {
+
+	var user User
+
+	db := sg.db.Select("storage_used, storage_quota").
+		Where("id = ?", userID)
+	if err := first(db, &user); err != nil {
+		return nil, err
+	}
+
+	return &Storage{
+		Used:  user.StorageUsed,
+		Quota: user.StorageQuota,
+	}, nil
+}
+
+func (sg *storageGorm) Reserve(userID uint, n, defaultQuota int64) error {
+
+	// Check and update in a single statement, so that concurrent
+	// uploads can't both squeeze into the last bytes of the quota.
+	db := sg.db.Model(&User{}).
+		Where("id = ? AND storage_used + ? <= "+
+			"COALESCE(NULLIF(storage_quota, 0), ?)",
+			userID, n, defaultQuota).
+		UpdateColumn("storage_used", gorm.Expr("storage_used + ?", n))
+	if db.Error != nil {
+		return db.Error
+	}
+
+	if db.RowsAffected == 0 {
+		return ErrStorageQuotaExceeded
+	}
+
+	return nil
+}
+
+func (sg *storageGorm) Release(userID uint, n int64) error {
+	return sg.db.Model(&User{}).Where("id = ?", userID).
+		UpdateColumn("storage_used",
+			gorm.Expr("GREATEST(storage_used - ?, 0)", n)).Error
+}
+
+func (sg *storageGorm) Set(userID uint, used int64) error {
+	return sg.db.Model(&User{}).Where("id = ?", userID).
+		UpdateColumn("storage_used", used).Error
+}
@@ -0,0 +1,208 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// throttlePolicy describes how many attempts are allowed for a key
+// and for how long the key is locked out once they are used up.
+type throttlePolicy struct {
+	// Free is the number of attempts allowed before locking.
+	Free int
+
+	// Lockout is how long the first lockout lasts. It doubles with
+	// every attempt made after that, up to Max.
+	Lockout time.Duration
+	Max     time.Duration
+
+	// Window is how long it takes for past attempts to be
+	// forgotten when the key isn't locked.
+	Window time.Duration
+}
+
+var (
+	loginEmailPolicy = throttlePolicy{
+		Free:    5,
+		Lockout: time.Minute,
+		Max:     time.Hour,
+		Window:  time.Hour,
+	}
+
+	loginIPPolicy = throttlePolicy{
+		Free:    20,
+		Lockout: time.Minute,
+		Max:     time.Hour,
+		Window:  time.Hour,
+	}
+
+	resetEmailPolicy = throttlePolicy{
+		Free:    3,
+		Lockout: 15 * time.Minute,
+		Max:     24 * time.Hour,
+		Window:  time.Hour,
+	}
+
+	resetIPPolicy = throttlePolicy{
+		Free:    10,
+		Lockout: 15 * time.Minute,
+		Max:     24 * time.Hour,
+		Window:  time.Hour,
+	}
+
+	// A gallery password is shared by every visitor of the
+	// gallery, who may well be behind the same address, so it
+	// allows more attempts than the password of a user.
+	galleryPolicy = throttlePolicy{
+		Free:    20,
+		Lockout: time.Minute,
+		Max:     time.Hour,
+		Window:  time.Hour,
+	}
+)
+
+/////////////////////////////////////////////////////////////////////
+//
+// Model throttle structures and methods
+//
+/////////////////////////////////////////////////////////////////////
+
+// throttle counts the recent attempts made for a key, like the email
+// address or the IP address used to log in. UpdatedAt is the time of
+// the last attempt.
+type throttle struct {
+	gorm.Model
+	Key         string `gorm:"not null;unique_index"`
+	Attempts    int    `gorm:"not null"`
+	LockedUntil *time.Time
+}
+
+// Locked reports whether the key is currently locked out.
+func (t *throttle) Locked() bool {
+	return t.LockedUntil != nil && time.Now().Before(*t.LockedUntil)
+}
+
+type throttleGorm struct {
+	db *gorm.DB
+}
+
+type throttleDB interface {
+	ByKey(key string) (*throttle, error)
+	Create(t *throttle) error
+	Update(t *throttle) error
+	Delete(id uint) error
+}
+
+func (tg *throttleGorm) ByKey(key string) (*throttle, error) {
+
+	var t throttle
+
+	err := first(tg.db.Where("key = ?", key), &t)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func (tg *throttleGorm) Create(t *throttle) error {
+	return tg.db.Create(t).Error
+}
+
+func (tg *throttleGorm) Update(t *throttle) error {
+	return tg.db.Save(t).Error
+}
+
+func (tg *throttleGorm) Delete(id uint) error {
+
+	t := throttle{
+		Model: gorm.Model{ID: id},
+	}
+
+	return tg.db.Unscoped().Delete(&t).Error
+}
+
+/////////////////////////////////////////////////////////////////////
+//
+// Throttler
+//
+/////////////////////////////////////////////////////////////////////
+
+// throttler applies throttle policies on top of a throttleDB.
+type throttler struct {
+	throttleDB
+}
+
+// check returns ErrTooManyAttempts if the key is locked out.
+func (t *throttler) check(key string) error {
+
+	th, err := t.ByKey(key)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		return nil
+	default:
+		return err
+	}
+
+	if th.Locked() {
+		return ErrTooManyAttempts
+	}
+
+	return nil
+}
+
+// hit records an attempt for the key, locking it out with an
+// exponential backoff once the policy's free attempts are used up.
+func (t *throttler) hit(key string, p throttlePolicy) error {
+
+	th, err := t.ByKey(key)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		th = &throttle{Key: key}
+	default:
+		return err
+	}
+
+	now := time.Now()
+	if !th.Locked() && now.Sub(th.UpdatedAt) > p.Window {
+		th.Attempts = 0
+		th.LockedUntil = nil
+	}
+
+	th.Attempts++
+	if extra := th.Attempts - p.Free; extra > 0 {
+		lockout := p.Max
+		if extra < 32 {
+			lockout = p.Lockout << uint(extra-1)
+		}
+		if lockout > p.Max || lockout <= 0 {
+			lockout = p.Max
+		}
+		lockedUntil := now.Add(lockout)
+		th.LockedUntil = &lockedUntil
+	}
+
+	if th.ID == 0 {
+		return t.Create(th)
+	}
+
+	return t.Update(th)
+}
+
+// reset forgets every attempt made for the key.
+func (t *throttler) reset(key string) error {
+
+	th, err := t.ByKey(key)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		return nil
+	default:
+		return err
+	}
+
+	return t.Delete(th.ID)
+}
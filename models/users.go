@@ -1,16 +1,46 @@
 package models
 
 import (
+	"fmt"
+	"log"
+	"net/url"
 	"regexp"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
-	"golang.org/x/crypto/bcrypt"
 
 	"lenslockedbr.com/hash"
-	"lenslockedbr.com/rand"
+	"lenslockedbr.com/pwcheck"
+	"lenslockedbr.com/totp"
+)
+
+const (
+	// totpIssuer is the name authenticator apps display next to
+	// the codes they generate for us.
+	totpIssuer = "LensLockedBR"
+
+	// maxTwoFactorAttempts is the number of wrong codes accepted
+	// for a single login before the user must log in again.
+	maxTwoFactorAttempts = 5
+
+	// DeletionGracePeriod is how long an account scheduled for
+	// deletion can still be restored before it is purged.
+	DeletionGracePeriod = 14 * 24 * time.Hour
+
+	// loginLinkDuration is how long an emailed sign-in link can be
+	// used for.
+	loginLinkDuration = 15 * time.Minute
+
+	// ReauthWindow is how recently users without a password must
+	// have logged in to change their email, password or delete
+	// their account.
+	ReauthWindow = 10 * time.Minute
+
+	maxDisplayNameLen = 50
+	maxBioLen         = 1000
 )
 
 var (
@@ -45,12 +75,28 @@ var (
 	ErrPasswordTooShort modelError = "models: password must be at" +
 		" least 8 characters long"
 
+	// ErrPasswordBreached is returned when a user tries to set a
+	// password that appeared in a known data breach.
+	ErrPasswordBreached modelError = "models: this password has " +
+		"appeared in a data breach, please choose another one"
+
+	// ErrPasswordTooWeak is returned when a user tries to set a
+	// password that is too easy to guess.
+	ErrPasswordTooWeak modelError = "models: password is too easy " +
+		"to guess, try a longer one or a few unrelated words"
+
 	// ErrPasswordRequired is returned when a create is attempted
 	// without a user password provided.
 	ErrPasswordRequired modelError = "models: password is required"
 
-	// ErrRememberRequired is returned when a create or update is
-	// attempted without a user remember token hash
+	// ErrReauthRequired is returned when a user without a password
+	// attempts a sensitive change more than ReauthWindow after
+	// logging in.
+	ErrReauthRequired modelError = "models: please log in again " +
+		"to confirm it's you, then try again within 10 minutes"
+
+	// ErrRememberRequired is returned when a session create or
+	// update is attempted without a remember token hash
 	ErrRememberRequired modelError = "models: remember token " +
 		" is required"
 
@@ -61,6 +107,71 @@ var (
 
 	ErrTokenInvalid modelError = "models: token provided is not valid"
 
+	// ErrTooManyAttempts is returned when too many attempts to log
+	// in or to reset a password were made in a short period of time.
+	ErrTooManyAttempts modelError = "models: too many attempts, " +
+		"please wait a few minutes and try again"
+
+	// ErrAccountDisabled is returned when a disabled user attempts
+	// to log in.
+	ErrAccountDisabled modelError = "models: this account has been " +
+		"disabled, please contact support"
+
+	// ErrCannotImpersonate is returned when an admin attempts to
+	// impersonate themselves or another admin.
+	ErrCannotImpersonate modelError = "models: this user cannot be " +
+		"impersonated"
+
+	// ErrHandleInvalid is returned when a handle doesn't match our
+	// requirements.
+	ErrHandleInvalid modelError = "models: handle must be 3 to 30 " +
+		"characters long and may only contain letters, numbers, " +
+		"dashes and underscores"
+
+	// ErrHandleTaken is returned when an update is attempted with a
+	// handle that is already in use.
+	ErrHandleTaken modelError = "models: handle is already taken"
+
+	// ErrWebsiteInvalid is returned when the website of a profile
+	// isn't a valid http or https URL.
+	ErrWebsiteInvalid modelError = "models: website is not a valid URL"
+
+	// ErrDisplayNameTooLong is returned when a display name is
+	// longer than maxDisplayNameLen characters.
+	ErrDisplayNameTooLong modelError = "models: display name must " +
+		"be at most 50 characters long"
+
+	// ErrBioTooLong is returned when a bio is longer than
+	// maxBioLen characters.
+	ErrBioTooLong modelError = "models: bio must be at most 1000 " +
+		"characters long"
+
+	// ErrEmailUnchanged is returned when a user attempts to change
+	// their email address to the one they already use.
+	ErrEmailUnchanged modelError = "models: that is already your " +
+		"email address"
+
+	// ErrEmailNotVerified is returned when a user attempts an action
+	// that requires a confirmed email address before confirming it.
+	ErrEmailNotVerified modelError = "models: please verify your " +
+		"email address first"
+
+	// ErrTwoFactorCodeInvalid is returned when a TOTP or recovery
+	// code provided does not match the user's second factor.
+	ErrTwoFactorCodeInvalid modelError = "models: two-factor code " +
+		"is not valid"
+
+	// ErrTwoFactorEnabled is returned when a user attempts to
+	// enroll a new authenticator while two-factor authentication
+	// is already enabled.
+	ErrTwoFactorEnabled modelError = "models: two-factor " +
+		"authentication is already enabled"
+
+	// ErrTwoFactorNotEnrolled is returned when a two-factor code is
+	// confirmed without enrolling an authenticator first.
+	ErrTwoFactorNotEnrolled modelError = "models: two-factor " +
+		"authentication has not been set up"
+
 	_ UserDB      = &userGorm{}
 	_ UserService = &userService{}
 )
@@ -72,8 +183,111 @@ type User struct {
 	Email        string `gorm:"not null;unique_index"`
 	Password     string `gorm:"-"`
 	PasswordHash string `gorm:"not null"`
-	Remember     string `gorm:"-"`
-	RememberHash string `gorm:"not nill;unique_index"`
+
+	EmailVerifiedAt *time.Time
+
+	TOTPSecret    string
+	TOTPEnabledAt *time.Time
+
+	// TOTPLastCounter is the time step of the last TOTP code used,
+	// so that a code can't be used twice.
+	TOTPLastCounter int64 `gorm:"not null;default:0"`
+
+	DeletionScheduledAt *time.Time
+
+	IsAdmin    bool `gorm:"not null;default:false"`
+	DisabledAt *time.Time
+
+	// Public profile. The handle is optional, users without one
+	// don't have a profile page. Uniqueness of non empty handles is
+	// enforced by an index created in Services.AutoMigrate.
+	Handle          string
+	DisplayName     string
+	Bio             string `gorm:"type:text"`
+	Website         string
+	AvatarGalleryID uint
+	AvatarFilename  string
+
+	// Bytes taken by the images of the user, and how many they can
+	// store. A zero quota stands for the default one. StorageUsed is
+	// only ever changed by the ImageService.
+	StorageUsed  int64 `gorm:"not null;default:0"`
+	StorageQuota int64 `gorm:"not null;default:0"`
+}
+
+// PublicName is the name shown to other users.
+func (u *User) PublicName() string {
+	switch {
+	case u.DisplayName != "":
+		return u.DisplayName
+	case u.Name != "":
+		return u.Name
+	default:
+		return u.Handle
+	}
+}
+
+// ProfilePath returns the path of the user's public profile page, or
+// an empty string if they didn't pick a handle.
+func (u *User) ProfilePath() string {
+	if u.Handle == "" {
+		return ""
+	}
+
+	return "/u/" + u.Handle
+}
+
+// Avatar returns the image picked as the user's avatar, if any.
+func (u *User) Avatar() *Image {
+	if u.AvatarFilename == "" {
+		return nil
+	}
+
+	return &Image{
+		GalleryID: u.AvatarGalleryID,
+		Filename:  u.AvatarFilename,
+	}
+}
+
+// EmailVerified reports whether the user has confirmed that they own
+// their email address.
+func (u *User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// DeletionScheduled reports whether the user asked for their account
+// to be deleted. The account is only purged once DeletionGracePeriod
+// has passed, and can be restored until then.
+func (u *User) DeletionScheduled() bool {
+	return u.DeletionScheduledAt != nil
+}
+
+// DeletionDate returns when the account will be purged if the user
+// doesn't restore it.
+func (u *User) DeletionDate() time.Time {
+	if u.DeletionScheduledAt == nil {
+		return time.Time{}
+	}
+
+	return u.DeletionScheduledAt.Add(DeletionGracePeriod)
+}
+
+// Disabled reports whether an admin disabled the account, in which
+// case the user can't log in anymore.
+func (u *User) Disabled() bool {
+	return u.DisabledAt != nil
+}
+
+// HasPassword reports whether the user picked a password, users who
+// signed up with an OAuth provider don't have to.
+func (u *User) HasPassword() bool {
+	return u.PasswordHash != ""
+}
+
+// TwoFactorEnabled reports whether a TOTP code is required, in
+// addition to the password, when the user logs in.
+func (u *User) TwoFactorEnabled() bool {
+	return u.TOTPEnabledAt != nil
 }
 
 // UserDB is used to interact with the users database.
@@ -93,16 +307,31 @@ type UserDB interface {
 	// Methods for querying for single users
 	ByID(id uint) (*User, error)
 	ByEmail(email string) (*User, error)
-	ByRemember(token string) (*User, error)
+	ByHandle(handle string) (*User, error)
 	ByAge(age int) (*User, error)
 
 	// Methods for querying multiples users
 	InAgeRange(min, max int) ([]User, error)
+	DeletionScheduledBefore(t time.Time) ([]User, error)
+
+	// Search returns a page of the users whose email, name or
+	// handle contain the query, along with the total number of
+	// users matching it. An empty query matches every user.
+	Search(query string, offset, limit int) ([]User, int, error)
 
 	// Methods for altering users
 	Create(user *User) error
 	Update(user *User) error
 	Delete(id uint) error
+
+	// Purge permanently deletes the user row, instead of the soft
+	// delete performed by Delete.
+	Purge(id uint) error
+
+	// UseTOTPCounter records the time step of the TOTP code the
+	// user just used. It returns ErrNotFound if a code of that time
+	// step or a later one was used already.
+	UseTOTPCounter(id uint, counter int64) error
 }
 
 // UserService interface is a set of methods used to manipulate and
@@ -120,37 +349,201 @@ type UserService interface {
 	// and password are correct. If they are correct, the
 	// user corresponding to that email will be returned.
 	// Otherwise you will receive either:
-	// ErrNotFound, ErrPasswordIncorrect, or another error
-	// if something goes wrong.
-	Authenticate(email, password string) (*User, error)
+	// ErrNotFound, ErrPasswordIncorrect, ErrTooManyAttempts, or
+	// another error if something goes wrong.
+	// Failed attempts are counted per email and per client IP, and
+	// either one is locked out for a while after too many of them.
+	Authenticate(email, password string, client ClientInfo) (*User, error)
 
 	// InitiateReset will complete all the model-related taks to
 	// start the password reset process for the user with the
 	// provided email address. Once completed, it will return the
 	// token, or an error if there was one.
-	InitiateReset(email string) (string, error)
+	// Requests are throttled per email and per client IP, returning
+	// ErrTooManyAttempts, so we can't be used to spam someone.
+	InitiateReset(email string, client ClientInfo) (string, error)
 
 	// CompleteReset will complete all the model-related tasks to
 	// complete the password reset process for the user that the
 	// token matches, including updating that user's pw.
 	// If the token has expired, or if it is invalid for any other
 	// reason the ErrTokenInvalid error will be returned.
-	CompleteReset(token, newPw string) (*User, error)
+	// Like ChangePassword, every session and pending reset token of
+	// the user is invalidated.
+	CompleteReset(token, newPw string, client ClientInfo) (*User, error)
+
+	// InitiateLoginLink will create a token that logs the user with
+	// the provided email address in without their password, to be
+	// sent to them as a sign-in link. The token is empty when no
+	// user has the address, so callers can answer the same way
+	// without revealing who has an account.
+	InitiateLoginLink(email string, client ClientInfo) (string, error)
+
+	// CompleteLoginLink returns the user the token was issued to.
+	// Tokens can only be used once, if it was already used or has
+	// expired the ErrTokenInvalid error will be returned.
+	CompleteLoginLink(token string) (*User, error)
+
+	// ChangePassword will update the user's password after checking
+	// the current one, returning ErrPasswordIncorrect if it doesn't
+	// match. Users without a password set their first one this way,
+	// which requires the session to be less than ReauthWindow old
+	// or returns ErrReauthRequired, like every method checking the
+	// password.
+	// Every session and pending reset token of the user is
+	// invalidated, so the caller has to sign the user in again.
+	ChangePassword(user *User, session *Session, currentPw, newPw string,
+		client ClientInfo) error
+
+	// ScheduleDeletion will schedule the user's account to be
+	// deleted after DeletionGracePeriod, once the password is
+	// confirmed. The user is signed out everywhere.
+	ScheduleDeletion(user *User, session *Session, password string) error
+
+	// CancelDeletion will restore an account scheduled for
+	// deletion.
+	CancelDeletion(user *User) error
+
+	// InitiateEmailChange will check the user's password, validate
+	// the new email address and return a token that must be sent to
+	// it. The user's email is only changed once the token is
+	// confirmed with CompleteEmailChange.
+	InitiateEmailChange(user *User, session *Session,
+		password, newEmail string) (string, error)
+
+	// CompleteEmailChange will swap the email address of the user
+	// that the token matches for the new one, which is now known to
+	// be verified. If the token has expired, or if it is invalid
+	// for any other reason the ErrTokenInvalid error will be
+	// returned.
+	CompleteEmailChange(token string) (*User, error)
+
+	// InitiateVerification will create a new email verification
+	// token for the provided user and return it so that it can be
+	// emailed to the address being verified.
+	InitiateVerification(user *User) (string, error)
+
+	// CompleteVerification will mark the email address of the user
+	// that the token matches as verified. If the token has expired,
+	// or if it is invalid for any other reason the ErrTokenInvalid
+	// error will be returned.
+	CompleteVerification(token string) (*User, error)
+
+	// RequireVerified returns ErrEmailNotVerified unless the user
+	// has already confirmed their email address. It should be
+	// checked before sensitive actions like sharing galleries.
+	RequireVerified(user *User) error
+
+	// EnrollTOTP will generate a new TOTP secret for the user and
+	// store it until the enrollment is confirmed. It returns the
+	// otpauth:// URL to be displayed to the user.
+	EnrollTOTP(user *User) (string, error)
+
+	// ConfirmTOTP will enable two-factor authentication once the
+	// user proves their authenticator app produces valid codes.
+	// The recovery codes returned are not stored in plain text so
+	// this is the only time they are available.
+	ConfirmTOTP(user *User, code string) ([]string, error)
+
+	// DisableTOTP will turn two-factor authentication off after
+	// checking the provided TOTP or recovery code.
+	DisableTOTP(user *User, code string) error
+
+	// InitiateTwoFactor will start the second login step for a user
+	// that has already been authenticated with their password. The
+	// token returned identifies the pending login.
+	InitiateTwoFactor(user *User) (string, error)
+
+	// CompleteTwoFactor will finish the login started with
+	// InitiateTwoFactor if the TOTP or recovery code is valid.
+	// If the token has expired, or if it is invalid for any other
+	// reason the ErrTokenInvalid error will be returned.
+	CompleteTwoFactor(token, code string) (*User, error)
+
+	// CreateSession will sign the user in on a new browser or
+	// device. The session returned has its plain text Token set so
+	// it can be stored in a cookie.
+	CreateSession(user *User, client ClientInfo) (*Session, error)
+
+	// BySession looks up the user and the session matching the
+	// provided remember token. Expired sessions are treated as
+	// ErrNotFound.
+	BySession(token string) (*User, *Session, error)
+
+	// Sessions returns the active sessions of the user, the most
+	// recently used first.
+	Sessions(userID uint) ([]Session, error)
+
+	// RevokeSession signs out a single session of the user. If the
+	// session belongs to someone else ErrNotFound is returned.
+	RevokeSession(userID, sessionID uint) error
+
+	// RevokeOtherSessions signs the user out of every session but
+	// the one with the provided ID.
+	RevokeOtherSessions(userID, currentID uint) error
+
+	// CreateAPIToken creates a named token letting scripts act on
+	// behalf of the user, within the scopes provided. The token
+	// returned has its plain text Token set, it can't be displayed
+	// again later.
+	CreateAPIToken(user *User, name string, scopes []string) (*APIToken, error)
+
+	// APITokens returns the API tokens of the user, the most
+	// recently created first.
+	APITokens(userID uint) ([]APIToken, error)
+
+	// RevokeAPIToken deletes an API token of the user. If the token
+	// belongs to someone else ErrNotFound is returned.
+	RevokeAPIToken(userID, tokenID uint) error
+
+	// ByAPIToken looks up the user and the API token matching the
+	// provided token.
+	ByAPIToken(token string) (*User, *APIToken, error)
+
+	// SignInWithOAuth returns the user an identity from a provider
+	// belongs to. Unknown identities are connected to the user with
+	// the same email address, or to a new user without a password,
+	// as long as the provider verified that address. Otherwise
+	// ErrIdentityEmailUnverified is returned.
+	SignInWithOAuth(identity Identity, client ClientInfo) (*User, error)
+
+	// Disable prevents the user from logging in and signs them out
+	// everywhere. Enable reverts it.
+	Disable(user *User) error
+	Enable(user *User) error
+
+	// Impersonate makes the admin's session act as the target user
+	// until StopImpersonating is called with the same session.
+	Impersonate(admin *User, session *Session, target *User) error
+	StopImpersonating(session *Session) error
 }
 
 type userService struct {
 	UserDB
-	pepper    string
-	pwResetDB pwResetDB
+	uv                  *userValidator
+	pw                  hash.Password
+	pwResetDB           pwResetDB
+	emailVerificationDB emailVerificationDB
+	recoveryCodeDB      recoveryCodeDB
+	loginChallengeDB    loginChallengeDB
+	sessionDB           sessionDB
+	throttler           *throttler
+	emailChangeDB       emailChangeDB
+	loginLinkDB         loginLinkDB
+	apiTokenDB          apiTokenDB
+	audit               AuditService
+	oauth               OAuthService
 }
 
 // userValidator is our validation layer that validates and normalizes
 // data before passing it on to the next UserDB in our interface chain.
 type userValidator struct {
 	UserDB
-	hmac       hash.HMAC
-	pepper     string
-	emailRegex *regexp.Regexp
+	hmac        hash.HMAC
+	pw          hash.Password
+	policy      pwcheck.Policy
+	emailRegex  *regexp.Regexp
+	handleRegex *regexp.Regexp
 }
 
 type userValFn func(*User) error
@@ -188,11 +581,11 @@ func (e modelError) Public() string {
 // need to return a pointer here. Don't forget to update this first
 // line - we removed the * character at the end where we write
 // (UserService, error)
-func NewUserService(db *gorm.DB, pepper, hmacKey string) UserService {
+func NewUserService(db *gorm.DB, pw hash.Password, hmac hash.HMAC,
+	policy pwcheck.Policy) UserService {
 
 	u := &userGorm{db}
-	hmac := hash.NewHMAC(hmacKey)
-	uv := newUserValidator(u, hmac, pepper)
+	uv := newUserValidator(u, hmac, pw, policy)
 
 	// We also need to update how we construct the user service.
 	// We no longer have a UserService type to construct, and
@@ -202,18 +595,36 @@ func NewUserService(db *gorm.DB, pepper, hmacKey string) UserService {
 	//   func (us *userService) <- this uses a pointer
 	return &userService{
 		UserDB:    uv,
-		pepper:    pepper,
+		uv:        uv,
+		pw:        pw,
 		pwResetDB: newPwResetValidator(&pwResetGorm{db}, hmac),
+		emailVerificationDB: newEmailVerificationValidator(
+			&emailVerificationGorm{db}, hmac),
+		recoveryCodeDB: newRecoveryCodeValidator(
+			&recoveryCodeGorm{db}, hmac),
+		loginChallengeDB: newLoginChallengeValidator(
+			&loginChallengeGorm{db}, hmac),
+		sessionDB: newSessionValidator(&sessionGorm{db}, hmac),
+		throttler: &throttler{&throttleGorm{db}},
+		emailChangeDB: newEmailChangeValidator(
+			&emailChangeGorm{db}, hmac),
+		loginLinkDB: newLoginLinkValidator(&loginLinkGorm{db}, hmac),
+		apiTokenDB:  newAPITokenValidator(&apiTokenGorm{db}, hmac),
+		audit:       NewAuditService(db),
+		oauth:       NewOAuthService(db),
 	}
 }
 
-func newUserValidator(udb UserDB, hmac hash.HMAC, pepper string) *userValidator {
+func newUserValidator(udb UserDB, hmac hash.HMAC, pw hash.Password,
+	policy pwcheck.Policy) *userValidator {
 	return &userValidator{
 		UserDB: udb,
 		hmac:   hmac,
-		pepper: pepper,
+		pw:     pw,
+		policy: policy,
 		emailRegex: regexp.MustCompile(
 			`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
+		handleRegex: regexp.MustCompile(`^[a-z0-9_\-]{3,30}$`),
 	}
 }
 
@@ -223,16 +634,19 @@ func (u *userValidator) Create(user *User) error {
 
 	err := runUserValFns(user, u.passwordRequired,
 		u.passwordMinLength,
-		u.bcryptPassword,
+		u.passwordNotBreached,
+		u.passwordStrength,
+		u.hashPassword,
 		u.passwordHashRequired,
-		u.setRememberIfUnset,
-		u.rememberMinBytes,
-		u.hmacRemember,
-		u.rememberHashRequired,
 		u.normalizeEmail,
 		u.requireEmail,
 		u.emailFormat,
-		u.emailIsAvail)
+		u.emailIsAvail,
+		u.normalizeHandle,
+		u.handleFormat,
+		u.handleIsAvail,
+		u.normalizeWebsite,
+		u.profileMaxLength)
 	if err != nil {
 		return err
 	}
@@ -246,19 +660,23 @@ func (u *userGorm) Create(user *User) error {
 	return u.db.Create(user).Error
 }
 
-// Update will hash a remember token if it is provided
+// Update will hash a password if it is provided
 func (u *userValidator) Update(user *User) error {
 
 	err := runUserValFns(user, u.passwordMinLength,
-		u.bcryptPassword,
-		u.passwordHashRequired,
-		u.rememberMinBytes,
-		u.hmacRemember,
-		u.rememberHashRequired,
+		u.passwordNotBreached,
+		u.passwordStrength,
+		u.hashPassword,
 		u.normalizeEmail,
 		u.requireEmail,
 		u.emailFormat,
-		u.emailIsAvail)
+		u.emailIsAvail,
+		u.normalizeHandle,
+		u.handleFormat,
+		u.handleIsAvail,
+		u.normalizeWebsite,
+		u.profileMaxLength,
+		u.storageQuotaNotNegative)
 	if err != nil {
 		return err
 	}
@@ -269,7 +687,7 @@ func (u *userValidator) Update(user *User) error {
 // Update will update the provided user with all of the data in
 // the provided user object.
 func (u *userGorm) Update(user *User) error {
-	return u.db.Save(user).Error
+	return u.db.Omit("storage_used").Save(user).Error
 }
 
 // Delete will delete the user with the provided ID
@@ -292,6 +710,44 @@ func (u *userGorm) Delete(id uint) error {
 	return u.db.Delete(&user).Error
 }
 
+// Purge will validate the ID before permanently deleting the user
+func (u *userValidator) Purge(id uint) error {
+
+	var user User
+	user.ID = id
+
+	err := runUserValFns(&user, u.idGreaterThan(0))
+	if err != nil {
+		return err
+	}
+
+	return u.UserDB.Purge(id)
+}
+
+// Purge will permanently delete the user with the provided ID
+func (u *userGorm) Purge(id uint) error {
+	user := User{Model: gorm.Model{ID: id}}
+	return u.db.Unscoped().Delete(&user).Error
+}
+
+func (u *userGorm) UseTOTPCounter(id uint, counter int64) error {
+
+	// The condition is checked by the update itself, so two logins
+	// racing with the same code can't both succeed.
+	db := u.db.Model(&User{}).
+		Where("id = ? AND totp_last_counter < ?", id, counter).
+		UpdateColumn("totp_last_counter", counter)
+	if db.Error != nil {
+		return db.Error
+	}
+
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
 // Authenticate can be used to authenticate a user with the provided
 // email address and password.
 // If the email address provided is invalid, this will return
@@ -300,28 +756,94 @@ func (u *userGorm) Delete(id uint) error {
 // nil. ErrPasswordIncorrect
 // If the email and password are both valid, this will return
 // user, nil
+// If there were too many failed attempts for the email address or the
+// client IP recently, this will return nil, ErrTooManyAttempts
 // Otherwise if another error is encountered this will return nil, error
-func (u *userService) Authenticate(email, password string) (*User, error) {
+func (u *userService) Authenticate(email, password string,
+	client ClientInfo) (*User, error) {
+
+	keys := throttleKeys("login", email, client)
+	for _, key := range keys {
+		if err := u.throttler.check(key); err != nil {
+			return nil, err
+		}
+	}
+
 	foundUser, err := u.ByEmail(email)
-	if err != nil {
+	if err == ErrNotFound {
+		u.failedLogin(keys)
+		return nil, err
+	} else if err != nil {
 		return nil, err
 	}
 
-	err = bcrypt.CompareHashAndPassword(
-		[]byte(foundUser.PasswordHash),
-		[]byte(password+u.pepper))
-
+	err = u.checkPassword(foundUser, password)
 	switch err {
 	case nil:
+		// Only the email is forgiven on success, otherwise an
+		// attacker could reset the counter of their IP address
+		// by logging in to their own account.
+		if err := u.throttler.reset(keys[0]); err != nil {
+			return nil, err
+		}
+		if foundUser.Disabled() {
+			return nil, ErrAccountDisabled
+		}
 		return foundUser, nil
-	case bcrypt.ErrMismatchedHashAndPassword:
-		return nil, ErrPasswordIncorrect
+	case ErrPasswordIncorrect:
+		u.failedLogin(keys)
+		u.audit.Log(foundUser, nil, AuditLoginFailed, "", client)
+		return nil, err
 	default:
 		return nil, err
 	}
 }
 
-func (u *userService) InitiateReset(email string) (string, error) {
+// rehashPassword upgrades the user's password hash to the current
+// algorithm, parameters and pepper, now that we know the password.
+// Failing to do so isn't worth failing the login for, as we can try
+// again next time.
+func (u *userService) rehashPassword(user *User, password string) {
+
+	hashed, err := u.pw.Hash(password)
+	if err != nil {
+		log.Println("models: rehashing password:", err)
+		return
+	}
+
+	// Skip the validators, the password might predate the current
+	// minimum length and the user must not be locked out for it.
+	user.PasswordHash = hashed
+	if err := u.uv.UserDB.Update(user); err != nil {
+		log.Println("models: rehashing password:", err)
+	}
+}
+
+// failedLogin records a failed login attempt for the email and IP
+// keys returned by throttleKeys.
+func (u *userService) failedLogin(keys []string) {
+	policies := []throttlePolicy{loginEmailPolicy, loginIPPolicy}
+	for i, key := range keys {
+		if err := u.throttler.hit(key, policies[i]); err != nil {
+			log.Println("models: recording failed login:", err)
+		}
+	}
+}
+
+func (u *userService) InitiateReset(email string, client ClientInfo) (string, error) {
+
+	// Every request counts, successful or not, since each one can
+	// send an email.
+	keys := throttleKeys("reset", email, client)
+	policies := []throttlePolicy{resetEmailPolicy, resetIPPolicy}
+	for i, key := range keys {
+		if err := u.throttler.check(key); err != nil {
+			return "", err
+		}
+		if err := u.throttler.hit(key, policies[i]); err != nil {
+			return "", err
+		}
+	}
 
 	user, err := u.ByEmail(email)
 	if err != nil {
@@ -335,10 +857,13 @@ func (u *userService) InitiateReset(email string) (string, error) {
 		return "", err
 	}
 
+	u.audit.Log(user, nil, AuditPasswordResetRequested, "", client)
+
 	return pwr.Token, nil
 }
 
-func (u *userService) CompleteReset(token, newPw string) (*User, error) {
+func (u *userService) CompleteReset(token, newPw string,
+	client ClientInfo) (*User, error) {
 
 	pwr, err := u.pwResetDB.ByToken(token)
 	if err != nil {
@@ -363,176 +888,1139 @@ func (u *userService) CompleteReset(token, newPw string) (*User, error) {
 		return nil, err
 	}
 
-	u.pwResetDB.Delete(pwr.ID)
+	err = u.passwordChanged(user)
+	if err != nil {
+		return nil, err
+	}
+
+	u.audit.Log(user, user, AuditPasswordReset, "", client)
 
 	return user, nil
 }
 
-// bcryptPassword will hash a user's password with an app-wide pepper
-// and bcrypt, which salts for us.
-func (u *userValidator) bcryptPassword(user *User) error {
+func (u *userService) InitiateLoginLink(email string, client ClientInfo) (string, error) {
 
-	if user.Password == "" {
-		// We DO NOT need to run this if the password
-		// hasn't been changed.
-		return nil
+	// Just like resets, every request can send an email.
+	keys := throttleKeys("link", email, client)
+	policies := []throttlePolicy{resetEmailPolicy, resetIPPolicy}
+	for i, key := range keys {
+		if err := u.throttler.check(key); err != nil {
+			return "", err
+		}
+		if err := u.throttler.hit(key, policies[i]); err != nil {
+			return "", err
+		}
 	}
 
-	pwBytes := []byte(user.Password + u.pepper)
-	hashedBytes, err := bcrypt.GenerateFromPassword(pwBytes,
-		bcrypt.DefaultCost)
-	if err != nil {
-		return err
+	user, err := u.ByEmail(email)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		return "", nil
+	default:
+		return "", err
 	}
 
-	user.PasswordHash = string(hashedBytes)
-	user.Password = ""
+	ll := loginLink{
+		UserID: user.ID,
+	}
+	if err := u.loginLinkDB.Create(&ll); err != nil {
+		return "", err
+	}
 
-	return nil
+	return ll.Token, nil
 }
 
-func (u *userValidator) hmacRemember(user *User) error {
-	if user.Remember == "" {
-		return nil
+func (u *userService) CompleteLoginLink(token string) (*User, error) {
+
+	ll, err := u.loginLinkDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
 	}
-	user.RememberHash = u.hmac.Hash(user.Remember)
 
-	return nil
-}
+	// Delete it before anything else, so the link can't be used
+	// twice even if logging in fails further down.
+	if err := u.loginLinkDB.Delete(ll.ID); err != nil {
+		return nil, err
+	}
 
-func (u *userValidator) setRememberIfUnset(user *User) error {
-	if user.Remember != "" {
-		return nil
+	if time.Now().Sub(ll.CreatedAt) > loginLinkDuration {
+		return nil, ErrTokenInvalid
 	}
 
-	token, err := rand.RememberToken()
+	user, err := u.ByID(ll.UserID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	user.Remember = token
-
-	return nil
-}
-
-func (u *userValidator) idGreaterThan(n uint) userValFn {
-	return userValFn(func(user *User) error {
-		if user.ID <= n {
-			return ErrIDInvalid
+	// Following the link proves that the email address is theirs.
+	if !user.EmailVerified() {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+		if err := u.Update(user); err != nil {
+			return nil, err
 		}
-		return nil
-	})
-}
-
-func (u *userValidator) normalizeEmail(user *User) error {
-	user.Email = strings.ToLower(user.Email)
-	user.Email = strings.TrimSpace(user.Email)
+	}
 
-	return nil
+	return user, nil
 }
 
-func (u *userValidator) requireEmail(user *User) error {
-	if user.Email == "" {
-		return ErrEmailRequired
+func (u *userService) ChangePassword(user *User, session *Session,
+	currentPw, newPw string, client ClientInfo) error {
+
+	err := u.confirmPassword(user, session, currentPw)
+	if err != nil {
+		return err
 	}
 
-	return nil
-}
+	if newPw == "" {
+		return ErrPasswordRequired
+	}
 
-func (u *userValidator) emailFormat(user *User) error {
-	if user.Email == "" {
-		return nil
+	user.Password = newPw
+	err = u.Update(user)
+	if err != nil {
+		return err
 	}
 
-	if !u.emailRegex.MatchString(user.Email) {
-		return ErrEmailInvalid
+	err = u.passwordChanged(user)
+	if err != nil {
+		return err
 	}
 
+	u.audit.Log(user, user, AuditPasswordChanged, "", client)
+
 	return nil
 }
 
-func (u *userValidator) emailIsAvail(user *User) error {
-	existing, err := u.ByEmail(user.Email)
-	if err == ErrNotFound {
-		// Email address is available if we don't find
-		// a user with that email address.
-		return nil
-	}
+func (u *userService) ScheduleDeletion(user *User, session *Session,
+	password string) error {
 
-	// We can't continue our validation without a successful
-	// query, so if we get any error other than ErrNotFound we
-	// should return it.
+	err := u.confirmPassword(user, session, password)
 	if err != nil {
 		return err
 	}
 
-	// If we get here that means we found a user w/ this email
-	// address, so we need to see if this is the same user we
-	// are updating, or if we have a conflict.
-	if user.ID != existing.ID {
-		return ErrEmailTaken
+	now := time.Now()
+	user.DeletionScheduledAt = &now
+	err = u.Update(user)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return u.sessionDB.DeleteByUserID(user.ID, 0)
 }
 
-func (u *userValidator) passwordMinLength(user *User) error {
-	if user.Password == "" {
-		return nil
+func (u *userService) CancelDeletion(user *User) error {
+
+	user.DeletionScheduledAt = nil
+
+	return u.Update(user)
+}
+
+func (u *userService) InitiateEmailChange(user *User, session *Session,
+	password, newEmail string) (string, error) {
+
+	err := u.confirmPassword(user, session, password)
+	if err != nil {
+		return "", err
 	}
 
-	if len(user.Password) < 8 {
-		return ErrPasswordTooShort
+	// Run the new address through the same normalization and
+	// checks as a signup, on a copy so the user isn't changed yet.
+	candidate := User{
+		Model: gorm.Model{ID: user.ID},
+		Email: newEmail,
+	}
+	err = runUserValFns(&candidate, u.uv.normalizeEmail,
+		u.uv.requireEmail,
+		u.uv.emailFormat)
+	if err != nil {
+		return "", err
 	}
 
-	return nil
-}
+	if candidate.Email == user.Email {
+		return "", ErrEmailUnchanged
+	}
 
-func (u *userValidator) passwordRequired(user *User) error {
-	if user.Password == "" {
-		return ErrPasswordRequired
+	err = runUserValFns(&candidate, u.uv.emailIsAvail)
+	if err != nil {
+		return "", err
 	}
 
-	return nil
-}
+	// Only the latest request is kept, so following an older
+	// link can't switch to an address the user moved on from.
+	err = u.emailChangeDB.DeleteByUserID(user.ID)
+	if err != nil {
+		return "", err
+	}
 
-func (u *userValidator) passwordHashRequired(user *User) error {
-	if user.PasswordHash == "" {
-		return ErrPasswordRequired
+	ec := emailChange{
+		UserID:   user.ID,
+		NewEmail: candidate.Email,
+	}
+	if err := u.emailChangeDB.Create(&ec); err != nil {
+		return "", err
 	}
 
-	return nil
+	return ec.Token, nil
 }
 
-func (u *userValidator) rememberMinBytes(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
+func (u *userService) CompleteEmailChange(token string) (*User, error) {
 
-	n, err := rand.NBytes(user.Remember)
+	ec, err := u.emailChangeDB.ByToken(token)
 	if err != nil {
-		return err
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
 	}
 
-	if n < 32 {
-		return ErrRememberTooShort
+	if time.Now().Sub(ec.CreatedAt) > (24 * time.Hour) {
+		return nil, ErrTokenInvalid
 	}
 
-	return nil
-}
+	user, err := u.ByID(ec.UserID)
+	if err != nil {
+		return nil, err
+	}
 
-func (u *userValidator) rememberHashRequired(user *User) error {
-	if user.RememberHash == "" {
-		return ErrRememberRequired
+	// Update runs the email validations again, so we still get
+	// ErrEmailTaken if someone signed up with the address since
+	// the change was requested.
+	now := time.Now()
+	user.Email = ec.NewEmail
+	user.EmailVerifiedAt = &now
+	err = u.Update(user)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	u.emailChangeDB.Delete(ec.ID)
+
+	return user, nil
 }
 
-/////////////////////////////////////////////////////////////////////
-//
-// Query Methods
-//
+func (u *userService) SignInWithOAuth(identity Identity, client ClientInfo) (*User, error) {
+
+	if identity.Subject == "" {
+		return nil, ErrSubjectRequired
+	}
+
+	oauth, err := u.oauth.BySubject(identity.Service, identity.Subject)
+	switch err {
+	case nil:
+		user, err := u.ByID(oauth.UserID)
+		if err != nil {
+			return nil, err
+		}
+		// Keep the freshest token for the features using it.
+		err = u.oauth.Connect(user, identity.OAuth(), client)
+		if err != nil {
+			return nil, err
+		}
+		return user, nil
+	case ErrNotFound:
+	default:
+		return nil, err
+	}
+
+	if identity.Email == "" || !identity.EmailVerified {
+		return nil, ErrIdentityEmailUnverified
+	}
+
+	user, err := u.ByEmail(identity.Email)
+	switch err {
+	case nil:
+		err = u.claimUnverified(user)
+	case ErrNotFound:
+		user, err = u.createPasswordless(identity)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = u.oauth.Connect(user, identity.OAuth(), client)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// claimUnverified hands an account whose email address was never
+// verified over to whoever the provider vouched for. Anyone could
+// have signed up with that address, so every way in set up back then
+// is dropped, otherwise the account could have been prepared in
+// advance to spy on its real owner.
+func (u *userService) claimUnverified(user *User) error {
+
+	if user.EmailVerified() {
+		return nil
+	}
+
+	now := time.Now()
+	user.EmailVerifiedAt = &now
+	user.PasswordHash = ""
+	user.TOTPSecret = ""
+	user.TOTPEnabledAt = nil
+	user.TOTPLastCounter = 0
+	if err := u.Update(user); err != nil {
+		return err
+	}
+
+	err := u.recoveryCodeDB.DeleteByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+
+	err = u.emailChangeDB.DeleteByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+
+	err = u.apiTokenDB.DeleteByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+
+	return u.passwordChanged(user)
+}
+
+// createPasswordless signs up the user of an identity, who doesn't
+// pick a password. They can still set one later on.
+func (u *userService) createPasswordless(identity Identity) (*User, error) {
+
+	now := time.Now()
+	user := User{
+		Name:            identity.Name,
+		Email:           identity.Email,
+		EmailVerifiedAt: &now,
+	}
+
+	err := runUserValFns(&user, u.uv.normalizeEmail,
+		u.uv.requireEmail,
+		u.uv.emailFormat,
+		u.uv.emailIsAvail)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.uv.UserDB.Create(&user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (u *userService) Disable(user *User) error {
+
+	now := time.Now()
+	user.DisabledAt = &now
+	if err := u.Update(user); err != nil {
+		return err
+	}
+
+	return u.sessionDB.DeleteByUserID(user.ID, 0)
+}
+
+func (u *userService) Enable(user *User) error {
+
+	user.DisabledAt = nil
+
+	return u.Update(user)
+}
+
+func (u *userService) Impersonate(admin *User, session *Session, target *User) error {
+
+	// Admins can't be impersonated, otherwise the admin checks
+	// would apply to the target user instead of the real one.
+	if !admin.IsAdmin || target.IsAdmin || admin.ID == target.ID {
+		return ErrCannotImpersonate
+	}
+
+	if session.UserID != admin.ID {
+		return ErrNotFound
+	}
+
+	session.ImpersonatingID = target.ID
+
+	return u.sessionDB.Update(session)
+}
+
+func (u *userService) StopImpersonating(session *Session) error {
+
+	session.ImpersonatingID = 0
+
+	return u.sessionDB.Update(session)
+}
+
+// Purge permanently deletes the user along with every token or
+// credential that belongs to them. Anything else the user owns, like
+// galleries, must be removed first by the caller.
+func (u *userService) Purge(id uint) error {
+
+	user, err := u.ByID(id)
+	if err != nil {
+		return err
+	}
+
+	err = u.pwResetDB.DeleteByUserID(id)
+	if err != nil {
+		return err
+	}
+
+	err = u.emailVerificationDB.DeleteByUserID(id)
+	if err != nil {
+		return err
+	}
+
+	err = u.recoveryCodeDB.DeleteByUserID(id)
+	if err != nil {
+		return err
+	}
+
+	err = u.loginChallengeDB.DeleteByUserID(id)
+	if err != nil {
+		return err
+	}
+
+	err = u.sessionDB.DeleteByUserID(id, 0)
+	if err != nil {
+		return err
+	}
+
+	err = u.emailChangeDB.DeleteByUserID(id)
+	if err != nil {
+		return err
+	}
+
+	err = u.loginLinkDB.DeleteByUserID(id)
+	if err != nil {
+		return err
+	}
+
+	err = u.apiTokenDB.DeleteByUserID(id)
+	if err != nil {
+		return err
+	}
+
+	err = u.audit.DeleteByUserID(id)
+	if err != nil {
+		return err
+	}
+
+	for _, action := range []string{"login", "reset", "link"} {
+		key := throttleKeys(action, user.Email, ClientInfo{})[0]
+		if err := u.throttler.reset(key); err != nil {
+			return err
+		}
+	}
+
+	return u.UserDB.Purge(id)
+}
+
+// checkPassword returns ErrPasswordIncorrect unless the password
+// provided is the user's current password. An out of date hash is
+// upgraded on the way, so raising our hashing strength or rotating
+// the pepper doesn't force anyone to reset their password.
+func (u *userService) checkPassword(user *User, password string) error {
+
+	if !user.HasPassword() {
+		return ErrPasswordIncorrect
+	}
+
+	rehash, err := u.pw.Compare(user.PasswordHash, password)
+
+	switch err {
+	case nil:
+		if rehash {
+			u.rehashPassword(user, password)
+		}
+		return nil
+	case hash.ErrPasswordMismatch:
+		return ErrPasswordIncorrect
+	default:
+		return err
+	}
+}
+
+// confirmPassword is checkPassword for users who are already signed
+// in. Those who never picked a password have nothing to confirm, so
+// they must have logged in again recently, through their provider or
+// a sign-in link, on the session making the change.
+func (u *userService) confirmPassword(user *User, session *Session,
+	password string) error {
+
+	if !user.HasPassword() {
+		if session == nil || session.UserID != user.ID ||
+			time.Since(session.CreatedAt) > ReauthWindow {
+			return ErrReauthRequired
+		}
+		return nil
+	}
+
+	return u.checkPassword(user, password)
+}
+
+// passwordChanged invalidates everything that was granted with the
+// old password, or that could be used to pick a new one: every
+// session, every pending password reset and every sign-in link of
+// the user.
+func (u *userService) passwordChanged(user *User) error {
+
+	err := u.pwResetDB.DeleteByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+
+	err = u.loginLinkDB.DeleteByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+
+	return u.sessionDB.DeleteByUserID(user.ID, 0)
+}
+
+func (u *userService) InitiateVerification(user *User) (string, error) {
+
+	ev := emailVerification{
+		UserID: user.ID,
+	}
+	if err := u.emailVerificationDB.Create(&ev); err != nil {
+		return "", err
+	}
+
+	return ev.Token, nil
+}
+
+func (u *userService) CompleteVerification(token string) (*User, error) {
+
+	ev, err := u.emailVerificationDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+
+	if time.Now().Sub(ev.CreatedAt) > (48 * time.Hour) {
+		return nil, ErrTokenInvalid
+	}
+
+	user, err := u.ByID(ev.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !user.EmailVerified() {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+		err = u.Update(user)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	u.emailVerificationDB.Delete(ev.ID)
+
+	return user, nil
+}
+
+func (u *userService) RequireVerified(user *User) error {
+
+	if user == nil || !user.EmailVerified() {
+		return ErrEmailNotVerified
+	}
+
+	return nil
+}
+
+func (u *userService) EnrollTOTP(user *User) (string, error) {
+
+	if user.TwoFactorEnabled() {
+		return "", ErrTwoFactorEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+
+	user.TOTPSecret = secret
+	err = u.Update(user)
+	if err != nil {
+		return "", err
+	}
+
+	return totp.URL(totpIssuer, user.Email, secret), nil
+}
+
+func (u *userService) ConfirmTOTP(user *User, code string) ([]string, error) {
+
+	if user.TwoFactorEnabled() {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	if user.TOTPSecret == "" {
+		return nil, ErrTwoFactorNotEnrolled
+	}
+
+	counter, ok := totp.ValidateCounter(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return nil, ErrTwoFactorCodeInvalid
+	}
+
+	// Any codes left over from a previous enrollment must not keep
+	// working with the new authenticator.
+	err := u.recoveryCodeDB.DeleteByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		rc := recoveryCode{
+			UserID: user.ID,
+		}
+		if err := u.recoveryCodeDB.Create(&rc); err != nil {
+			return nil, err
+		}
+		codes[i] = rc.Code
+	}
+
+	now := time.Now()
+	user.TOTPEnabledAt = &now
+	user.TOTPLastCounter = counter
+	err = u.Update(user)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+func (u *userService) DisableTOTP(user *User, code string) error {
+
+	if !user.TwoFactorEnabled() {
+		return ErrTwoFactorNotEnrolled
+	}
+
+	err := u.checkSecondFactor(user, code)
+	if err != nil {
+		return err
+	}
+
+	err = u.recoveryCodeDB.DeleteByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+
+	user.TOTPSecret = ""
+	user.TOTPEnabledAt = nil
+	user.TOTPLastCounter = 0
+
+	return u.Update(user)
+}
+
+func (u *userService) InitiateTwoFactor(user *User) (string, error) {
+
+	lc := loginChallenge{
+		UserID: user.ID,
+	}
+	if err := u.loginChallengeDB.Create(&lc); err != nil {
+		return "", err
+	}
+
+	return lc.Token, nil
+}
+
+func (u *userService) CompleteTwoFactor(token, code string) (*User, error) {
+
+	lc, err := u.loginChallengeDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+
+	if time.Now().Sub(lc.CreatedAt) > (5 * time.Minute) {
+		u.loginChallengeDB.Delete(lc.ID)
+		return nil, ErrTokenInvalid
+	}
+
+	user, err := u.ByID(lc.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = u.checkSecondFactor(user, code)
+	if err == ErrTwoFactorCodeInvalid {
+		// Only a handful of guesses are allowed per login so the
+		// six digit codes can't be brute forced. After that the
+		// user has to start over with their password.
+		lc.Attempts++
+		if lc.Attempts >= maxTwoFactorAttempts {
+			u.loginChallengeDB.Delete(lc.ID)
+			return nil, ErrTokenInvalid
+		}
+		u.loginChallengeDB.Update(lc)
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	u.loginChallengeDB.Delete(lc.ID)
+
+	return user, nil
+}
+
+func (u *userService) CreateSession(user *User, client ClientInfo) (*Session, error) {
+
+	// Every way of logging in ends up here, so this is the one
+	// place a disabled user must be stopped.
+	if user.Disabled() {
+		return nil, ErrAccountDisabled
+	}
+
+	session := Session{
+		UserID:    user.ID,
+		UserAgent: client.UserAgent,
+		IP:        client.IP,
+	}
+	if err := u.sessionDB.Create(&session); err != nil {
+		return nil, err
+	}
+
+	u.audit.Log(user, user, AuditLogin, "", client)
+
+	return &session, nil
+}
+
+func (u *userService) BySession(token string) (*User, *Session, error) {
+
+	session, err := u.sessionDB.ByToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if session.Expired() {
+		u.sessionDB.Delete(session.ID)
+		return nil, nil, ErrNotFound
+	}
+
+	user, err := u.ByID(session.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if user.Disabled() {
+		u.sessionDB.Delete(session.ID)
+		return nil, nil, ErrNotFound
+	}
+
+	if time.Now().Sub(session.LastSeenAt) > sessionTouchInterval {
+		session.LastSeenAt = time.Now()
+		session.ExpiresAt = session.LastSeenAt.Add(sessionDuration)
+		if err := u.sessionDB.Update(session); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return user, session, nil
+}
+
+func (u *userService) Sessions(userID uint) ([]Session, error) {
+	return u.sessionDB.ByUserID(userID)
+}
+
+func (u *userService) RevokeSession(userID, sessionID uint) error {
+
+	sessions, err := u.sessionDB.ByUserID(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range sessions {
+		if s.ID == sessionID {
+			return u.sessionDB.Delete(s.ID)
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (u *userService) RevokeOtherSessions(userID, currentID uint) error {
+	return u.sessionDB.DeleteByUserID(userID, currentID)
+}
+
+func (u *userService) CreateAPIToken(user *User, name string, scopes []string) (*APIToken, error) {
+
+	token := APIToken{
+		UserID: user.ID,
+		Name:   name,
+		Scopes: strings.Join(scopes, " "),
+	}
+	if err := u.apiTokenDB.Create(&token); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func (u *userService) APITokens(userID uint) ([]APIToken, error) {
+	return u.apiTokenDB.ByUserID(userID)
+}
+
+func (u *userService) RevokeAPIToken(userID, tokenID uint) error {
+
+	tokens, err := u.apiTokenDB.ByUserID(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tokens {
+		if t.ID == tokenID {
+			return u.apiTokenDB.Delete(t.ID)
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (u *userService) ByAPIToken(token string) (*User, *APIToken, error) {
+
+	t, err := u.apiTokenDB.ByToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := u.ByID(t.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The token is kept, so the scripts work again if the account
+	// is enabled later on.
+	if user.Disabled() {
+		return nil, nil, ErrNotFound
+	}
+
+	// Like sessions, only record the last use every few minutes.
+	if t.LastUsedAt == nil ||
+		time.Now().Sub(*t.LastUsedAt) > sessionTouchInterval {
+		now := time.Now()
+		t.LastUsedAt = &now
+		if err := u.apiTokenDB.Update(t); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return user, t, nil
+}
+
+// checkSecondFactor accepts either a current TOTP code that wasn't
+// used yet or one of the user's unused recovery codes, which is
+// consumed.
+// Wrong codes are counted per user, whatever the login challenge,
+// and lock the user out with the same backoff as wrong passwords.
+// Once locked out, ErrTooManyAttempts is returned.
+func (u *userService) checkSecondFactor(user *User, code string) error {
+
+	key := fmt.Sprintf("2fa:user:%d", user.ID)
+	if err := u.throttler.check(key); err != nil {
+		return err
+	}
+
+	err := u.verifySecondFactor(user, code)
+	switch err {
+	case nil:
+		u.throttler.reset(key)
+	case ErrTwoFactorCodeInvalid:
+		u.throttler.hit(key, loginEmailPolicy)
+	}
+
+	return err
+}
+
+func (u *userService) verifySecondFactor(user *User, code string) error {
+
+	counter, ok := totp.ValidateCounter(user.TOTPSecret, code, time.Now())
+	if ok {
+		err := u.UseTOTPCounter(user.ID, counter)
+		switch err {
+		case nil:
+			user.TOTPLastCounter = counter
+			return nil
+		case ErrNotFound:
+			return ErrTwoFactorCodeInvalid
+		default:
+			return err
+		}
+	}
+
+	rc, err := u.recoveryCodeDB.ByCode(user.ID, code)
+	if err == nil {
+		// Another request may have used the code since we read it.
+		err = u.recoveryCodeDB.Delete(user.ID, rc.ID)
+	}
+
+	switch err {
+	case nil:
+		return nil
+	case ErrNotFound:
+		return ErrTwoFactorCodeInvalid
+	default:
+		return err
+	}
+}
+
+// hashPassword will hash a user's password with an app-wide pepper
+// and the configured algorithm, which salts for us.
+func (u *userValidator) hashPassword(user *User) error {
+
+	if user.Password == "" {
+		// We DO NOT need to run this if the password
+		// hasn't been changed.
+		return nil
+	}
+
+	hashed, err := u.pw.Hash(user.Password)
+	if err != nil {
+		return err
+	}
+
+	user.PasswordHash = hashed
+	user.Password = ""
+
+	return nil
+}
+
+func (u *userValidator) idGreaterThan(n uint) userValFn {
+	return userValFn(func(user *User) error {
+		if user.ID <= n {
+			return ErrIDInvalid
+		}
+		return nil
+	})
+}
+
+func (u *userValidator) normalizeEmail(user *User) error {
+	user.Email = strings.ToLower(user.Email)
+	user.Email = strings.TrimSpace(user.Email)
+
+	return nil
+}
+
+func (u *userValidator) requireEmail(user *User) error {
+	if user.Email == "" {
+		return ErrEmailRequired
+	}
+
+	return nil
+}
+
+func (u *userValidator) emailFormat(user *User) error {
+	if user.Email == "" {
+		return nil
+	}
+
+	if !u.emailRegex.MatchString(user.Email) {
+		return ErrEmailInvalid
+	}
+
+	return nil
+}
+
+func (u *userValidator) emailIsAvail(user *User) error {
+	existing, err := u.ByEmail(user.Email)
+	if err == ErrNotFound {
+		// Email address is available if we don't find
+		// a user with that email address.
+		return nil
+	}
+
+	// We can't continue our validation without a successful
+	// query, so if we get any error other than ErrNotFound we
+	// should return it.
+	if err != nil {
+		return err
+	}
+
+	// If we get here that means we found a user w/ this email
+	// address, so we need to see if this is the same user we
+	// are updating, or if we have a conflict.
+	if user.ID != existing.ID {
+		return ErrEmailTaken
+	}
+
+	return nil
+}
+
+func (u *userValidator) normalizeHandle(user *User) error {
+	user.Handle = strings.ToLower(user.Handle)
+	user.Handle = strings.TrimSpace(user.Handle)
+	user.Handle = strings.TrimPrefix(user.Handle, "@")
+
+	return nil
+}
+
+func (u *userValidator) handleFormat(user *User) error {
+	if user.Handle == "" {
+		return nil
+	}
+
+	if !u.handleRegex.MatchString(user.Handle) {
+		return ErrHandleInvalid
+	}
+
+	return nil
+}
+
+func (u *userValidator) handleIsAvail(user *User) error {
+	if user.Handle == "" {
+		return nil
+	}
+
+	existing, err := u.ByHandle(user.Handle)
+	if err == ErrNotFound {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if user.ID != existing.ID {
+		return ErrHandleTaken
+	}
+
+	return nil
+}
+
+// normalizeWebsite accepts a website with or without its scheme, but
+// only http and https links are stored as we render them on profile
+// pages.
+func (u *userValidator) normalizeWebsite(user *User) error {
+	user.Website = strings.TrimSpace(user.Website)
+	if user.Website == "" {
+		return nil
+	}
+
+	if !strings.Contains(user.Website, "://") {
+		user.Website = "https://" + user.Website
+	}
+
+	parsed, err := url.Parse(user.Website)
+	if err != nil || parsed.Host == "" {
+		return ErrWebsiteInvalid
+	}
+
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return ErrWebsiteInvalid
+	}
+
+	user.Website = parsed.String()
+
+	return nil
+}
+
+func (u *userValidator) profileMaxLength(user *User) error {
+	user.DisplayName = strings.TrimSpace(user.DisplayName)
+	if utf8.RuneCountInString(user.DisplayName) > maxDisplayNameLen {
+		return ErrDisplayNameTooLong
+	}
+
+	user.Bio = strings.TrimSpace(user.Bio)
+	if utf8.RuneCountInString(user.Bio) > maxBioLen {
+		return ErrBioTooLong
+	}
+
+	return nil
+}
+
+func (u *userValidator) storageQuotaNotNegative(user *User) error {
+	if user.StorageQuota < 0 {
+		return ErrStorageQuotaInvalid
+	}
+
+	return nil
+}
+
+func (u *userValidator) passwordMinLength(user *User) error {
+	if user.Password == "" {
+		return nil
+	}
+
+	if len(user.Password) < 8 {
+		return ErrPasswordTooShort
+	}
+
+	return nil
+}
+
+func (u *userValidator) passwordNotBreached(user *User) error {
+
+	if user.Password == "" || u.policy.Breached == nil {
+		return nil
+	}
+
+	breached, err := u.policy.Breached.Contains(user.Password)
+	if err != nil {
+		// Don't stop everyone from signing up because the dataset
+		// can't be read, the other checks still apply.
+		log.Println("models: checking breached passwords:", err)
+		return nil
+	}
+
+	if breached {
+		return ErrPasswordBreached
+	}
+
+	return nil
+}
+
+// passwordStrength doesn't give any credit for the parts of the
+// password made of the user's own email address, name or handle.
+func (u *userValidator) passwordStrength(user *User) error {
+
+	if user.Password == "" {
+		return nil
+	}
+
+	strength := pwcheck.Strength(user.Password, user.Email, user.Name,
+		user.Handle)
+	if strength < u.policy.MinStrength {
+		return ErrPasswordTooWeak
+	}
+
+	return nil
+}
+
+func (u *userValidator) passwordRequired(user *User) error {
+	if user.Password == "" {
+		return ErrPasswordRequired
+	}
+
+	return nil
+}
+
+func (u *userValidator) passwordHashRequired(user *User) error {
+	if user.PasswordHash == "" {
+		return ErrPasswordRequired
+	}
+
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////
+//
+// Query Methods
+//
 /////////////////////////////////////////////////////////////////////
 
 // ByID will look up a user with the provided ID.
@@ -590,6 +2078,38 @@ func (u *userValidator) ByEmail(email string) (*User, error) {
 	return u.UserDB.ByEmail(user.Email)
 }
 
+// ByHandle looks up a user with the given handle and returns that
+// user.
+func (u *userGorm) ByHandle(handle string) (*User, error) {
+	var user User
+	db := u.db.Where("handle = ?", handle)
+	err := first(db, &user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// ByHandle will normalize a handle before passing it on to the
+// database layer to perform the query.
+func (u *userValidator) ByHandle(handle string) (*User, error) {
+	user := User{
+		Handle: handle,
+	}
+
+	err := runUserValFns(&user, u.normalizeHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Handle == "" {
+		return nil, ErrNotFound
+	}
+
+	return u.UserDB.ByHandle(user.Handle)
+}
+
 // ByAge will look up a user with the provided age.
 // If the user is found, we will return a nil error
 // If the user is not found, we will return ErrNotFound
@@ -625,32 +2145,56 @@ func (u *userGorm) InAgeRange(min, max int) ([]User, error) {
 	return users, nil
 }
 
-// ByRemember looks up a user with the given remember token and returns
-// that user. This method expects the remember token already hashed
-func (u *userGorm) ByRemember(rememberHashed string) (*User, error) {
-	var user User
-	err := first(u.db.Where("remember_hash = ?", rememberHashed),
-		&user)
-	if err != nil {
-		return nil, err
+// Search will find a page of users by email, name or handle, newest
+// first.
+func (u *userGorm) Search(query string, offset, limit int) ([]User, int, error) {
+
+	users := make([]User, 0)
+	db := u.db.Model(&User{})
+
+	if query != "" {
+		pattern := "%" + likeEscaper.Replace(query) + "%"
+		db = db.Where("email ILIKE ? OR name ILIKE ? OR handle ILIKE ?",
+			pattern, pattern, pattern)
 	}
 
-	return &user, nil
+	var total int
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	db = db.Order("created_at desc").Offset(offset).Limit(limit)
+	if err := all(db, &users); err != nil {
+		return nil, 0, err
+	}
+
+	return users, total, nil
 }
 
-// ByRemember will hash the remember token and then call ByRemember on
-// the subsequent UserDB layer.
-func (u *userValidator) ByRemember(token string) (*User, error) {
+// Search will trim the query before passing it on to the database
+// layer to perform the query.
+func (u *userValidator) Search(query string, offset, limit int) ([]User, int, error) {
 
-	user := User{
-		Remember: token,
+	if offset < 0 {
+		offset = 0
 	}
 
-	if err := runUserValFns(&user, u.hmacRemember); err != nil {
+	return u.UserDB.Search(strings.TrimSpace(query), offset, limit)
+}
+
+// DeletionScheduledBefore will find all the users that asked for
+// their account to be deleted before the provided time.
+func (u *userGorm) DeletionScheduledBefore(t time.Time) ([]User, error) {
+
+	users := make([]User, 0)
+
+	db := u.db.Where("deletion_scheduled_at < ?", t)
+	err := all(db, &users)
+	if err != nil {
 		return nil, err
 	}
 
-	return u.UserDB.ByRemember(user.RememberHash)
+	return users, nil
 }
 
 /////////////////////////////////////////////////////////////////////
@@ -659,6 +2203,18 @@ func (u *userValidator) ByRemember(token string) (*User, error) {
 //
 /////////////////////////////////////////////////////////////////////
 
+// throttleKeys returns the keys used to throttle an action, the email
+// address key first and then the IP address key, if there is one.
+func throttleKeys(action, email string, client ClientInfo) []string {
+	email = strings.TrimSpace(strings.ToLower(email))
+	keys := []string{action + ":email:" + email}
+	if client.IP != "" {
+		keys = append(keys, action+":ip:"+client.IP)
+	}
+
+	return keys
+}
+
 //
 // first will query using the provided gorm.DB and it will get
 // the first item returned and place it into dst. If nothing is
@@ -679,3 +2235,26 @@ func all(db *gorm.DB, dst interface{}) error {
 	}
 	return err
 }
+
+// likeEscaper escapes the wildcards of a LIKE pattern, so user input
+// is matched literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// byHash calls lookup with the hash of the token under each HMAC key,
+// the primary one first, until something is found. This keeps the
+// tokens issued before a key rotation working. rehash reports whether
+// it was found under a retired key, in which case the stored hash
+// should be replaced with the primary one.
+func byHash(hmac hash.HMAC, token string,
+	lookup func(tokenHash string) error) (rehash bool, err error) {
+
+	for i, h := range hmac.Hashes(token) {
+		err = lookup(h)
+		if err == ErrNotFound {
+			continue
+		}
+		return i > 0 && err == nil, err
+	}
+
+	return false, ErrNotFound
+}
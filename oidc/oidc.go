@@ -0,0 +1,143 @@
+// Package oidc signs users in with an OAuth2 provider, and asks the
+// provider who they are through its OpenID Connect userinfo endpoint.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// maxUserInfoBytes is far more than any userinfo response needs, it
+// only protects us from a misbehaving provider.
+const maxUserInfoBytes = 1 << 20
+
+var (
+	// ErrNoUserInfo is returned when the provider has no userinfo
+	// endpoint configured, so it can only be connected to.
+	ErrNoUserInfo = errors.New("oidc: provider has no userinfo URL")
+
+	// ErrNoSubject is returned when the provider doesn't say which
+	// of its users signed in.
+	ErrNoSubject = errors.New("oidc: userinfo has no subject")
+)
+
+// Provider is an OAuth2 provider users can sign in with.
+type Provider struct {
+	// Name identifies the provider in our URLs, like dropbox.
+	Name string
+
+	// Label is the name displayed to users, like Dropbox.
+	Label string
+
+	Config *oauth2.Config
+
+	// UserInfoURL is the OpenID Connect userinfo endpoint. Most
+	// providers expect a GET request, but some, like Dropbox, want
+	// a POST, which UserInfoMethod can be set to.
+	UserInfoURL    string
+	UserInfoMethod string
+}
+
+// UserInfo is what the provider told us about the user who signed in.
+type UserInfo struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// userInfo are the standard claims we use. Some providers send
+// email_verified as the string "true", so it's decoded by hand.
+type userInfo struct {
+	Subject       string      `json:"sub"`
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"`
+	Name          string      `json:"name"`
+	GivenName     string      `json:"given_name"`
+	FamilyName    string      `json:"family_name"`
+}
+
+// CanSignIn reports whether users can sign in with the provider,
+// rather than only connect it to their account.
+func (p *Provider) CanSignIn() bool {
+	return p.UserInfoURL != ""
+}
+
+// UserInfo asks the provider about the user the token was issued to.
+func (p *Provider) UserInfo(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+
+	if !p.CanSignIn() {
+		return nil, ErrNoUserInfo
+	}
+
+	method := p.UserInfoMethod
+	if method == "" {
+		method = "GET"
+	}
+
+	var body io.Reader
+	if method == "POST" {
+		body = strings.NewReader("{}")
+	}
+
+	req, err := http.NewRequest(method, p.UserInfoURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := p.Config.Client(ctx, token).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc: userinfo of %s: %s", p.Name,
+			res.Status)
+	}
+
+	var info userInfo
+	dec := json.NewDecoder(io.LimitReader(res.Body, maxUserInfoBytes))
+	if err := dec.Decode(&info); err != nil {
+		return nil, err
+	}
+
+	if info.Subject == "" {
+		return nil, ErrNoSubject
+	}
+
+	name := info.Name
+	if name == "" {
+		name = strings.TrimSpace(info.GivenName + " " +
+			info.FamilyName)
+	}
+
+	return &UserInfo{
+		Subject:       info.Subject,
+		Email:         info.Email,
+		EmailVerified: isTrue(info.EmailVerified),
+		Name:          name,
+	}, nil
+}
+
+func isTrue(v interface{}) bool {
+
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	default:
+		return false
+	}
+}
@@ -0,0 +1,80 @@
+// Package pwcheck rejects passwords that are known to attackers or
+// that are easy to guess, before they are ever hashed.
+package pwcheck
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultMinStrength is the lowest Strength accepted when a Policy
+// doesn't say otherwise.
+const DefaultMinStrength = 2
+
+// prefixLen is the number of hex characters of the SHA-1 hash used to
+// name the files of a Dataset, as in the k-anonymity range API of
+// Have I Been Pwned.
+const prefixLen = 5
+
+// Policy decides which passwords users are allowed to pick.
+type Policy struct {
+	// Breached lists the passwords leaked in known data breaches.
+	// Leave it nil to skip that check.
+	Breached *Dataset
+
+	// MinStrength is the lowest Strength accepted, from 0 to 4.
+	MinStrength int
+}
+
+// Dataset is an offline copy of breached password hashes, split by
+// hash prefix like the Have I Been Pwned range API. The directory
+// holds one file per prefix, named like 21BD1.txt, listing the rest
+// of the SHA-1 hashes sharing that prefix as SUFFIX:COUNT lines.
+//
+// Only the one small file matching a password is ever read, so the
+// dataset doesn't have to fit in memory.
+type Dataset struct {
+	dir string
+}
+
+// NewDataset returns the dataset stored in dir.
+func NewDataset(dir string) *Dataset {
+	return &Dataset{
+		dir: dir,
+	}
+}
+
+// Contains reports whether the password appears in the dataset. A
+// prefix without a file is treated as having no breached hashes.
+func (d *Dataset) Contains(password string) (bool, error) {
+
+	sum := sha1.Sum([]byte(password))
+	h := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := h[:prefixLen], h[prefixLen:]
+
+	f, err := os.Open(filepath.Join(d.dir, prefix+".txt"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			line = line[:i]
+		}
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
@@ -0,0 +1,157 @@
+package pwcheck
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// keyboardRows are walked through by passwords like qwerty or asdf,
+// which are no harder to guess than abcd.
+var keyboardRows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+	"abcdefghijklmnopqrstuvwxyz",
+}
+
+// commonWords are the base of countless passwords, usually followed
+// by a few digits or symbols.
+var commonWords = []string{
+	"password", "passw0rd", "qwerty", "letmein", "welcome",
+	"admin", "iloveyou", "monkey", "dragon", "football",
+	"baseball", "sunshine", "princess", "master", "login",
+	"abc123", "trustno1", "lenslocked", "lenslockedbr",
+}
+
+// Strength estimates how hard the password is to guess, from 0 (too
+// guessable) to 4 (very unguessable). The inputs are things an
+// attacker would try first, like the email address or name of the
+// user, which don't make the password any stronger.
+//
+// It's a rough estimate of the entropy of the password, not a
+// replacement for the breached passwords check.
+func Strength(password string, inputs ...string) int {
+
+	bits := entropy(password, inputs)
+
+	switch {
+	case bits < 28:
+		return 0
+	case bits < 40:
+		return 1
+	case bits < 56:
+		return 2
+	case bits < 72:
+		return 3
+	default:
+		return 4
+	}
+}
+
+func entropy(password string, inputs []string) float64 {
+
+	lower := strings.ToLower(password)
+
+	// Only count the part of the password that isn't guessable
+	// from the user themselves or from the most common passwords.
+	for _, input := range append(splitInputs(inputs), commonWords...) {
+		if len(input) >= 3 {
+			lower = strings.Replace(lower, input, "", -1)
+		}
+	}
+
+	runes := []rune(lower)
+	bitsPerRune := math.Log2(float64(poolSize(password)))
+
+	var bits float64
+	for i, r := range runes {
+		if i > 0 && predictable(runes[i-1], r) {
+			bits++
+			continue
+		}
+		bits += bitsPerRune
+	}
+
+	return bits
+}
+
+// splitInputs breaks email addresses and names into the parts an
+// attacker would try on their own.
+func splitInputs(inputs []string) []string {
+
+	var parts []string
+	for _, input := range inputs {
+		input = strings.ToLower(input)
+		parts = append(parts, input)
+		parts = append(parts, strings.FieldsFunc(input, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})...)
+	}
+
+	return parts
+}
+
+// poolSize is the number of characters an attacker would have to try
+// for each position, given the kinds of characters used.
+func poolSize(password string) int {
+
+	var lower, upper, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r > unicode.MaxASCII:
+			other = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	size := 0
+	if lower {
+		size += 26
+	}
+	if upper {
+		size += 26
+	}
+	if digit {
+		size += 10
+	}
+	if symbol {
+		size += 33
+	}
+	if other {
+		size += 100
+	}
+	if size < 2 {
+		size = 2
+	}
+
+	return size
+}
+
+// predictable reports whether cur follows prev in a way guessers try
+// early: a repeated character, or the next one on the keyboard or in
+// the alphabet, in either direction.
+func predictable(prev, cur rune) bool {
+
+	if prev == cur {
+		return true
+	}
+
+	for _, row := range keyboardRows {
+		i := strings.IndexRune(row, prev)
+		j := strings.IndexRune(row, cur)
+		if i >= 0 && j >= 0 && (j-i == 1 || i-j == 1) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -34,6 +34,8 @@ sleep 2
 echo "  Go getting deps..."
 ssh root@leandr0.net -p 2233 "export GOPATH=/root/go; /usr/local/go/bin/go get golang.org/x/crypto/bcrypt"
 
+ssh root@leandr0.net -p 2233 "export GOPATH=/root/go; /usr/local/go/bin/go get golang.org/x/crypto/argon2"
+
 ssh root@leandr0.net -p 2233 "export GOPATH=/root/go; /usr/local/go/bin/go get github.com/gorilla/mux"
 
 ssh root@leandr0.net -p 2233 "export GOPATH=/root/go; /usr/local/go/bin/go get github.com/gorilla/schema"
@@ -52,6 +54,8 @@ ssh root@leandr0.net -p 2233 "export GOPATH=/root/go; /usr/local/go/bin/go get g
 
 ssh root@leandr0.net -p 2233 "export GOPATH=/root/go; /usr/local/go/bin/go get golang.org/x/oauth2"
 
+ssh root@leandr0.net -p 2233 "export GOPATH=/root/go; /usr/local/go/bin/go get github.com/skip2/go-qrcode"
+
 sleep 2
 
 echo "  Building the code on remote server..."
@@ -0,0 +1,140 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"lenslockedbr.com/rand"
+)
+
+const (
+	// SecretBytes is the size of the shared secrets we generate.
+	// RFC 4226 recommends at least 160 bits.
+	SecretBytes = 20
+
+	// Digits is the number of digits in each code.
+	Digits = 6
+
+	// Period is the time step used to derive codes, as recommended
+	// by RFC 6238.
+	Period = 30 * time.Second
+
+	// Skew is the number of periods before and after the current
+	// one that we still accept, to tolerate clock drift on the
+	// user's phone.
+	Skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random base32 encoded secret suitable
+// for adding to an authenticator app.
+func GenerateSecret() (string, error) {
+	b, err := rand.Bytes(SecretBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(b), nil
+}
+
+// Code returns the code for the provided secret at the time t.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return code(key, uint64(t.Unix())/uint64(Period/time.Second)), nil
+}
+
+// Validate reports whether the code is valid for the secret at the
+// time t, allowing for Skew periods of clock drift.
+func Validate(secret, passcode string, t time.Time) bool {
+	_, ok := ValidateCounter(secret, passcode, t)
+	return ok
+}
+
+// ValidateCounter is like Validate, but also returns the time step
+// the code was generated for. Callers can remember it to reject a
+// code that was already used, as RFC 6238 section 5.2 requires.
+func ValidateCounter(secret, passcode string, t time.Time) (int64, bool) {
+	passcode = strings.TrimSpace(passcode)
+	if len(passcode) != Digits {
+		return 0, false
+	}
+
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return 0, false
+	}
+
+	counter := int64(t.Unix()) / int64(Period/time.Second)
+	for i := -Skew; i <= Skew; i++ {
+		expected := code(key, uint64(counter+int64(i)))
+		if hmac.Equal([]byte(expected), []byte(passcode)) {
+			return counter + int64(i), true
+		}
+	}
+
+	return 0, false
+}
+
+// URL builds the otpauth:// URL understood by authenticator apps. It
+// is usually displayed as a QR code.
+func URL(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("digits", fmt.Sprintf("%d", Digits))
+	v.Set("period", fmt.Sprintf("%d", int(Period/time.Second)))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: v.Encode(),
+	}
+
+	return u.String()
+}
+
+/////////////////////////////////////////////////////////////////////
+//
+// Helper functions
+//
+/////////////////////////////////////////////////////////////////////
+
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	secret = strings.TrimRight(secret, "=")
+
+	return encoding.DecodeString(secret)
+}
+
+// code implements the HOTP algorithm from RFC 4226 with the dynamic
+// truncation described in section 5.3.
+func code(key []byte, counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", Digits, value%mod)
+}
@@ -36,6 +36,9 @@ type Data struct {
 	Alert *Alert
 	User  *models.User
 	Yield interface{}
+
+	// Impersonator is the admin acting as User, if any.
+	Impersonator *models.User
 }
 
 func (d *Data) SetAlert(err error) {
@@ -12,6 +12,8 @@ import (
 	"lenslockedbr.com/context"
 
 	"github.com/gorilla/csrf"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday"
 )
 
 var (
@@ -20,6 +22,10 @@ var (
 	TemplateExt string = ".gohtml"
 )
 
+// markdownPolicy is safe to share, policies only being read once
+// set up.
+var markdownPolicy = bluemonday.UGCPolicy()
+
 type View struct {
 	Template *template.Template
 	Layout   string
@@ -37,6 +43,7 @@ func NewView(layout string, notfound bool, files ...string) *View {
 		"pathEscape": func(s string) string {
 			return url.PathEscape(s)
 		},
+		"markdown": markdown,
 	}).ParseFiles(files...)
 	if err != nil {
 		panic(err)
@@ -49,6 +56,13 @@ func NewView(layout string, notfound bool, files ...string) *View {
 	}
 }
 
+// markdown renders text written by users as HTML, keeping only the
+// elements and attributes that are safe to show to others.
+func markdown(s string) template.HTML {
+	html := blackfriday.MarkdownCommon([]byte(s))
+	return template.HTML(markdownPolicy.SanitizeBytes(html))
+}
+
 func (v *View) Render(w http.ResponseWriter, r *http.Request,
 	data interface{}) {
 	var buf bytes.Buffer
@@ -72,6 +86,7 @@ func (v *View) Render(w http.ResponseWriter, r *http.Request,
 	}
 
 	vd.User = context.User(r.Context())
+	vd.Impersonator = context.Impersonator(r.Context())
 
 	csrfField := csrf.TemplateField(r)
 	tpl := v.Template.Funcs(template.FuncMap{